@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/controller"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+// runDecap implements the decap subcommand, which decapsulates stored tunnel
+// captures:
+//
+//	capture-controller decap -o OUT.pcapng FILE...
+func runDecap(args []string) error {
+	fs := flag.NewFlagSet("decap", flag.ExitOnError)
+	output := fs.String("o", "", "Output pcapng file, or - for stdout (required)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s decap -o OUT.pcapng FILE...\n\nWrites the packets of tunnel captures, in order, with VXLAN and Geneve headers removed and kept as packet comments.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *output == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var inputs []*pcap.Reader
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r, err := pcap.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		inputs = append(inputs, r)
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		var err error
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	n, err := controller.Decapsulate(out, inputs...)
+	if out != os.Stdout {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Decapsulated %d packets\n", n)
+	return nil
+}
@@ -5,8 +5,16 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -17,19 +25,144 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "decap" {
+		if err := runDecap(os.Args[2:]); err != nil {
+			klog.Fatalf("Failed to decapsulate: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "summary" {
+		if err := runSummary(os.Args[2:]); err != nil {
+			klog.Fatalf("Failed to summarize: %v", err)
+		}
+		return
+	}
+
 	var (
 		criSocket     string
 		captureDir    string
 		maxConcurrent int
+		listenAddress string
+		apiAuth       bool
+		gcConfig      controller.GCConfig
+		quota         = controller.QuotaConfig{Namespaces: map[string]controller.NamespaceQuota{}}
+		diskWatchdog  controller.DiskWatchdogConfig
+		priorities    = controller.PriorityPolicy{}
+		limits        controller.Limits
+		policy        controller.CapturePolicy
+		policyFile    string
+		fileTemplate  string
+		rulesRef      string
+		watchOwners   bool
+		nsCaptures    bool
+		eventTriggers bool
+		antreaPCs     bool
+		bufferBudget  = int64(controller.DefaultFlightRecorderBudget)
+		captureMode   = controller.CaptureModeNetns
+		gatewayIface  string
+		tunnelIface   string
 	)
 	flag.StringVar(&criSocket, "cri-socket", "", "Path to CRI socket (auto-detected if empty)")
+	flag.Func("capture-mode", "Where to capture: netns enters the Pod's network namespace with nsenter; veth captures the Pod's host-side veth and needs hostNetwork instead (default netns)", func(value string) (err error) {
+		captureMode, err = controller.ParseCaptureMode(value)
+		return err
+	})
+	flag.StringVar(&gatewayIface, "gateway-interface", controller.DefaultGatewayInterface, "Name of the node's gateway interface, captured for node-interfaces=gateway")
+	flag.StringVar(&tunnelIface, "tunnel-interface", controller.DefaultTunnelInterface, "Node interface carrying the VXLAN and Geneve packets between nodes, captured for node-interfaces=tunnel; empty uses the interface of the host's default route")
 	flag.StringVar(&captureDir, "capture-dir", "/", "Directory to store pcap files")
-	flag.IntVar(&maxConcurrent, "max-concurrent", 5, "Maximum concurrent captures")
+	flag.IntVar(&maxConcurrent, "max-concurrent", 5, "Maximum concurrent captures; stop conditions and live stream viewers each add a tcpdump per capture on top of these")
+	flag.StringVar(&fileTemplate, "file-name-template", controller.DefaultFileNameTemplate, "Template for capture file names with {{.Namespace}}, {{.Pod}}, {{.UID}}, {{.Container}} and {{.Start}}; must end in .pcap")
+	flag.StringVar(&listenAddress, "listen-address", "127.0.0.1:9090", "Address for the capture API server (live streams, files, metrics); empty disables it")
+	flag.BoolVar(&apiAuth, "api-auth", false, "Require a bearer token on the capture API, authorized with TokenReview and SubjectAccessReview against pods/"+controller.APISubresource+"; needed when --listen-address is reachable by others, e.g. with hostNetwork")
+	flag.DurationVar(&gcConfig.Interval, "gc-interval", 10*time.Minute, "Interval between sweeps for orphaned capture files; 0 disables the garbage collector")
+	flag.DurationVar(&gcConfig.GracePeriod, "gc-grace-period", time.Hour, "How long an orphaned capture file must be unmodified before it is reclaimed")
+	flag.BoolVar(&gcConfig.DryRun, "gc-dry-run", false, "Only log orphaned capture files instead of reclaiming them")
+	flag.StringVar(&gcConfig.ArchiveDir, "gc-archive-dir", "", "Move orphaned capture files here instead of deleting them")
+	flag.Func("capture-dir-budget", "Total bytes capture files may occupy in --capture-dir, e.g. 10Gi (default unlimited)", func(value string) error {
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return err
+		}
+		quota.Budget = q.Value()
+		return nil
+	})
+	flag.Func("namespace-quota", "Per-namespace quota as <namespace>=<bytes>[/<captures>], e.g. team-a=2Gi/3; use * for the default (repeatable)", func(value string) error {
+		namespace, nq, err := controller.ParseNamespaceQuota(value)
+		if err != nil {
+			return err
+		}
+		quota.Namespaces[namespace] = nq
+		return nil
+	})
+	flag.Func("flight-recorder-budget", "Memory all flight recorder buffers may hold together, e.g. 64Mi; 0 is unlimited (default 64Mi)", func(value string) error {
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return err
+		}
+		bufferBudget = q.Value()
+		return nil
+	})
+	flag.DurationVar(&quota.CheckInterval, "quota-check-interval", 30*time.Second, "How often disk usage is checked against the budget and quotas")
+	flag.IntVar(&limits.MaxFiles, "max-files", 0, "Largest number of rotated files a capture may request; 0 is unlimited")
+	flag.DurationVar(&limits.MaxDuration, "max-duration", 0, "Longest duration a capture may request; when set, a duration is required. 0 is unlimited")
+	flag.Func("priority-policy", "Highest capture priority a namespace may request as <namespace>=<max>, e.g. sre=100; use * for the default, otherwise 0 (repeatable)", func(value string) error {
+		namespace, max, err := controller.ParsePriorityPolicy(value)
+		if err != nil {
+			return err
+		}
+		priorities[namespace] = max
+		return nil
+	})
+	flag.Func("allow-namespace", "Only allow captures in this namespace (repeatable; default all namespaces)", func(value string) error {
+		policy.AllowNamespaces = append(policy.AllowNamespaces, value)
+		return nil
+	})
+	flag.Func("deny-namespace", "Never allow captures in this namespace (repeatable)", func(value string) error {
+		policy.DenyNamespaces = append(policy.DenyNamespaces, value)
+		return nil
+	})
+	flag.Func("require-namespace-label", "Label a Pod's namespace must have to allow captures, e.g. capture-allowed=true", func(value string) (err error) {
+		policy.NamespaceSelector, err = labels.Parse(value)
+		return err
+	})
+	flag.Func("block-pod-label", "Pod label that blocks captures of the Pod, e.g. no-capture", func(value string) (err error) {
+		policy.BlockingPodSelector, err = labels.Parse(value)
+		return err
+	})
+	flag.StringVar(&policyFile, "capture-policy-file", "", "YAML capture policy file, e.g. a mounted ConfigMap; replaces the policy flags and is reloaded when it changes")
+	flag.StringVar(&rulesRef, "capture-rules-configmap", "", "ConfigMap <namespace>/<name> whose "+controller.CaptureRulesKey+" key holds label-selector capture rules; empty disables rules")
+	flag.BoolVar(&watchOwners, "owner-annotations", false, "Let Pods inherit capture annotations from their Deployment, StatefulSet, DaemonSet, Job or ReplicaSet; watches those kinds cluster-wide")
+	flag.BoolVar(&nsCaptures, "namespace-annotations", false, "Let capture annotations on a Namespace apply to all its Pods")
+	flag.BoolVar(&eventTriggers, "event-triggers", false, "Watch Pod Events cluster-wide for the trigger rules of --capture-rules-configmap; without it trigger rules never fire")
+	flag.BoolVar(&antreaPCs, "antrea-packetcaptures", false, "Reconcile Antrea PacketCapture objects (crd.antrea.io/v1alpha1) like capture annotations; watches them cluster-wide")
+	flag.Float64Var(&diskWatchdog.SoftFreePercent, "disk-soft-free-percent", 0, "Refuse new captures when free space or inodes on the capture filesystem drop below this percentage; 0 disables")
+	flag.Float64Var(&diskWatchdog.HardFreePercent, "disk-hard-free-percent", 0, "Stop the largest captures when free space or inodes drop below this percentage; 0 disables")
+	flag.DurationVar(&diskWatchdog.Interval, "disk-check-interval", 10*time.Second, "How often the capture filesystem's free space is checked; 0 disables the watchdog")
 
 	klog.InitFlags(nil)
 	flag.Parse()
 	defer klog.Flush()
 
+	naming, err := controller.NewFileNaming(fileTemplate)
+	if err != nil {
+		klog.Fatalf("Invalid --file-name-template: %v", err)
+	}
+
+	var rulesNamespace, rulesName string
+	if rulesRef != "" {
+		var ok bool
+		rulesNamespace, rulesName, ok = strings.Cut(rulesRef, "/")
+		if !ok || rulesNamespace == "" || rulesName == "" {
+			klog.Fatalf("Invalid --capture-rules-configmap %q: want <namespace>/<name>", rulesRef)
+		}
+	}
+
+	if policyFile != "" {
+		if policy, err = controller.LoadCapturePolicy(policyFile); err != nil {
+			klog.Fatalf("Failed to load capture policy: %v", err)
+		}
+	}
+
 	// Get node name from environment (set via downward API)
 	nodeName := os.Getenv("NODE_NAME")
 	if nodeName == "" {
@@ -81,6 +214,7 @@ func main() {
 
 	// Create the controller
 	ctrl := controller.NewController(
+		clientset,
 		podInformer,
 		nodeName,
 		criSocket,
@@ -88,6 +222,70 @@ func main() {
 		maxConcurrent,
 	)
 
+	ctrl.SetCaptureMode(captureMode)
+	ctrl.SetNodeInterfaces(gatewayIface, tunnelIface)
+	ctrl.SetQuota(quota)
+	ctrl.SetFlightRecorderBudget(bufferBudget)
+	ctrl.SetDiskWatchdog(diskWatchdog)
+	ctrl.SetAPIAuth(apiAuth)
+	ctrl.SetPriorityPolicy(priorities)
+	ctrl.SetLimits(limits)
+	ctrl.SetFileNaming(naming)
+	// A reloaded policy file may start requiring Namespace labels
+	if policyFile != "" || (policy.NamespaceSelector != nil && !policy.NamespaceSelector.Empty()) {
+		ctrl.SetPolicy(policy, informerFactory.Core().V1().Namespaces())
+	} else {
+		ctrl.SetPolicy(policy, nil)
+	}
+	if policyFile != "" {
+		ctrl.SetPolicyFile(policyFile)
+	}
+
+	if nsCaptures {
+		ctrl.SetNamespaceCaptures(informerFactory.Core().V1().Namespaces())
+	}
+	if watchOwners {
+		ctrl.SetOwnerInformers(controller.OwnerInformers{
+			ReplicaSets:  informerFactory.Apps().V1().ReplicaSets(),
+			Deployments:  informerFactory.Apps().V1().Deployments(),
+			StatefulSets: informerFactory.Apps().V1().StatefulSets(),
+			DaemonSets:   informerFactory.Apps().V1().DaemonSets(),
+			Jobs:         informerFactory.Batch().V1().Jobs(),
+		})
+	}
+
+	// Watch only the capture rules ConfigMap
+	var rulesInformerFactory informers.SharedInformerFactory
+	if rulesName != "" {
+		rulesInformerFactory = informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+			informers.WithNamespace(rulesNamespace),
+			informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", rulesName).String()
+			}))
+		ctrl.SetCaptureRules(rulesInformerFactory.Core().V1().ConfigMaps(), rulesName)
+	}
+
+	// Trigger rules only look at Pod Events
+	var eventInformerFactory informers.SharedInformerFactory
+	if rulesName != "" && eventTriggers {
+		eventInformerFactory = informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+			informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.FieldSelector = fields.OneTermEqualSelector("involvedObject.kind", "Pod").String()
+			}))
+		ctrl.SetEventTriggers(eventInformerFactory.Core().V1().Events())
+	}
+
+	// PacketCaptures are not in the typed clientset
+	var dynamicInformerFactory dynamicinformer.DynamicSharedInformerFactory
+	if antreaPCs {
+		dynamicClient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			klog.Fatalf("Failed to create dynamic client: %v", err)
+		}
+		dynamicInformerFactory = dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+		ctrl.SetPacketCaptures(dynamicClient, dynamicInformerFactory.ForResource(controller.PacketCaptureGVR).Informer())
+	}
+
 	// Set up signal handling for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -102,6 +300,29 @@ func main() {
 
 	// Start informers
 	informerFactory.Start(ctx.Done())
+	if rulesInformerFactory != nil {
+		rulesInformerFactory.Start(ctx.Done())
+	}
+	if eventInformerFactory != nil {
+		eventInformerFactory.Start(ctx.Done())
+	}
+	if dynamicInformerFactory != nil {
+		dynamicInformerFactory.Start(ctx.Done())
+	}
+
+	// Start the capture API server
+	if listenAddress != "" {
+		go func() {
+			if err := ctrl.Serve(ctx, listenAddress); err != nil {
+				klog.Fatalf("Error running capture API server: %v", err)
+			}
+		}()
+	}
+
+	// Start the orphaned capture file garbage collector
+	if gcConfig.Interval > 0 {
+		go ctrl.RunGarbageCollector(ctx, gcConfig)
+	}
 
 	// Run the controller
 	if err := ctrl.Run(ctx, 2); err != nil {
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/summary"
+)
+
+// runSummary implements the summary subcommand, which summarises the
+// connections in stored captures:
+//
+//	capture-controller summary [-format json|csv] [-tunnel] [-o OUT] FILE...
+func runSummary(args []string) error {
+	fs := flag.NewFlagSet("summary", flag.ExitOnError)
+	output := fs.String("o", "-", "Output file, or - for stdout")
+	format := fs.String("format", "json", "Output format, json or csv")
+	tunnel := fs.Bool("tunnel", false, "Summarise the packets inside VXLAN and Geneve tunnels")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s summary [-format json|csv] [-tunnel] [-o OUT] FILE...\n\nWrites the connections in pcap captures, read in order, with their packets and bytes each way and TCP handshake and teardown.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (*format != "json" && *format != "csv") || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	t := summary.NewTable()
+	t.Decapsulate = *tunnel
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r, err := pcap.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := t.Read(r); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	report := t.Report()
+
+	out := os.Stdout
+	if *output != "-" {
+		var err error
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	write := report.WriteJSON
+	if *format == "csv" {
+		write = report.WriteCSV
+	}
+	err := write(out)
+	if out != os.Stdout {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Summarized %d packets into %d flows\n", report.Packets, len(report.Flows))
+	return nil
+}
@@ -0,0 +1,74 @@
+// capture-webhook is a validating admission webhook that rejects Pods whose
+// capture annotations the controller would refuse. Run it with the same
+// --max-files, --max-duration and --priority-policy flags as the controller.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/controller"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/webhook"
+)
+
+func main() {
+	var (
+		listenAddress string
+		certFile      string
+		keyFile       string
+		checkFilters  bool
+		limits        controller.Limits
+		priorities    = controller.PriorityPolicy{}
+	)
+	flag.StringVar(&listenAddress, "listen-address", ":8443", "Address to serve the webhook on")
+	flag.StringVar(&certFile, "tls-cert-file", "/etc/webhook/tls/tls.crt", "TLS certificate file")
+	flag.StringVar(&keyFile, "tls-private-key-file", "/etc/webhook/tls/tls.key", "TLS private key file")
+	flag.BoolVar(&checkFilters, "check-filters", true, "Compile filters with tcpdump to reject invalid syntax")
+	flag.IntVar(&limits.MaxFiles, "max-files", 0, "Largest number of rotated files a capture may request; 0 is unlimited")
+	flag.DurationVar(&limits.MaxDuration, "max-duration", 0, "Longest duration a capture may request; when set, a duration is required. 0 is unlimited")
+	flag.Func("priority-policy", "Highest capture priority a namespace may request as <namespace>=<max>, e.g. sre=100; use * for the default, otherwise 0 (repeatable)", func(value string) error {
+		namespace, max, err := controller.ParsePriorityPolicy(value)
+		if err != nil {
+			return err
+		}
+		priorities[namespace] = max
+		return nil
+	})
+
+	klog.InitFlags(nil)
+	flag.Parse()
+	defer klog.Flush()
+
+	mux := http.NewServeMux()
+	mux.Handle("/validate", webhook.NewValidator(limits, priorities, checkFilters))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	srv := &http.Server{
+		Addr:              listenAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		klog.Info("Received shutdown signal, stopping webhook...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	klog.InfoS("Starting capture annotation webhook", "address", listenAddress, "checkFilters", checkFilters)
+	if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		klog.Fatalf("Error running webhook server: %v", err)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/controller"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+func runFetch(ctx context.Context, args []string) (err error) {
+	var (
+		o      options
+		output string
+		follow bool
+		iface  string
+		decap  bool
+		flow   bool
+		report string
+	)
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	o.addFlags(fs)
+	fs.StringVar(&output, "o", "", "Output pcap file, or - for stdout (defaults to <pod>.pcap)")
+	fs.BoolVar(&follow, "follow", false, "Stream live packets instead of downloading the rotated files")
+	fs.BoolVar(&follow, "f", false, "Shorthand for --follow")
+	fs.StringVar(&iface, "interface", "", "Fetch the files of this node interface capture, e.g. antrea-gw0, instead of the Pod's")
+	fs.BoolVar(&decap, "decap", false, "With --interface, fetch the decapsulated pcapng of a stopped tunnel capture")
+	fs.BoolVar(&flow, "flow", false, "Fetch both ends of a two-ended capture, from both nodes, as one merged pcap")
+	fs.StringVar(&report, "summary", "", "Fetch the connection summary of a stopped capture, as json or csv, instead of its packets")
+	podName, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := o.complete(); err != nil {
+		return err
+	}
+	if decap && iface == "" {
+		return fmt.Errorf("--decap needs the --interface of a tunnel capture")
+	}
+	if flow && (follow || iface != "") {
+		return fmt.Errorf("--flow cannot be combined with --follow or --interface")
+	}
+	if report != "" && report != "json" && report != "csv" {
+		return fmt.Errorf("invalid --summary %q: want json or csv", report)
+	}
+	if report != "" && (follow || decap || flow) {
+		return fmt.Errorf("--summary cannot be combined with --follow, --decap or --flow")
+	}
+	if output == "" {
+		output = podName + ".pcap"
+		switch {
+		case decap:
+			output = podName + "-" + iface + ".pcapng"
+		case report != "" && iface != "":
+			output = podName + "-" + iface + ".summary." + report
+		case report != "":
+			output = podName + ".summary." + report
+		}
+	}
+
+	pod, err := o.clientset.CoreV1().Pods(o.namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if flow {
+		out, finish, openErr := openOutput(output)
+		if openErr != nil {
+			return openErr
+		}
+		defer func() { err = finish(err) }()
+		return fetchFlow(ctx, &o, pod, out)
+	}
+	controllerPod, err := findControllerPod(ctx, &o, pod.Spec.NodeName)
+	if err != nil {
+		return err
+	}
+
+	baseURL, stop, err := forwardToController(&o, controllerPod)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	capturePath := baseURL + "/captures/" + url.PathEscape(pod.Namespace) + "/" + url.PathEscape(pod.Name)
+
+	out, finish, err := openOutput(output)
+	if err != nil {
+		return err
+	}
+	defer func() { err = finish(err) }()
+
+	if follow {
+		if iface != "" {
+			return fmt.Errorf("--follow streams the Pod's capture only")
+		}
+		body, err := get(ctx, capturePath+"/stream")
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		fmt.Fprintf(os.Stderr, "Streaming %s/%s from %s (Ctrl-C to stop)\n", pod.Namespace, pod.Name, controllerPod.Name)
+		_, err = io.Copy(out, body)
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	if decap {
+		return fetchStoppedFile(ctx, capturePath, out, "decapsulated file of interface "+iface,
+			func(f controller.CaptureFile) bool { return f.Interface == iface && f.Decapsulated })
+	}
+	if report != "" {
+		what := report + " summary"
+		if iface != "" {
+			what += " of interface " + iface
+		}
+		return fetchStoppedFile(ctx, capturePath, out, what, func(f controller.CaptureFile) bool {
+			return f.Interface == iface && f.Summary && strings.HasSuffix(f.Name, "."+report)
+		})
+	}
+	return fetchFiles(ctx, capturePath, iface, out)
+}
+
+// findControllerPod returns the running controller Pod on nodeName.
+func findControllerPod(ctx context.Context, o *options, nodeName string) (*corev1.Pod, error) {
+	if nodeName == "" {
+		return nil, fmt.Errorf("pod is not scheduled to a node")
+	}
+	pods, err := o.clientset.CoreV1().Pods(o.controllerNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: o.controllerSelector,
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		if pods.Items[i].Status.Phase == corev1.PodRunning {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no running capture controller found on node %s", nodeName)
+}
+
+// forwardToController port-forwards a local port to the controller API and
+// returns its base URL.
+func forwardToController(o *options, pod *corev1.Pod) (string, func(), error) {
+	transport, upgrader, err := spdy.RoundTripperFor(o.config)
+	if err != nil {
+		return "", nil, err
+	}
+	req := o.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+
+	stopCh := make(chan struct{})
+	readyCh := make(chan struct{})
+	fw, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"},
+		[]string{fmt.Sprintf("0:%d", o.controllerPort)}, stopCh, readyCh, io.Discard, os.Stderr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- fw.ForwardPorts() }()
+	select {
+	case <-readyCh:
+	case err := <-errCh:
+		return "", nil, fmt.Errorf("port-forward to %s failed: %w", pod.Name, err)
+	}
+
+	ports, err := fw.GetPorts()
+	if err != nil {
+		close(stopCh)
+		return "", nil, err
+	}
+	return fmt.Sprintf("http://127.0.0.1:%d", ports[0].Local), func() { close(stopCh) }, nil
+}
+
+// fetchFiles downloads every rotated file of the capture of iface, or of the
+// Pod if iface is empty, and writes them to out as one pcap merged by
+// timestamp.
+func fetchFiles(ctx context.Context, capturePath, iface string, out io.Writer) error {
+	tmpDir, err := os.MkdirTemp("", "kubectl-pcap-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	readers, closeFiles, err := downloadFiles(ctx, capturePath, iface, tmpDir)
+	if err != nil {
+		return err
+	}
+	defer closeFiles()
+	return pcap.Merge(out, readers...)
+}
+
+// fetchFlow downloads the files of both ends of the two-ended capture of pod
+// from the controllers on their nodes and writes them to out as one pcap
+// merged by timestamp.
+func fetchFlow(ctx context.Context, o *options, pod *corev1.Pod, out io.Writer) error {
+	status, err := controller.ParseCaptureStatus(pod.Annotations)
+	if err != nil {
+		return err
+	}
+	if status == nil || status.FlowID == "" {
+		return fmt.Errorf("pod %s/%s has no running two-ended capture", pod.Namespace, pod.Name)
+	}
+	namespace, name, _ := cache.SplitMetaNamespaceKey(status.Peer)
+	peer, err := o.clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "kubectl-pcap-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var readers []*pcap.Reader
+	for _, p := range []*corev1.Pod{pod, peer} {
+		if s, _ := controller.ParseCaptureStatus(p.Annotations); s == nil || s.FlowID != status.FlowID {
+			return fmt.Errorf("pod %s/%s has not started its end of %s", p.Namespace, p.Name, status.FlowID)
+		}
+		controllerPod, err := findControllerPod(ctx, o, p.Spec.NodeName)
+		if err != nil {
+			return err
+		}
+		baseURL, stop, err := forwardToController(o, controllerPod)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(tmpDir, p.Namespace+"_"+p.Name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			stop()
+			return err
+		}
+		capturePath := baseURL + "/captures/" + url.PathEscape(p.Namespace) + "/" + url.PathEscape(p.Name)
+		rs, closeFiles, err := downloadFiles(ctx, capturePath, "", dir)
+		stop()
+		if err != nil {
+			return fmt.Errorf("pod %s/%s: %w", p.Namespace, p.Name, err)
+		}
+		defer closeFiles()
+		readers = append(readers, rs...)
+	}
+	fmt.Fprintf(os.Stderr, "Merging both ends of %s\n", status.FlowID)
+	return pcap.Merge(out, readers...)
+}
+
+// downloadFiles downloads every rotated file of the capture of iface, or of
+// the Pod if iface is empty, into dir and opens them. The returned function
+// closes the files.
+func downloadFiles(ctx context.Context, capturePath, iface, dir string) ([]*pcap.Reader, func(), error) {
+	files, err := listFiles(ctx, capturePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	files = slices.DeleteFunc(files, func(f controller.CaptureFile) bool {
+		return f.Interface != iface || f.Decapsulated || f.Summary
+	})
+	if len(files) == 0 && iface != "" {
+		return nil, nil, fmt.Errorf("capture has no files of interface %s", iface)
+	}
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("capture has no files yet")
+	}
+
+	var (
+		readers []*pcap.Reader
+		opened  []*os.File
+	)
+	closeFiles := func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name)
+		if err := download(ctx, capturePath+"/files/"+url.PathEscape(f.Name), path); err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+		opened = append(opened, file)
+
+		r, err := pcap.NewReader(file)
+		if err != nil {
+			// An empty file that tcpdump just rotated into has no header yet.
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", f.Name, err)
+			continue
+		}
+		readers = append(readers, r)
+		fmt.Fprintf(os.Stderr, "Fetched %s (%d bytes)\n", f.Name, f.Size)
+	}
+	if len(readers) == 0 {
+		closeFiles()
+		return nil, nil, fmt.Errorf("no readable capture files")
+	}
+	return readers, closeFiles, nil
+}
+
+// fetchStoppedFile writes the file of the capture that match selects to out:
+// one the controller writes when the capture stops, like the decapsulated
+// copy of a tunnel capture. what describes it when there is none yet.
+func fetchStoppedFile(ctx context.Context, capturePath string, out io.Writer, what string, match func(controller.CaptureFile) bool) error {
+	files, err := listFiles(ctx, capturePath)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(files, match)
+	if i < 0 {
+		return fmt.Errorf("capture has no %s; it is written when the capture stops", what)
+	}
+	body, err := get(ctx, capturePath+"/files/"+url.PathEscape(files[i].Name))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if _, err := io.Copy(out, body); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Fetched %s (%d bytes)\n", files[i].Name, files[i].Size)
+	return nil
+}
+
+// listFiles returns the files of the capture, oldest first.
+func listFiles(ctx context.Context, capturePath string) ([]controller.CaptureFile, error) {
+	body, err := get(ctx, capturePath+"/files")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var files []controller.CaptureFile
+	if err := json.NewDecoder(body).Decode(&files); err != nil {
+		return nil, fmt.Errorf("failed to decode file list: %w", err)
+	}
+	// Names become paths in the download directory
+	for _, f := range files {
+		if f.Name == "" || filepath.Base(f.Name) != f.Name || strings.HasPrefix(f.Name, ".") {
+			return nil, fmt.Errorf("controller listed an invalid file name %q", f.Name)
+		}
+	}
+	return files, nil
+}
+
+func download(ctx context.Context, fileURL, path string) error {
+	body, err := get(ctx, fileURL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// apiClient sends requests to the controller API through the port-forward,
+// with the credentials of the kubeconfig.
+var apiClient = http.DefaultClient
+
+func get(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %s", req.URL.Path, resp.Status, msg)
+	}
+	return resp.Body, nil
+}
+
+// openOutput returns where to write the output at path, "-" for stdout. The
+// file is written under a temporary name; the returned function, given the
+// result of writing it, renames it to path on success and removes it
+// otherwise, so a failed fetch leaves an existing file alone.
+func openOutput(path string) (io.Writer, func(error) error, error) {
+	if path == "-" {
+		return os.Stdout, func(err error) error { return err }, nil
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func(err error) error {
+		if err == nil {
+			err = f.Chmod(0644)
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+		return nil
+	}, nil
+}
@@ -0,0 +1,436 @@
+// kubectl-pcap is a kubectl plugin for the packet capture controller.
+//
+//	kubectl pcap start POD [--files N] [--filter EXPR] [--duration D] [--priority P]
+//	                       [--schedule CRON --duration D [--keep-sessions N]]
+//	                       [--flight-recorder 30s,16Mi [--post-trigger D] [--trigger-match PRED]]
+//	                       [--stop-on PRED] [--stop-on-filter EXPR] [--stop-tail D]
+//	                       [--node-interfaces gateway,tunnel] [--peer [NAMESPACE/]POD] [--packet-count N]
+//	kubectl pcap trigger POD
+//	kubectl pcap status POD [--watch]
+//	kubectl pcap stop POD
+//	kubectl pcap fetch POD [-o FILE] [--follow | --flow | [--interface IFACE] [--decap | --summary json|csv]]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/controller"
+)
+
+const usage = `Usage: kubectl pcap <command> POD [flags]
+
+Commands:
+  start    Request a capture by annotating the Pod
+  status   Show the capture status reported by the controller
+  trigger  Dump a flight recorder's buffer to a file
+  stop     Remove the capture annotations (the controller deletes the files)
+  fetch    Download the capture files from the node as one merged pcap
+`
+
+// options are the flags shared by every command.
+type options struct {
+	kubeconfig          string
+	kubeContext         string
+	namespace           string
+	controllerNamespace string
+	controllerSelector  string
+	controllerPort      int
+
+	config    *rest.Config
+	clientset kubernetes.Interface
+}
+
+func (o *options) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file")
+	fs.StringVar(&o.kubeContext, "context", "", "Kubeconfig context to use")
+	fs.StringVar(&o.namespace, "namespace", "", "Namespace of the Pod (defaults to the kubeconfig namespace)")
+	fs.StringVar(&o.namespace, "n", "", "Shorthand for --namespace")
+	fs.StringVar(&o.controllerNamespace, "controller-namespace", "kube-system", "Namespace of the capture controller DaemonSet")
+	fs.StringVar(&o.controllerSelector, "controller-selector", "app=capture-controller", "Label selector of the capture controller Pods")
+	fs.IntVar(&o.controllerPort, "controller-port", 9090, "Port of the capture controller API")
+}
+
+// complete builds the client from the kubeconfig.
+func (o *options) complete() error {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if o.kubeconfig != "" {
+		rules.ExplicitPath = o.kubeconfig
+	}
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: o.kubeContext})
+
+	var err error
+	if o.namespace == "" {
+		if o.namespace, _, err = loader.Namespace(); err != nil {
+			return err
+		}
+	}
+	if o.config, err = loader.ClientConfig(); err != nil {
+		return err
+	}
+	if o.clientset, err = kubernetes.NewForConfig(o.config); err != nil {
+		return err
+	}
+	// Controllers run with --api-auth check the kubeconfig's bearer token
+	transport, err := rest.HTTPWrappersForConfig(o.config, http.DefaultTransport)
+	if err != nil {
+		return err
+	}
+	apiClient = &http.Client{Transport: transport}
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var err error
+	switch os.Args[1] {
+	case "start":
+		err = runStart(ctx, os.Args[2:])
+	case "status":
+		err = runStatus(ctx, os.Args[2:])
+	case "trigger":
+		err = runTrigger(ctx, os.Args[2:])
+	case "stop":
+		err = runStop(ctx, os.Args[2:])
+	case "fetch":
+		err = runFetch(ctx, os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseArgs parses flags that may appear before or after the Pod name and
+// returns the Pod name.
+func parseArgs(fs *flag.FlagSet, args []string) (string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return "", err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != 1 {
+		return "", fmt.Errorf("expected exactly one POD argument, got %d", len(positional))
+	}
+	return positional[0], nil
+}
+
+func runStart(ctx context.Context, args []string) error {
+	var (
+		o   options
+		cfg controller.CaptureConfig
+	)
+	fs := flag.NewFlagSet("start", flag.ExitOnError)
+	o.addFlags(fs)
+	fs.IntVar(&cfg.MaxFiles, "files", 5, "Number of rotated 1MB files to keep")
+	fs.StringVar(&cfg.Filter, "filter", "", "tcpdump filter expression")
+	fs.DurationVar(&cfg.Duration, "duration", 0, "Stop the capture after this long (0 runs until stopped)")
+	fs.IntVar(&cfg.Priority, "priority", 0, "Capture priority; higher priorities may preempt lower ones when slots are full")
+	fs.StringVar(&cfg.Schedule, "schedule", "", "Cron expression to capture for --duration each time it fires, e.g. \"0 2 * * *\"")
+	fs.IntVar(&cfg.KeepSessions, "keep-sessions", 0, fmt.Sprintf("Number of scheduled capture sessions to keep (default %d)", controller.DefaultKeepSessions))
+	var flightRecorder string
+	fs.StringVar(&flightRecorder, "flight-recorder", "", "Keep the last packets in memory instead of writing files, bounded by time, size or both, e.g. 30s,16Mi")
+	fs.DurationVar(&cfg.PostTrigger, "post-trigger", controller.DefaultPostTrigger, "How long a flight recorder keeps writing after a trigger")
+	fs.StringVar(&cfg.TriggerMatch, "trigger-match", "", "Packet predicate that triggers a flight recorder, e.g. \"tcp.flags=rst port=5432\"")
+	fs.StringVar(&cfg.StopOn, "stop-on", "", "Finish the capture after the first packet matching this predicate, e.g. \"http.status=503\"")
+	fs.StringVar(&cfg.StopOnFilter, "stop-on-filter", "", "Finish the capture after the first packet matching this tcpdump filter, e.g. \"tcp[tcpflags] & tcp-rst != 0\"")
+	fs.DurationVar(&cfg.StopTail, "stop-tail", controller.DefaultStopTail, "How long the capture continues after its stop condition matched")
+	var nodeInterfaces string
+	fs.StringVar(&cfg.Peer, "peer", "", "Also capture the flows with this Pod on its node, as [namespace/]name; the capture only keeps packets between the two Pods")
+	fs.StringVar(&nodeInterfaces, "node-interfaces", "", "Also capture these node interfaces, filtered to the Pod's IPs: gateway, tunnel or both, e.g. gateway,tunnel")
+	fs.IntVar(&cfg.PacketCount, "packet-count", 0, "Finish the capture after this many packets (0 for no limit)")
+	podName, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if nodeInterfaces != "" {
+		annotations := map[string]string{controller.AnnotationKey: "1", controller.NodeInterfacesAnnotationKey: nodeInterfaces}
+		parsed, err := controller.ParseCaptureConfig(annotations)
+		if err != nil {
+			return err
+		}
+		cfg.NodeInterfaces = parsed.NodeInterfaces
+	}
+	if !cfg.StopCondition() {
+		cfg.StopTail = 0
+	}
+	if flightRecorder != "" {
+		annotations := map[string]string{controller.AnnotationKey: "1", controller.FlightRecorderAnnotationKey: flightRecorder}
+		parsed, err := controller.ParseCaptureConfig(annotations)
+		if err != nil {
+			return err
+		}
+		cfg.BufferDuration, cfg.BufferBytes = parsed.BufferDuration, parsed.BufferBytes
+	} else {
+		cfg.PostTrigger = 0
+	}
+	if cfg.Schedule != "" && cfg.KeepSessions == 0 {
+		cfg.KeepSessions = controller.DefaultKeepSessions
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if err := o.complete(); err != nil {
+		return err
+	}
+
+	if err := patchAnnotations(ctx, &o, podName, cfg.Annotations()); err != nil {
+		return err
+	}
+	fmt.Printf("Capture requested for pod %s/%s\n", o.namespace, podName)
+	return nil
+}
+
+func runStop(ctx context.Context, args []string) error {
+	var o options
+	fs := flag.NewFlagSet("stop", flag.ExitOnError)
+	o.addFlags(fs)
+	podName, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := o.complete(); err != nil {
+		return err
+	}
+
+	err = patchAnnotations(ctx, &o, podName, map[string]interface{}{
+		controller.AnnotationKey:               nil,
+		controller.FilterAnnotationKey:         nil,
+		controller.DurationAnnotationKey:       nil,
+		controller.PriorityAnnotationKey:       nil,
+		controller.ScheduleAnnotationKey:       nil,
+		controller.KeepSessionsAnnotationKey:   nil,
+		controller.FlightRecorderAnnotationKey: nil,
+		controller.PostTriggerAnnotationKey:    nil,
+		controller.TriggerMatchAnnotationKey:   nil,
+		controller.TriggerAnnotationKey:        nil,
+		controller.StopOnAnnotationKey:         nil,
+		controller.StopOnFilterAnnotationKey:   nil,
+		controller.StopTailAnnotationKey:       nil,
+		controller.NodeInterfacesAnnotationKey: nil,
+		controller.PeerAnnotationKey:           nil,
+		controller.PacketCountAnnotationKey:    nil,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Capture stopped for pod %s/%s\n", o.namespace, podName)
+	return nil
+}
+
+// runTrigger triggers a flight recorder by changing the Pod's trigger
+// annotation.
+func runTrigger(ctx context.Context, args []string) error {
+	var o options
+	fs := flag.NewFlagSet("trigger", flag.ExitOnError)
+	o.addFlags(fs)
+	podName, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := o.complete(); err != nil {
+		return err
+	}
+
+	err = patchAnnotations(ctx, &o, podName, map[string]interface{}{
+		controller.TriggerAnnotationKey: time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Flight recorder triggered for pod %s/%s\n", o.namespace, podName)
+	return nil
+}
+
+func runStatus(ctx context.Context, args []string) error {
+	var (
+		o      options
+		follow bool
+	)
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	o.addFlags(fs)
+	fs.BoolVar(&follow, "watch", false, "Keep printing the status as it changes")
+	fs.BoolVar(&follow, "w", false, "Shorthand for --watch")
+	podName, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := o.complete(); err != nil {
+		return err
+	}
+
+	pod, err := o.clientset.CoreV1().Pods(o.namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if err := printStatus(pod); err != nil || !follow {
+		return err
+	}
+	return watchStatus(ctx, &o, pod)
+}
+
+// watchStatus prints the Pod's capture status whenever it changes.
+func watchStatus(ctx context.Context, o *options, pod *corev1.Pod) error {
+	last := pod.Annotations[controller.StatusAnnotationKey]
+	w, err := o.clientset.CoreV1().Pods(o.namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", pod.Name).String(),
+		ResourceVersion: pod.ResourceVersion,
+	})
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return fmt.Errorf("watch closed")
+			}
+			switch event.Type {
+			case watch.Deleted:
+				fmt.Println("Pod deleted")
+				return nil
+			case watch.Added, watch.Modified:
+				p, ok := event.Object.(*corev1.Pod)
+				if !ok || p.Annotations[controller.StatusAnnotationKey] == last {
+					continue
+				}
+				last = p.Annotations[controller.StatusAnnotationKey]
+				if err := printStatus(p); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// printStatus prints the Pod's capture request and status.
+func printStatus(pod *corev1.Pod) error {
+	cfg, cfgErr := controller.ParseCaptureConfig(pod.Annotations)
+	status, err := controller.ParseCaptureStatus(pod.Annotations)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintf(tw, "Pod:\t%s/%s\n", pod.Namespace, pod.Name)
+	switch {
+	case cfgErr != nil:
+		fmt.Fprintf(tw, "Request:\tinvalid: %v\n", cfgErr)
+	case cfg == nil && status != nil && status.FlowSource != "":
+		fmt.Fprintf(tw, "Request:\ttwo-ended capture from %s\n", status.FlowSource)
+	case cfg == nil && status != nil && status.PacketCapture != "":
+		fmt.Fprintf(tw, "Request:\tPacketCapture %s\n", status.PacketCapture)
+	case cfg == nil && status != nil && status.Owner != "":
+		fmt.Fprintf(tw, "Request:\tinherited from %s\n", status.Owner)
+	case cfg == nil && status != nil && status.NamespaceWide:
+		fmt.Fprintf(tw, "Request:\tinherited from namespace %s\n", pod.Namespace)
+	case cfg == nil && status != nil && status.Trigger != "":
+		fmt.Fprintf(tw, "Request:\ttriggered by %s\n", status.Trigger)
+	case cfg == nil && status != nil && status.Rule != "":
+		fmt.Fprintf(tw, "Request:\tcapture rule %s\n", status.Rule)
+	case cfg == nil:
+		fmt.Fprintf(tw, "Request:\tnone\n")
+	default:
+		fmt.Fprintf(tw, "Request:\tfiles=%d filter=%q duration=%s priority=%d\n", cfg.MaxFiles, cfg.Filter, cfg.Duration, cfg.Priority)
+		if cfg.Schedule != "" {
+			fmt.Fprintf(tw, "Schedule:\t%q keep-sessions=%d\n", cfg.Schedule, cfg.KeepSessions)
+		}
+		if cfg.FlightRecorder() {
+			fmt.Fprintf(tw, "Flight recorder:\t%s post-trigger=%s trigger-match=%q\n", pod.Annotations[controller.FlightRecorderAnnotationKey], cfg.PostTrigger, cfg.TriggerMatch)
+		}
+		if cfg.StopCondition() {
+			fmt.Fprintf(tw, "Stop on:\t%q filter=%q tail=%s\n", cfg.StopOn, cfg.StopOnFilter, cfg.StopTail)
+		}
+		if cfg.NodeInterfaces != "" {
+			fmt.Fprintf(tw, "Node interfaces:\t%s\n", cfg.NodeInterfaces)
+		}
+		if cfg.Peer != "" {
+			fmt.Fprintf(tw, "Peer:\t%s\n", cfg.Peer)
+		}
+		if cfg.PacketCount > 0 {
+			fmt.Fprintf(tw, "Packet count:\t%d\n", cfg.PacketCount)
+		}
+	}
+	if status == nil {
+		fmt.Fprintf(tw, "Phase:\t<not reported>\n")
+		return nil
+	}
+	fmt.Fprintf(tw, "Phase:\t%s\n", status.Phase)
+	fmt.Fprintf(tw, "Node:\t%s\n", status.Node)
+	if status.Preempted {
+		fmt.Fprintf(tw, "Preempted:\tyes\n")
+	}
+	if status.QueuePosition > 0 {
+		fmt.Fprintf(tw, "Queue position:\t%d\n", status.QueuePosition)
+	}
+	if status.FlowID != "" {
+		fmt.Fprintf(tw, "Flow:\t%s with %s\n", status.FlowID, status.Peer)
+	}
+	if status.Files != "" {
+		fmt.Fprintf(tw, "Files:\t%s\n", status.Files)
+	}
+	if status.StartTime != nil {
+		fmt.Fprintf(tw, "Started:\t%s\n", status.StartTime.Format(time.RFC3339))
+	}
+	if status.NextCapture != nil {
+		fmt.Fprintf(tw, "Next capture:\t%s\n", status.NextCapture.Format(time.RFC3339))
+	}
+	if status.Message != "" {
+		fmt.Fprintf(tw, "Message:\t%s\n", status.Message)
+	}
+	fmt.Fprintln(tw)
+	return nil
+}
+
+// patchAnnotations merge-patches the Pod's annotations; nil values remove keys.
+func patchAnnotations(ctx context.Context, o *options, podName string, annotations map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = o.clientset.CoreV1().Pods(o.namespace).Patch(ctx, podName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,545 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/cron"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/packet"
+)
+
+// Annotation keys understood by the controller. They are shared with the
+// kubectl plugin so that client and server always agree on the format.
+const (
+	// AnnotationKey requests a capture; the value is the number of rotated
+	// 1MB files to keep.
+	AnnotationKey = "tcpdump.antrea.io"
+	// FilterAnnotationKey holds an optional tcpdump filter expression.
+	FilterAnnotationKey = "tcpdump.antrea.io/filter"
+	// DurationAnnotationKey holds an optional capture duration (e.g. "5m").
+	DurationAnnotationKey = "tcpdump.antrea.io/duration"
+	// PriorityAnnotationKey holds an optional integer capture priority.
+	// Higher priorities are started first and may preempt lower ones.
+	PriorityAnnotationKey = "tcpdump.antrea.io/priority"
+	// ScheduleAnnotationKey holds an optional cron expression (e.g.
+	// "0 2 * * *"). Each time it fires, a new capture session runs for the
+	// capture duration, which is then required.
+	ScheduleAnnotationKey = "tcpdump.antrea.io/schedule"
+	// KeepSessionsAnnotationKey holds how many sessions of a scheduled
+	// capture to keep, DefaultKeepSessions if unset.
+	KeepSessionsAnnotationKey = "tcpdump.antrea.io/keep-sessions"
+	// FlightRecorderAnnotationKey turns the capture into a flight recorder
+	// that keeps the last packets in memory instead of writing files. The
+	// value bounds the buffer by time, size or both, e.g. "30s", "16Mi" or
+	// "30s,16Mi".
+	FlightRecorderAnnotationKey = "tcpdump.antrea.io/flight-recorder"
+	// PostTriggerAnnotationKey holds how long a flight recorder keeps
+	// writing after a trigger, DefaultPostTrigger if unset.
+	PostTriggerAnnotationKey = "tcpdump.antrea.io/post-trigger"
+	// TriggerMatchAnnotationKey holds a packet predicate (see
+	// packet.ParsePredicate) that triggers a flight recorder.
+	TriggerMatchAnnotationKey = "tcpdump.antrea.io/trigger-match"
+	// StopOnAnnotationKey holds a packet predicate (see
+	// packet.ParsePredicate) that finishes the capture once a packet
+	// matches it.
+	StopOnAnnotationKey = "tcpdump.antrea.io/stop-on"
+	// StopOnFilterAnnotationKey holds a tcpdump filter expression that
+	// finishes the capture once a packet matches it. With
+	// StopOnAnnotationKey, a packet must match both.
+	StopOnFilterAnnotationKey = "tcpdump.antrea.io/stop-on-filter"
+	// StopTailAnnotationKey holds how long the capture continues after its
+	// stop condition matched, DefaultStopTail if unset.
+	StopTailAnnotationKey = "tcpdump.antrea.io/stop-tail"
+	// NodeInterfacesAnnotationKey adds captures of node-level interfaces,
+	// filtered to the Pod's IPs, as a comma-separated list of
+	// NodeInterfaceGateway and NodeInterfaceTunnel.
+	NodeInterfacesAnnotationKey = "tcpdump.antrea.io/node-interfaces"
+	// PeerAnnotationKey makes the capture of a Pod one end of a two-ended
+	// capture of its flows with the Pod it names, as namespace/name or as
+	// a name in the same namespace. The annotated Pod is the source.
+	PeerAnnotationKey = "tcpdump.antrea.io/peer"
+	// PacketCountAnnotationKey holds an optional number of packets after
+	// which the capture finishes.
+	PacketCountAnnotationKey = "tcpdump.antrea.io/packet-count"
+	// TriggerAnnotationKey triggers a flight recorder whenever its value
+	// changes. It is not part of the capture request.
+	TriggerAnnotationKey = "tcpdump.antrea.io/trigger"
+	// StatusAnnotationKey is written by the controller with a JSON
+	// CaptureStatus.
+	StatusAnnotationKey = "tcpdump.antrea.io/status"
+)
+
+const maxFilterLength = 1024
+
+// Flight recorder defaults and limits.
+const (
+	// DefaultFlightRecorderBytes bounds a buffer given only by time.
+	DefaultFlightRecorderBytes = 16 << 20
+	// MaxFlightRecorderBytes bounds every buffer, as it is held in memory.
+	// It equals DefaultFlightRecorderBudget, so one buffer always fits.
+	MaxFlightRecorderBytes = 64 << 20
+	// DefaultPostTrigger is how long a flight recorder keeps writing after
+	// a trigger.
+	DefaultPostTrigger = 30 * time.Second
+)
+
+// DefaultStopTail is how long a capture continues after its stop condition
+// matched, so the packets that follow it are captured too.
+const DefaultStopTail = 5 * time.Second
+
+// DefaultKeepSessions is how many sessions of a scheduled capture are kept
+// when KeepSessionsAnnotationKey is unset.
+const DefaultKeepSessions = 3
+
+// CaptureConfig is the capture requested by a Pod's annotations.
+type CaptureConfig struct {
+	MaxFiles int
+	Filter   string
+	Duration time.Duration
+	Priority int
+	// Schedule is the cron expression of a recurring capture, empty for a
+	// capture that starts right away.
+	Schedule     string
+	KeepSessions int
+	// A flight recorder buffers the last BufferDuration and at most
+	// BufferBytes of packets, and writes them with the next PostTrigger of
+	// packets to the next of MaxFiles files when triggered.
+	BufferDuration time.Duration
+	BufferBytes    int64
+	PostTrigger    time.Duration
+	TriggerMatch   string
+	// A capture with a stop condition finishes StopTail after the first
+	// packet that matches StopOn and StopOnFilter.
+	StopOn       string
+	StopOnFilter string
+	StopTail     time.Duration
+	// NodeInterfaces lists the node-level interfaces also captured, in
+	// the canonical order of parseNodeInterfaces.
+	NodeInterfaces string
+	// Peer is the other end of a two-ended capture. The controller
+	// resolves it to namespace/name, sets FlowID, which both ends share,
+	// and adds the flows between the two Pods to Filter.
+	Peer   string
+	FlowID string
+	// PacketCount finishes the capture after that many packets, 0 for no
+	// limit.
+	PacketCount int
+}
+
+// ParseCaptureConfig reads the capture annotations. It returns nil without an
+// error when no capture is requested.
+func ParseCaptureConfig(annotations map[string]string) (*CaptureConfig, error) {
+	value, ok := annotations[AnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+
+	maxFiles, err := parseMaxFiles(value)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &CaptureConfig{
+		MaxFiles: maxFiles,
+		Filter:   annotations[FilterAnnotationKey],
+	}
+
+	if d, ok := annotations[DurationAnnotationKey]; ok {
+		cfg.Duration, err = time.ParseDuration(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q: %w", d, err)
+		}
+	}
+
+	if p, ok := annotations[PriorityAnnotationKey]; ok {
+		cfg.Priority, err = strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority %q: %w", p, err)
+		}
+	}
+
+	if schedule, ok := annotations[ScheduleAnnotationKey]; ok {
+		cfg.Schedule = schedule
+		cfg.KeepSessions = DefaultKeepSessions
+	}
+	if k, ok := annotations[KeepSessionsAnnotationKey]; ok {
+		cfg.KeepSessions, err = strconv.Atoi(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keep-sessions %q: %w", k, err)
+		}
+	}
+
+	if fr, ok := annotations[FlightRecorderAnnotationKey]; ok {
+		if cfg.BufferDuration, cfg.BufferBytes, err = parseFlightRecorder(fr); err != nil {
+			return nil, err
+		}
+		cfg.PostTrigger = DefaultPostTrigger
+	}
+	if d, ok := annotations[PostTriggerAnnotationKey]; ok {
+		cfg.PostTrigger, err = time.ParseDuration(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid post-trigger %q: %w", d, err)
+		}
+	}
+	cfg.TriggerMatch = annotations[TriggerMatchAnnotationKey]
+
+	cfg.StopOn = annotations[StopOnAnnotationKey]
+	cfg.StopOnFilter = annotations[StopOnFilterAnnotationKey]
+	if cfg.StopCondition() {
+		cfg.StopTail = DefaultStopTail
+	}
+	if d, ok := annotations[StopTailAnnotationKey]; ok {
+		cfg.StopTail, err = time.ParseDuration(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop-tail %q: %w", d, err)
+		}
+	}
+
+	if ni, ok := annotations[NodeInterfacesAnnotationKey]; ok {
+		if cfg.NodeInterfaces, err = parseNodeInterfaces(ni); err != nil {
+			return nil, err
+		}
+	}
+
+	if peer, ok := annotations[PeerAnnotationKey]; ok {
+		if cfg.Peer, err = parsePeer(peer); err != nil {
+			return nil, err
+		}
+	}
+
+	if n, ok := annotations[PacketCountAnnotationKey]; ok {
+		cfg.PacketCount, err = strconv.Atoi(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid packet-count %q: %w", n, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseFlightRecorder parses a buffer bound such as "30s", "16Mi" or
+// "30s,16Mi". A buffer bounded only by time holds at most
+// DefaultFlightRecorderBytes.
+func parseFlightRecorder(value string) (time.Duration, int64, error) {
+	var (
+		window time.Duration
+		size   int64
+	)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if d, err := time.ParseDuration(part); err == nil && window == 0 {
+			window = d
+			continue
+		}
+		q, err := resource.ParseQuantity(part)
+		if err != nil || size != 0 {
+			return 0, 0, fmt.Errorf("invalid flight recorder buffer %q: want a duration, a size or both", value)
+		}
+		size = q.Value()
+	}
+	if window <= 0 && size <= 0 {
+		return 0, 0, fmt.Errorf("invalid flight recorder buffer %q: want a duration, a size or both", value)
+	}
+	if size == 0 {
+		size = DefaultFlightRecorderBytes
+	}
+	return window, size, nil
+}
+
+// FlightRecorder reports whether the capture is a flight recorder.
+func (cfg *CaptureConfig) FlightRecorder() bool {
+	return cfg.BufferBytes > 0
+}
+
+// StopCondition reports whether the capture finishes on a matching packet.
+func (cfg *CaptureConfig) StopCondition() bool {
+	return cfg.StopOn != "" || cfg.StopOnFilter != ""
+}
+
+func parseMaxFiles(value string) (int, error) {
+	maxFiles, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid max files %q: %w", value, err)
+	}
+	if maxFiles <= 0 {
+		return 0, fmt.Errorf("max files must be > 0, got %d", maxFiles)
+	}
+	return maxFiles, nil
+}
+
+// Validate checks the config for values the controller cannot run.
+func (cfg *CaptureConfig) Validate() error {
+	if cfg.MaxFiles <= 0 {
+		return fmt.Errorf("max files must be > 0, got %d", cfg.MaxFiles)
+	}
+	if cfg.Duration < 0 {
+		return fmt.Errorf("duration must not be negative, got %s", cfg.Duration)
+	}
+	if err := cfg.validateSchedule(); err != nil {
+		return err
+	}
+	if err := cfg.validateFlightRecorder(); err != nil {
+		return err
+	}
+	if err := cfg.validateStopCondition(); err != nil {
+		return err
+	}
+	if cfg.NodeInterfaces != "" && cfg.FlightRecorder() {
+		return fmt.Errorf("a flight recorder cannot capture node interfaces")
+	}
+	if cfg.PacketCount < 0 {
+		return fmt.Errorf("packet-count must not be negative, got %d", cfg.PacketCount)
+	}
+	if cfg.PacketCount > 0 && cfg.FlightRecorder() {
+		return fmt.Errorf("a flight recorder cannot have a packet count")
+	}
+	return validateFilter(cfg.Filter)
+}
+
+// validateSchedule checks that a scheduled capture is bounded and fires.
+func (cfg *CaptureConfig) validateSchedule() error {
+	if cfg.Schedule == "" {
+		if cfg.KeepSessions != 0 {
+			return fmt.Errorf("keep-sessions requires a schedule")
+		}
+		return nil
+	}
+	schedule, err := cron.Parse(cfg.Schedule)
+	if err != nil {
+		return err
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return fmt.Errorf("schedule %q never fires", cfg.Schedule)
+	}
+	if cfg.Duration <= 0 {
+		return fmt.Errorf("a scheduled capture requires a duration")
+	}
+	if cfg.KeepSessions <= 0 {
+		return fmt.Errorf("keep-sessions must be > 0, got %d", cfg.KeepSessions)
+	}
+	return nil
+}
+
+// validateFlightRecorder checks the buffer bounds and that trigger options are
+// only set on a flight recorder.
+func (cfg *CaptureConfig) validateFlightRecorder() error {
+	if !cfg.FlightRecorder() {
+		if cfg.BufferDuration != 0 || cfg.PostTrigger != 0 || cfg.TriggerMatch != "" {
+			return fmt.Errorf("post-trigger and trigger-match require a flight recorder")
+		}
+		return nil
+	}
+	if cfg.BufferDuration < 0 {
+		return fmt.Errorf("flight recorder window must not be negative, got %s", cfg.BufferDuration)
+	}
+	if cfg.BufferBytes > MaxFlightRecorderBytes {
+		return fmt.Errorf("flight recorder buffer must not exceed %d bytes, got %d", MaxFlightRecorderBytes, cfg.BufferBytes)
+	}
+	if cfg.PostTrigger < 0 {
+		return fmt.Errorf("post-trigger must not be negative, got %s", cfg.PostTrigger)
+	}
+	if cfg.Schedule != "" {
+		return fmt.Errorf("a flight recorder cannot be scheduled")
+	}
+	if cfg.TriggerMatch != "" {
+		if _, err := packet.ParsePredicate(cfg.TriggerMatch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateStopCondition checks the stop condition and that stop-tail is only
+// set with one.
+func (cfg *CaptureConfig) validateStopCondition() error {
+	if !cfg.StopCondition() {
+		if cfg.StopTail != 0 {
+			return fmt.Errorf("stop-tail requires stop-on or stop-on-filter")
+		}
+		return nil
+	}
+	if cfg.StopTail < 0 {
+		return fmt.Errorf("stop-tail must not be negative, got %s", cfg.StopTail)
+	}
+	if cfg.FlightRecorder() {
+		return fmt.Errorf("a flight recorder cannot have a stop condition, use trigger-match")
+	}
+	if cfg.StopOn != "" {
+		if _, err := packet.ParsePredicate(cfg.StopOn); err != nil {
+			return err
+		}
+	}
+	if err := validateFilter(cfg.StopOnFilter); err != nil {
+		return fmt.Errorf("invalid stop-on-filter: %w", err)
+	}
+	return nil
+}
+
+// validateFilter rejects filters that could be mistaken for tcpdump options
+// or that contain control characters.
+func validateFilter(filter string) error {
+	if len(filter) > maxFilterLength {
+		return fmt.Errorf("filter is longer than %d characters", maxFilterLength)
+	}
+	if strings.HasPrefix(strings.TrimSpace(filter), "-") {
+		return fmt.Errorf("filter must not start with '-'")
+	}
+	for _, r := range filter {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("filter contains control character %q", r)
+		}
+	}
+	return nil
+}
+
+// Annotations returns the annotations that request cfg. Keys for unset
+// optional fields map to nil so a merge patch removes stale values.
+func (cfg *CaptureConfig) Annotations() map[string]interface{} {
+	annotations := map[string]interface{}{
+		AnnotationKey:               strconv.Itoa(cfg.MaxFiles),
+		FilterAnnotationKey:         nil,
+		DurationAnnotationKey:       nil,
+		PriorityAnnotationKey:       nil,
+		ScheduleAnnotationKey:       nil,
+		KeepSessionsAnnotationKey:   nil,
+		FlightRecorderAnnotationKey: nil,
+		PostTriggerAnnotationKey:    nil,
+		TriggerMatchAnnotationKey:   nil,
+		StopOnAnnotationKey:         nil,
+		StopOnFilterAnnotationKey:   nil,
+		StopTailAnnotationKey:       nil,
+		NodeInterfacesAnnotationKey: nil,
+		PeerAnnotationKey:           nil,
+		PacketCountAnnotationKey:    nil,
+	}
+	if cfg.Filter != "" {
+		annotations[FilterAnnotationKey] = cfg.Filter
+	}
+	if cfg.Duration > 0 {
+		annotations[DurationAnnotationKey] = cfg.Duration.String()
+	}
+	if cfg.Priority != 0 {
+		annotations[PriorityAnnotationKey] = strconv.Itoa(cfg.Priority)
+	}
+	if cfg.Schedule != "" {
+		annotations[ScheduleAnnotationKey] = cfg.Schedule
+		annotations[KeepSessionsAnnotationKey] = strconv.Itoa(cfg.KeepSessions)
+	}
+	if cfg.FlightRecorder() {
+		annotations[FlightRecorderAnnotationKey] = cfg.flightRecorderValue()
+		annotations[PostTriggerAnnotationKey] = cfg.PostTrigger.String()
+		if cfg.TriggerMatch != "" {
+			annotations[TriggerMatchAnnotationKey] = cfg.TriggerMatch
+		}
+	}
+	if cfg.StopCondition() {
+		if cfg.StopOn != "" {
+			annotations[StopOnAnnotationKey] = cfg.StopOn
+		}
+		if cfg.StopOnFilter != "" {
+			annotations[StopOnFilterAnnotationKey] = cfg.StopOnFilter
+		}
+		annotations[StopTailAnnotationKey] = cfg.StopTail.String()
+	}
+	if cfg.NodeInterfaces != "" {
+		annotations[NodeInterfacesAnnotationKey] = cfg.NodeInterfaces
+	}
+	if cfg.Peer != "" {
+		annotations[PeerAnnotationKey] = cfg.Peer
+	}
+	if cfg.PacketCount > 0 {
+		annotations[PacketCountAnnotationKey] = strconv.Itoa(cfg.PacketCount)
+	}
+	return annotations
+}
+
+// flightRecorderValue formats the buffer bounds like
+// FlightRecorderAnnotationKey.
+func (cfg *CaptureConfig) flightRecorderValue() string {
+	size := resource.NewQuantity(cfg.BufferBytes, resource.BinarySI).String()
+	if cfg.BufferDuration > 0 {
+		return cfg.BufferDuration.String() + "," + size
+	}
+	return size
+}
+
+// Equal reports whether two configs request the same capture.
+func (cfg *CaptureConfig) Equal(other *CaptureConfig) bool {
+	if cfg == nil || other == nil {
+		return cfg == other
+	}
+	return *cfg == *other
+}
+
+// CapturePhase summarises the state of a capture.
+type CapturePhase string
+
+const (
+	CapturePending   CapturePhase = "Pending"
+	CaptureRunning   CapturePhase = "Running"
+	CaptureCompleted CapturePhase = "Completed"
+	CaptureFailed    CapturePhase = "Failed"
+	CaptureRefused   CapturePhase = "Refused"
+	// CaptureScheduled means a scheduled capture waits for its next run.
+	CaptureScheduled CapturePhase = "Scheduled"
+)
+
+// CaptureStatus is reported by the controller in StatusAnnotationKey.
+type CaptureStatus struct {
+	Phase     CapturePhase `json:"phase"`
+	Node      string       `json:"node,omitempty"`
+	Files     string       `json:"files,omitempty"`
+	Message   string       `json:"message,omitempty"`
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// QueuePosition is the 1-based position of a Pending capture waiting
+	// for a free slot.
+	QueuePosition int `json:"queuePosition,omitempty"`
+	// Preempted is set while a capture stopped by a higher-priority one
+	// waits to resume.
+	Preempted bool `json:"preempted,omitempty"`
+	// Rule names the capture rule that requested a capture of a Pod without
+	// capture annotations.
+	Rule string `json:"rule,omitempty"`
+	// Owner names the workload, as Kind/name, whose capture annotations the
+	// Pod inherits.
+	Owner string `json:"owner,omitempty"`
+	// NamespaceWide is set when the Pod inherits its Namespace's capture
+	// annotations.
+	NamespaceWide bool `json:"namespaceWide,omitempty"`
+	// Trigger names the trigger rule and the Event condition, as
+	// rule/condition, that started the capture.
+	Trigger string `json:"trigger,omitempty"`
+	// NextCapture is when the next session of a scheduled capture starts.
+	NextCapture *metav1.Time `json:"nextCapture,omitempty"`
+	// FlowID links the two ends of a two-ended capture, and Peer names the
+	// Pod at the other end.
+	FlowID string `json:"flowID,omitempty"`
+	Peer   string `json:"peer,omitempty"`
+	// FlowSource names the source Pod of the two-ended capture of a Pod
+	// without capture annotations.
+	FlowSource string `json:"flowSource,omitempty"`
+	// PacketCapture names the Antrea PacketCapture that requested the
+	// capture.
+	PacketCapture string `json:"packetCapture,omitempty"`
+}
+
+// ParseCaptureStatus decodes the status annotation, returning nil if absent.
+func ParseCaptureStatus(annotations map[string]string) (*CaptureStatus, error) {
+	value, ok := annotations[StatusAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	status := &CaptureStatus{}
+	if err := json.Unmarshal([]byte(value), status); err != nil {
+		return nil, fmt.Errorf("invalid capture status: %w", err)
+	}
+	return status, nil
+}
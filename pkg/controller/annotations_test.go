@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCaptureConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        *CaptureConfig
+		wantErr     bool
+	}{
+		{name: "no annotation", annotations: map[string]string{}},
+		{name: "files only", annotations: map[string]string{AnnotationKey: "3"}, want: &CaptureConfig{MaxFiles: 3}},
+		{
+			name: "all fields",
+			annotations: map[string]string{
+				AnnotationKey:         "5",
+				FilterAnnotationKey:   "tcp port 80",
+				DurationAnnotationKey: "90s",
+				PriorityAnnotationKey: "10",
+			},
+			want: &CaptureConfig{MaxFiles: 5, Filter: "tcp port 80", Duration: 90 * time.Second, Priority: 10},
+		},
+		{name: "zero files", annotations: map[string]string{AnnotationKey: "0"}, wantErr: true},
+		{name: "bad duration", annotations: map[string]string{AnnotationKey: "1", DurationAnnotationKey: "soon"}, wantErr: true},
+		{name: "bad priority", annotations: map[string]string{AnnotationKey: "1", PriorityAnnotationKey: "high"}, wantErr: true},
+		{
+			name:        "schedule",
+			annotations: map[string]string{AnnotationKey: "2", DurationAnnotationKey: "5m", ScheduleAnnotationKey: "0 2 * * *"},
+			want:        &CaptureConfig{MaxFiles: 2, Duration: 5 * time.Minute, Schedule: "0 2 * * *", KeepSessions: DefaultKeepSessions},
+		},
+		{name: "unbounded schedule", annotations: map[string]string{AnnotationKey: "1", ScheduleAnnotationKey: "@hourly"}, wantErr: true},
+		{name: "keep-sessions without schedule", annotations: map[string]string{AnnotationKey: "1", KeepSessionsAnnotationKey: "2"}, wantErr: true},
+		{
+			name:        "stop condition",
+			annotations: map[string]string{AnnotationKey: "1", StopOnAnnotationKey: "http.status=503"},
+			want:        &CaptureConfig{MaxFiles: 1, StopOn: "http.status=503", StopTail: DefaultStopTail},
+		},
+		{name: "stop-tail without stop condition", annotations: map[string]string{AnnotationKey: "1", StopTailAnnotationKey: "10s"}, wantErr: true},
+		{name: "bad stop predicate", annotations: map[string]string{AnnotationKey: "1", StopOnAnnotationKey: "tcp.flags=nope"}, wantErr: true},
+		{name: "option-like stop filter", annotations: map[string]string{AnnotationKey: "1", StopOnFilterAnnotationKey: "-z /bin/sh"}, wantErr: true},
+		{name: "option-like filter", annotations: map[string]string{AnnotationKey: "1", FilterAnnotationKey: "-z /bin/sh"}, wantErr: true},
+		{
+			name:        "node interfaces",
+			annotations: map[string]string{AnnotationKey: "1", NodeInterfacesAnnotationKey: "tunnel, gateway,tunnel"},
+			want:        &CaptureConfig{MaxFiles: 1, NodeInterfaces: "gateway,tunnel"},
+		},
+		{name: "unknown node interface", annotations: map[string]string{AnnotationKey: "1", NodeInterfacesAnnotationKey: "gateway,eth1"}, wantErr: true},
+		{name: "flight recorder with node interfaces", annotations: map[string]string{AnnotationKey: "1", FlightRecorderAnnotationKey: "30s", NodeInterfacesAnnotationKey: "gateway"}, wantErr: true},
+		{name: "packet count", annotations: map[string]string{AnnotationKey: "1", PacketCountAnnotationKey: "100"}, want: &CaptureConfig{MaxFiles: 1, PacketCount: 100}},
+		{name: "negative packet count", annotations: map[string]string{AnnotationKey: "1", PacketCountAnnotationKey: "-1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCaptureConfig(tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
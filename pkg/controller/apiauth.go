@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// APISubresource is the Pod subresource RBAC grants the capture API on when
+// it authenticates clients: get on pods/capture reads a Pod's captures and
+// create triggers its flight recorder. The API server has no such
+// subresource; it only names the permission.
+const APISubresource = "capture"
+
+// SetAPIAuth makes the capture API require a bearer token that the API server
+// authenticates and authorizes, with a TokenReview and a SubjectAccessReview
+// per request. Without it, anyone who can connect to --listen-address can
+// read every capture on the node. It must be called before Serve.
+func (c *Controller) SetAPIAuth(enabled bool) {
+	c.apiAuth = enabled
+}
+
+// authorized wraps h to check the client may make the request, if SetAPIAuth
+// enabled it. Requests under /captures/{namespace}/{name} need the verb of
+// their method on the Pod's APISubresource, others the verb on their path.
+func (c *Controller) authorized(h http.HandlerFunc) http.HandlerFunc {
+	if !c.apiAuth {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			http.Error(w, "bearer token required", http.StatusUnauthorized)
+			return
+		}
+		review, err := c.client.AuthenticationV1().TokenReviews().Create(r.Context(), &authenticationv1.TokenReview{
+			Spec: authenticationv1.TokenReviewSpec{Token: token},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			klog.ErrorS(err, "Failed to review capture API token")
+			http.Error(w, "failed to authenticate request", http.StatusInternalServerError)
+			return
+		}
+		if !review.Status.Authenticated {
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		user := review.Status.User
+		access := &authorizationv1.SubjectAccessReview{Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+		}}
+		if len(user.Extra) > 0 {
+			access.Spec.Extra = make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+			for k, v := range user.Extra {
+				access.Spec.Extra[k] = authorizationv1.ExtraValue(v)
+			}
+		}
+		verb := "get"
+		if r.Method == http.MethodPost {
+			verb = "create"
+		}
+		what := r.URL.Path
+		if namespace, name := r.PathValue("namespace"), r.PathValue("name"); name != "" {
+			access.Spec.ResourceAttributes = &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        verb,
+				Resource:    "pods",
+				Subresource: APISubresource,
+				Name:        name,
+			}
+			what = fmt.Sprintf("pods/%s %s/%s", APISubresource, namespace, name)
+		} else {
+			access.Spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{Path: r.URL.Path, Verb: verb}
+		}
+		access, err = c.client.AuthorizationV1().SubjectAccessReviews().Create(r.Context(), access, metav1.CreateOptions{})
+		if err != nil {
+			klog.ErrorS(err, "Failed to authorize capture API request", "user", user.Username)
+			http.Error(w, "failed to authorize request", http.StatusInternalServerError)
+			return
+		}
+		if !access.Status.Allowed {
+			http.Error(w, fmt.Sprintf("user %q cannot %s %s", user.Username, verb, what), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAPIAuth(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "alice-token" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "alice", Groups: []string{"sre"}}
+		}
+		return true, review, nil
+	})
+	// alice may read the metrics and web-0's captures, nothing else
+	var reviewed *authorizationv1.SubjectAccessReviewSpec
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviewed = &review.Spec
+		if res := review.Spec.ResourceAttributes; res != nil {
+			review.Status.Allowed = res.Verb == "get" && res.Namespace == "default" && res.Name == "web-0"
+		} else {
+			review.Status.Allowed = review.Spec.NonResourceAttributes.Path == "/metrics"
+		}
+		return true, review, nil
+	})
+	c := &Controller{client: client}
+	c.SetAPIAuth(true)
+	handler := c.Handler()
+
+	for _, tc := range []struct {
+		method, path, token string
+		want                int
+	}{
+		{"GET", "/metrics", "", http.StatusUnauthorized},
+		{"GET", "/metrics", "mallory-token", http.StatusUnauthorized},
+		{"GET", "/metrics", "alice-token", http.StatusOK},
+		{"GET", "/captures/default/db-0/files", "alice-token", http.StatusForbidden},
+		{"POST", "/captures/default/web-0/trigger", "alice-token", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s %s with %q = %d %s, want %d", tc.method, tc.path, tc.token, rec.Code, rec.Body, tc.want)
+		}
+	}
+
+	want := authorizationv1.ResourceAttributes{
+		Namespace: "default", Verb: "create", Resource: "pods", Subresource: APISubresource, Name: "web-0",
+	}
+	if reviewed == nil || reviewed.User != "alice" || len(reviewed.Groups) != 1 ||
+		reviewed.ResourceAttributes == nil || *reviewed.ResourceAttributes != want {
+		t.Errorf("last access review = %+v, want alice's for %+v", reviewed, want)
+	}
+}
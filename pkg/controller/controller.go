@@ -2,29 +2,36 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"path/filepath"
-	"strconv"
+	"maps"
+	"strings"
 	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
-)
-
-const (
-	annotationKey = "tcpdump.antrea.io"
+	"k8s.io/utils/clock"
 )
 
 // Terminal errors that should not trigger retries
 type terminalError struct {
-	msg string
+	msg   string
+	phase CapturePhase // reported in the capture status
 }
 
 func (e *terminalError) Error() string {
@@ -32,52 +39,144 @@ func (e *terminalError) Error() string {
 }
 
 func newTerminalError(format string, args ...interface{}) error {
-	return &terminalError{msg: fmt.Sprintf(format, args...)}
+	return &terminalError{msg: fmt.Sprintf(format, args...), phase: CaptureFailed}
+}
+
+// newRefusedError refuses a capture because of a limit. Like other terminal
+// errors it is not retried; the request is re-evaluated on the next Pod update.
+func newRefusedError(format string, args ...interface{}) error {
+	return &terminalError{msg: fmt.Sprintf(format, args...), phase: CaptureRefused}
 }
 
 // CaptureState tracks a running capture on a Pod.
 type CaptureState struct {
 	fileLocation string
 	filePattern  string
-	maxFiles     int // Track annotation value for reconciliation
+	sessionDir   string         // empty for files written before session directories
+	config       *CaptureConfig // Track annotation values for reconciliation
 	containerID  string
+	uid          string // of the Pod the capture was started for
+	startTime    metav1.Time
+	stopReason   string // set once the capture has finished on purpose
+	// triggerRule names the trigger rule that started the capture.
+	triggerRule string
+	// trigger is the last seen TriggerAnnotationKey of a flight recorder,
+	// nil until the first sync after it started.
+	trigger *string
 }
 
 // Controller watches Pods and manages packet captures.
 type Controller struct {
+	client     kubernetes.Interface
 	podLister  corelisters.PodLister
 	podSynced  cache.InformerSynced
+	podIndexer cache.Indexer // finds the sources of two-ended captures by flowPeerIndex
 	queue      workqueue.RateLimitingInterface
 	nodeName   string
 	criSocket  string
 	captureDir string
+	// captureMode is where captures run, see SetCaptureMode.
+	captureMode CaptureMode
 
 	// Process manager for tcpdump
 	processManager *ProcessManager
 
+	quota          QuotaConfig
+	diskWatchdog   DiskWatchdogConfig
+	priorityPolicy PriorityPolicy
+	limits         Limits
+	policyMu       sync.RWMutex
+	policy         CapturePolicy // guarded by policyMu
+	policyFile     string        // see SetPolicyFile
+	policyData     []byte        // the policy file as last read
+	naming         *FileNaming
+	recorderBudget int64 // bytes all flight recorder buffers may hold
+
+	namespaceLister corelisters.NamespaceLister
+	namespaceSynced cache.InformerSynced
+
+	rulesMu     sync.RWMutex
+	rules       []CaptureRule
+	rulesSynced cache.InformerSynced
+	// triggerRules are guarded by rulesMu too.
+	triggerRules  []TriggerRule
+	triggersSince time.Time
+	eventsSynced  cache.InformerSynced
+
+	owners       *ownerListers
+	ownersSynced []cache.InformerSynced
+
+	// packetCaptures holds Antrea PacketCaptures, indexed by
+	// packetCapturePodIndex, and dynamicClient writes their status.
+	packetCaptures       cache.Indexer
+	packetCapturesSynced cache.InformerSynced
+	dynamicClient        dynamic.Interface
+
+	namespaceCaptures bool
+	apiAuth           bool // see SetAPIAuth
+
+	eventBroadcaster record.EventBroadcaster
+	recorder         record.EventRecorder
+
 	mu             sync.Mutex
 	activeCaptures map[string]*CaptureState // key: namespace/name
+	preempted      map[string]bool          // preempted captures waiting to resume
+	// namespaceReports holds why a Pod of a namespace-wide capture was last
+	// reported as not captured.
+	namespaceReports map[string]string
+
+	sessionMu sync.Mutex     // serializes session manifest updates
+	finishing sync.WaitGroup // sessions being finished in the background
+
+	clock     clock.WithTicker
+	schedules map[string]*scheduledCapture // guarded by mu
+	triggers  map[string]*triggeredCapture // guarded by mu
 }
 
 // NewController creates a new capture controller.
 func NewController(
+	client kubernetes.Interface,
 	podInformer coreinformers.PodInformer,
 	nodeName, criSocket, captureDir string,
 	maxConcurrent int,
 ) *Controller {
 	pm := NewProcessManager(maxConcurrent, captureDir, criSocket)
+	eventBroadcaster := record.NewBroadcaster()
 	c := &Controller{
-		podLister:      podInformer.Lister(),
-		podSynced:      podInformer.Informer().HasSynced,
-		queue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "capture"),
-		nodeName:       nodeName,
-		criSocket:      criSocket,
-		captureDir:     captureDir,
-		processManager: pm,
-		activeCaptures: make(map[string]*CaptureState),
+		client:           client,
+		podLister:        podInformer.Lister(),
+		podSynced:        podInformer.Informer().HasSynced,
+		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "capture"),
+		nodeName:         nodeName,
+		criSocket:        criSocket,
+		captureDir:       captureDir,
+		captureMode:      CaptureModeNetns,
+		processManager:   pm,
+		activeCaptures:   make(map[string]*CaptureState),
+		preempted:        make(map[string]bool),
+		namespaceReports: make(map[string]string),
+		naming:           defaultFileNaming,
+		recorderBudget:   DefaultFlightRecorderBudget,
+		clock:            clock.RealClock{},
+		schedules:        make(map[string]*scheduledCapture),
+		triggers:         make(map[string]*triggeredCapture),
+
+		eventBroadcaster: eventBroadcaster,
+		recorder:         eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "capture-controller", Host: nodeName}),
 	}
 
 	pm.SetOnExit(c.onCaptureExit)
+	pm.SetOnPendingChange(func(key string) { c.queue.Add(key) })
+	pm.SetOnQueuedStart(c.onQueuedCaptureStart)
+	pm.SetOnCaptureChange(func(key string) { c.queue.Add(key) })
+	pm.SetPodIPLookup(c.podIPs)
+	registerMetrics()
+
+	if err := podInformer.Informer().AddIndexers(cache.Indexers{flowPeerIndex: indexFlowPeer}); err != nil {
+		klog.ErrorS(err, "Failed to index Pods by peer, two-ended captures only run on the source's node")
+	} else {
+		c.podIndexer = podInformer.Informer().GetIndexer()
+	}
 
 	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    c.addPod,
@@ -127,6 +226,8 @@ func (c *Controller) deletePod(obj interface{}) {
 
 // enqueuePod adds a Pod to the work queue.
 func (c *Controller) enqueuePod(pod *corev1.Pod) {
+	c.enqueueFlowPeers(pod)
+	c.enqueuePacketCapturePeers(pod)
 	if pod.Spec.NodeName != c.nodeName {
 		return
 	}
@@ -145,17 +246,53 @@ func (c *Controller) Run(ctx context.Context, workers int) error {
 	klog.Info("Starting capture controller")
 	defer klog.Info("Shutting down capture controller")
 
+	c.eventBroadcaster.StartStructuredLogging(0)
+	c.eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: c.client.CoreV1().Events("")})
+	defer c.eventBroadcaster.Shutdown()
+
 	klog.Info("Waiting for informer caches to sync")
-	if !cache.WaitForCacheSync(ctx.Done(), c.podSynced) {
+	synced := []cache.InformerSynced{c.podSynced}
+	if c.namespaceSynced != nil {
+		synced = append(synced, c.namespaceSynced)
+	}
+	if c.rulesSynced != nil {
+		synced = append(synced, c.rulesSynced)
+	}
+	if c.eventsSynced != nil {
+		synced = append(synced, c.eventsSynced)
+	}
+	if c.packetCapturesSynced != nil {
+		synced = append(synced, c.packetCapturesSynced)
+	}
+	synced = append(synced, c.ownersSynced...)
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
+	klog.Info("Recovering captures from a previous run")
+	c.recoverCaptures(ctx)
+
+	if c.diskWatchdog.enabled() {
+		go c.processManager.runDiskWatchdog(ctx, c.diskWatchdog)
+	}
+
 	klog.Info("Starting workers")
 	for i := 0; i < workers; i++ {
 		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
 	}
 
+	if c.quota.enabled() && c.quota.CheckInterval > 0 {
+		go wait.UntilWithContext(ctx, c.enforceQuota, c.quota.CheckInterval)
+	}
+
+	go wait.UntilWithContext(ctx, c.refreshSessions, sessionRefreshInterval)
+	go c.runScheduler(ctx)
+	if c.policyFile != "" {
+		go wait.UntilWithContext(ctx, c.reloadPolicyFile, policyFileCheckInterval)
+	}
+
 	<-ctx.Done()
+	c.finishing.Wait()
 	return nil
 }
 
@@ -183,7 +320,8 @@ func (c *Controller) processNextWorkItem(ctx context.Context) bool {
 	err := c.syncPod(ctx, key)
 	if err != nil {
 		// Check if this is a terminal error (e.g., multi-container Pod)
-		if _, isTerminal := err.(*terminalError); isTerminal {
+		var te *terminalError
+		if errors.As(err, &te) {
 			klog.Warningf("Terminal error for Pod %s, will not retry: %v", key, err)
 			c.queue.Forget(obj)
 		} else {
@@ -217,34 +355,135 @@ func (c *Controller) syncPod(ctx context.Context, key string) error {
 		return nil
 	}
 
-	annoValue, hasAnno := pod.Annotations[annotationKey]
-	if !hasAnno {
+	cfg, source, err := c.podCaptureConfig(pod)
+	if err == nil {
+		// The webhook rejects these too, but may be down or not deployed
+		err = checkAnnotationKeys(pod.Annotations)
+	}
+	if err == nil && cfg != nil {
+		err = c.limits.Check(cfg)
+	}
+	if err != nil {
+		klog.ErrorS(err, "Invalid capture request", "pod", key, "rule", source.rule, "owner", source.owner, "namespaceWide", source.namespaceWide, "trigger", source.trigger, "flowSource", source.flowSource, "packetCapture", source.packetCapture)
 		c.stopCapture(key, true)
-		return nil
+		return c.reportStatus(ctx, key, pod, source, &CaptureStatus{Phase: CaptureFailed, Node: c.nodeName, Message: err.Error()})
+	}
+	if cfg == nil {
+		c.stopCapture(key, true)
+		return c.updateStatus(ctx, pod, nil)
 	}
 
-	maxFiles, err := parseMaxFiles(annoValue)
-	if err != nil {
-		klog.ErrorS(err, "Invalid annotation value", "pod", key, "annotation", annotationKey, "value", annoValue)
+	if err := c.checkPolicy(pod); err != nil {
 		c.stopCapture(key, true)
-		return nil
+		var te *terminalError
+		if errors.As(err, &te) {
+			c.recorder.Event(pod, corev1.EventTypeWarning, EventReasonCaptureDenied, err.Error())
+		}
+		if statusErr := c.reportStatus(ctx, key, pod, source, c.captureStatus(key, err)); statusErr != nil {
+			return statusErr
+		}
+		return err
 	}
 
-	return c.startCapture(ctx, key, pod, maxFiles)
+	if source.trigger != "" && c.takeTrigger(key) && c.getCaptureState(key) != nil {
+		// A new trigger after the cooldown starts a new session
+		c.stopCapture(key, false)
+	}
+	err = c.startCapture(ctx, key, pod, cfg)
+	if err == nil {
+		c.checkRecorderTrigger(key, pod)
+	}
+	if statusErr := c.reportStatus(ctx, key, pod, source, c.captureStatus(key, err)); statusErr != nil && err == nil {
+		return statusErr
+	}
+	return err
 }
 
-func parseMaxFiles(value string) (int, error) {
-	maxFiles, err := strconv.Atoi(value)
-	if err != nil {
-		return 0, fmt.Errorf("invalid max files %q: %w", value, err)
+// reportStatus writes the status of a capture requested by source.
+func (c *Controller) reportStatus(ctx context.Context, key string, pod *corev1.Pod, source captureSource, status *CaptureStatus) error {
+	status.Rule = source.rule
+	status.Owner = source.owner
+	status.NamespaceWide = source.namespaceWide
+	status.Trigger = source.trigger
+	status.FlowSource = source.flowSource
+	status.PacketCapture = source.packetCapture
+	c.reportNamespaceCapture(key, pod, status)
+	if source.packetCapture != "" {
+		if err := c.updatePacketCaptureStatus(ctx, source.packetCapture, status); err != nil {
+			return err
+		}
 	}
-	if maxFiles <= 0 {
-		return 0, fmt.Errorf("max files must be > 0, got %d", maxFiles)
+	return c.updateStatus(ctx, pod, status)
+}
+
+// captureSource tells where a capture request came from when it is not the
+// Pod's own annotations.
+type captureSource struct {
+	rule          string // capture rule selecting the Pod
+	owner         string // workload whose annotations the Pod inherits, as Kind/name
+	namespaceWide bool   // the Pod inherits its Namespace's annotations
+	trigger       string // trigger rule and condition that started the capture, as rule/condition
+	flowSource    string // source Pod of a two-ended capture the Pod is the destination of
+	packetCapture string // Antrea PacketCapture capturing on the Pod
+}
+
+// podCaptureConfig returns the capture requested for pod and where it came
+// from. The Pod's own annotations come first, then a two-ended capture whose
+// destination it is, then an Antrea PacketCapture, then its workload's, then
+// capture rules, then its Namespace's, and last a capture started by a
+// trigger rule. The Pod's annotations override inherited ones key by key.
+func (c *Controller) podCaptureConfig(pod *corev1.Pod) (*CaptureConfig, captureSource, error) {
+	request := CaptureRequestAnnotations(pod.Annotations)
+	if _, ok := request[AnnotationKey]; ok {
+		cfg, err := ParseCaptureConfig(pod.Annotations)
+		if err == nil && cfg.Peer != "" {
+			cfg, err = c.sourceFlowConfig(pod, cfg)
+		}
+		return cfg, captureSource{}, err
 	}
-	return maxFiles, nil
+
+	if cfg, source, err := c.destinationFlowConfig(pod); cfg != nil || err != nil {
+		return cfg, captureSource{flowSource: source}, err
+	}
+	if cfg, name, err := c.packetCaptureConfig(pod); cfg != nil || err != nil {
+		return cfg, captureSource{packetCapture: name}, err
+	}
+
+	if inherited, owner := c.ownerCaptureAnnotations(pod); inherited[AnnotationKey] != "" {
+		cfg, err := inheritCaptureConfig(inherited, request)
+		if err != nil {
+			err = fmt.Errorf("annotations of %s: %w", owner, err)
+		}
+		return cfg, captureSource{owner: owner}, err
+	}
+	if rule := c.matchRule(pod); rule != nil {
+		return &rule.Config, captureSource{rule: rule.Name}, nil
+	}
+	if inherited := c.namespaceCaptureAnnotations(pod.Namespace); inherited[AnnotationKey] != "" {
+		cfg, err := inheritCaptureConfig(inherited, request)
+		if err != nil {
+			err = fmt.Errorf("annotations of namespace %s: %w", pod.Namespace, err)
+		}
+		return cfg, captureSource{namespaceWide: true}, err
+	}
+	if cfg, trigger := c.triggeredCaptureConfig(podKey(pod)); cfg != nil {
+		return cfg, captureSource{trigger: trigger}, nil
+	}
+	return nil, captureSource{}, nil
+}
+
+// inheritCaptureConfig parses inherited capture annotations overridden by the
+// Pod's own.
+func inheritCaptureConfig(inherited, own map[string]string) (*CaptureConfig, error) {
+	if _, ok := inherited[PeerAnnotationKey]; ok {
+		return nil, fmt.Errorf("%s can only be set on a Pod", PeerAnnotationKey)
+	}
+	annotations := maps.Clone(inherited)
+	maps.Copy(annotations, own)
+	return ParseCaptureConfig(annotations)
 }
 
-func (c *Controller) startCapture(ctx context.Context, key string, pod *corev1.Pod, maxFiles int) error {
+func (c *Controller) startCapture(ctx context.Context, key string, pod *corev1.Pod, cfg *CaptureConfig) error {
 	// Ensure Pod is in Running state
 	if pod.Status.Phase != corev1.PodRunning {
 		return fmt.Errorf("pod %s is not running (phase: %s)", key, pod.Status.Phase)
@@ -266,13 +505,7 @@ func (c *Controller) startCapture(ctx context.Context, key string, pod *corev1.P
 	}
 
 	// Find the container status by name
-	containerID := ""
-	for _, cs := range pod.Status.ContainerStatuses {
-		if cs.Name == targetContainerName {
-			containerID = cs.ContainerID
-			break
-		}
-	}
+	containerID := firstContainerID(pod)
 	if containerID == "" {
 		return fmt.Errorf("no container ID found for container %s in pod %s", targetContainerName, key)
 	}
@@ -282,75 +515,256 @@ func (c *Controller) startCapture(ctx context.Context, key string, pod *corev1.P
 	existingCapture := c.activeCaptures[key]
 	c.mu.Unlock()
 
-	if existingCapture != nil {
-		sameConfig := existingCapture.maxFiles == maxFiles && existingCapture.containerID == containerID
-		if sameConfig && c.processManager.HasCapture(key) {
+	if cfg.Schedule != "" {
+		due := c.scheduleDue(key, cfg)
+		switch {
+		case !due && existingCapture != nil && existingCapture.stopReason == StopReasonPreempted:
+			c.resumePreempted(key)
+		case !due:
+			// Keep the last session until the next run, unless the
+			// request changed under it.
+			if existingCapture != nil && !existingCapture.config.Equal(cfg) {
+				c.stopCapture(key, false)
+			}
+			return nil
+		case existingCapture != nil:
+			klog.InfoS("Starting next scheduled capture", "pod", key, "schedule", cfg.Schedule)
+			c.stopCapture(key, false)
+		}
+	} else if existingCapture != nil && existingCapture.stopReason == StopReasonPreempted {
+		c.resumePreempted(key)
+	} else if existingCapture != nil {
+		sameConfig := existingCapture.config.Equal(cfg)
+		if sameConfig && existingCapture.stopReason != "" {
+			// Capture finished; keep its files until the request changes
+			return nil
+		}
+		// The host veth outlives the Pod's containers
+		sameTarget := c.captureMode == CaptureModeVeth || existingCapture.containerID == containerID
+		if sameConfig && sameTarget && c.processManager.HasCapture(key) {
 			// Capture already running with correct config
 			return nil
 		}
 
 		klog.InfoS("Restarting capture due to config or process change",
 			"pod", key,
-			"oldMaxFiles", existingCapture.maxFiles,
-			"newMaxFiles", maxFiles,
+			"oldMaxFiles", existingCapture.config.MaxFiles,
+			"newMaxFiles", cfg.MaxFiles,
 			"oldContainerID", existingCapture.containerID,
 			"newContainerID", containerID,
 			"processActive", c.processManager.HasCapture(key))
 		c.stopCapture(key, false)
 	}
 
-	fileLocation := c.captureFileLocation(pod.Name)
+	if err := c.admitPriority(pod.Namespace, cfg); err != nil {
+		return err
+	}
+	if err := c.admitCapture(key, pod.Namespace, cfg); err != nil {
+		return err
+	}
+	if err := c.admitFlightRecorder(key, cfg); err != nil {
+		return err
+	}
 
-	err := c.processManager.StartCapture(ctx, key, pod.Name, containerID, maxFiles)
+	start := time.Now()
+	_, outputFile := c.newSession(pod, start)
+	err := c.processManager.StartCapture(ctx, key, outputFile, containerID, cfg)
+	if errors.Is(err, ErrCaptureQueued) {
+		// onQueuedCaptureStart records the state once a slot frees up
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("failed to start capture: %w", err)
 	}
 
+	c.recordCapture(key, outputFile, containerID, cfg, start)
+	return nil
+}
+
+// onQueuedCaptureStart records a capture started from the pending queue.
+func (c *Controller) onQueuedCaptureStart(key, outputFile, containerID string, cfg *CaptureConfig) {
+	c.recordCapture(key, outputFile, containerID, cfg, time.Now())
+	c.queue.Add(key)
+}
+
+// recordCapture tracks a capture the process manager has just started.
+func (c *Controller) recordCapture(key, outputFile, containerID string, cfg *CaptureConfig, start time.Time) {
+	keep, triggerRule := c.sessionsToKeep(key, cfg)
 	state := &CaptureState{
-		fileLocation: fileLocation,
-		filePattern:  c.captureFilePattern(pod.Name),
-		maxFiles:     maxFiles,
+		fileLocation: outputFile,
+		filePattern:  outputFile + "*",
+		sessionDir:   c.sessionDirOf(outputFile),
+		config:       cfg,
 		containerID:  containerID,
+		startTime:    metav1.NewTime(start),
+		triggerRule:  triggerRule,
+	}
+	namespace, name, _ := strings.Cut(key, "/")
+	if pod, err := c.podLister.Pods(namespace).Get(name); err == nil {
+		state.uid = string(pod.UID)
 	}
 
 	c.mu.Lock()
 	c.activeCaptures[key] = state
+	delete(c.preempted, key)
 	c.mu.Unlock()
 
-	klog.InfoS("Started packet capture", "pod", key, "file", fileLocation, "maxFiles", maxFiles)
-	return nil
+	c.openSession(key, state)
+	if keep > 0 {
+		c.pruneSessions(key, state, keep)
+	}
+
+	klog.InfoS("Started packet capture", "pod", key, "file", state.fileLocation, "maxFiles", cfg.MaxFiles, "filter", cfg.Filter, "duration", cfg.Duration)
 }
 
-func (c *Controller) onCaptureExit(key string) {
+// onCaptureExit records that the capture process writing filePattern
+// exited. A process stopped for a restart may exit after its successor
+// started; stopCapture already closed its session, so the successor's state
+// is left alone.
+func (c *Controller) onCaptureExit(key, filePattern, reason string) {
+	c.mu.Lock()
+	state := c.activeCaptures[key]
+	if state != nil && state.filePattern != filePattern {
+		state = nil
+	}
+	if state != nil && reason != "" {
+		state.stopReason = reason
+	}
+	c.mu.Unlock()
+
+	if reason == "" {
+		reason = StopReasonExited
+	}
+	c.closeSession(key, state, reason)
 	c.queue.Add(key)
 }
 
+// captureStatus describes the capture for key after a sync that returned err.
+func (c *Controller) captureStatus(key string, err error) *CaptureStatus {
+	status := &CaptureStatus{Node: c.nodeName, NextCapture: c.nextCapture(key)}
+	if err != nil {
+		status.Message = err.Error()
+		var te *terminalError
+		if errors.As(err, &te) {
+			status.Phase = te.phase
+		} else {
+			status.Phase = CapturePending
+		}
+		return status
+	}
+
+	c.mu.Lock()
+	state := c.activeCaptures[key]
+	status.Preempted = c.preempted[key]
+	c.mu.Unlock()
+	if state == nil && status.NextCapture != nil && !status.Preempted && c.processManager.QueuePosition(key) == 0 {
+		status.Phase = CaptureScheduled
+		return status
+	}
+	if state == nil {
+		status.Phase = CapturePending
+		status.QueuePosition = c.processManager.QueuePosition(key)
+		var messages []string
+		if status.Preempted {
+			messages = append(messages, "preempted by a higher-priority capture")
+		}
+		if status.QueuePosition > 0 {
+			messages = append(messages, pendingMessage(status.QueuePosition))
+		}
+		status.Message = strings.Join(messages, ", ")
+		return status
+	}
+	status.Files = state.filePattern
+	status.StartTime = &state.startTime
+	status.FlowID, status.Peer = state.config.FlowID, state.config.Peer
+	if state.stopReason == StopReasonPreempted {
+		// The resync that queues it to resume follows shortly
+		status.Phase = CapturePending
+		status.Preempted = true
+		status.Message = "preempted by a higher-priority capture"
+	} else if state.stopReason != "" && status.NextCapture != nil {
+		// Files and StartTime describe the last session
+		status.Phase = CaptureScheduled
+		status.Message = "last session: " + state.stopReason
+	} else if state.stopReason != "" {
+		status.Phase = CaptureCompleted
+		status.Message = state.stopReason
+	} else {
+		status.Phase = CaptureRunning
+		if rs, ok := c.processManager.RecorderStatus(key); ok {
+			status.Message = recorderMessage(rs)
+		} else if matched := c.processManager.StopMatch(key); matched != "" {
+			status.Message = "stop condition matched: " + matched
+		}
+	}
+	return status
+}
+
+// updateStatus writes status to the Pod's status annotation, or removes the
+// annotation when status is nil. It does nothing if the value is unchanged,
+// so the resulting Pod update event settles without another write.
+func (c *Controller) updateStatus(ctx context.Context, pod *corev1.Pod, status *CaptureStatus) error {
+	current, hasCurrent := pod.Annotations[StatusAnnotationKey]
+
+	var value interface{}
+	if status == nil {
+		if !hasCurrent {
+			return nil
+		}
+	} else {
+		data, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		if hasCurrent && current == string(data) {
+			return nil
+		}
+		value = string(data)
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{StatusAnnotationKey: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("failed to update capture status: %w", err)
+	}
+	return nil
+}
+
 func (c *Controller) stopCapture(podKey string, cleanup bool) {
 	c.mu.Lock()
 	state := c.activeCaptures[podKey]
 	if state != nil {
 		delete(c.activeCaptures, podKey)
 	}
-	c.mu.Unlock()
-
-	if state == nil {
-		return
+	delete(c.preempted, podKey)
+	if cleanup {
+		delete(c.namespaceReports, podKey)
+		delete(c.schedules, podKey)
+		delete(c.triggers, podKey)
 	}
+	c.mu.Unlock()
 
+	// A queued capture may have been started by the process manager before
+	// its state was recorded, so stop it even without state.
+	c.processManager.CancelPending(podKey)
 	c.processManager.StopCapture(podKey)
-	if cleanup {
+	if state != nil && cleanup {
+		// Remove earlier sessions too; state only knows the current one.
 		c.processManager.CleanupCaptureFilesForPod(state.filePattern)
+		c.removePodSessions(podKey, state.uid)
+	} else {
+		c.closeSession(podKey, state, StopReasonRestarted)
 	}
 }
 
-func (c *Controller) captureFileLocation(podName string) string {
-	return filepath.Join(c.captureDir, fmt.Sprintf("capture-%s.pcap", podName))
-}
-
-func (c *Controller) captureFilePattern(podName string) string {
-	return filepath.Join(c.captureDir, fmt.Sprintf("capture-%s.pcap*", podName))
-}
-
 func (c *Controller) getCaptureState(podKey string) *CaptureState {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -0,0 +1,210 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/packet"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+// decapSuffix names the decapsulated copy of a tunnel capture, after the
+// interface name.
+const decapSuffix = ".decap.pcapng"
+
+// Decapsulate writes the packets of pcap captures of a tunnel interface to
+// out as pcapng, reading the inputs one after another. VXLAN and Geneve
+// packets are replaced by their inner Ethernet frame, commented with the
+// tunnel, e.g. "geneve vni=0 192.168.77.2:43210 > 192.168.77.3:6081". Other
+// packets are written unchanged. A truncated final record ends its input. It
+// returns how many packets were decapsulated.
+func Decapsulate(out io.Writer, inputs ...*pcap.Reader) (int, error) {
+	headers := make([]pcap.FileHeader, len(inputs))
+	for i, r := range inputs {
+		headers[i] = r.Header()
+	}
+	d, err := newDecapWriter(out, headers)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range inputs {
+		if err := d.copy(r); err != nil {
+			return d.decapsulated, err
+		}
+	}
+	return d.decapsulated, nil
+}
+
+// decapWriter writes the packets of pcap inputs with one link type as
+// decapsulated pcapng.
+type decapWriter struct {
+	w            *pcap.NgWriter
+	linkType     uint32
+	decapsulated int
+}
+
+// newDecapWriter writes the pcapng header for inputs with headers to out.
+func newDecapWriter(out io.Writer, headers []pcap.FileHeader) (*decapWriter, error) {
+	if len(headers) == 0 {
+		return nil, fmt.Errorf("no pcap inputs to decapsulate")
+	}
+	hdr := headers[0]
+	for _, h := range headers[1:] {
+		if h.LinkType != hdr.LinkType {
+			return nil, fmt.Errorf("cannot decapsulate link types %d and %d together", hdr.LinkType, h.LinkType)
+		}
+		hdr.SnapLen = max(hdr.SnapLen, h.SnapLen)
+	}
+	w, err := pcap.NewNgWriter(out, hdr.LinkType, hdr.SnapLen)
+	if err != nil {
+		return nil, err
+	}
+	return &decapWriter{w: w, linkType: hdr.LinkType}, nil
+}
+
+// copy writes the packets of r, decapsulating those in tunnels.
+func (d *decapWriter) copy(r *pcap.Reader) error {
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		comment := ""
+		if tunnel, inner, err := packet.Decapsulate(d.linkType, rec.Data); err == nil {
+			// The inner frame was truncated by as much as the packet
+			headers := uint32(len(rec.Data) - len(inner))
+			rec = &pcap.Record{
+				Timestamp: rec.Timestamp,
+				OrigLen:   max(rec.OrigLen, uint32(len(rec.Data))) - headers,
+				Data:      inner,
+			}
+			comment = tunnel.String()
+			d.decapsulated++
+		}
+		if err := d.w.WriteRecord(rec, comment); err != nil {
+			return err
+		}
+	}
+}
+
+// decapsulateTunnels writes the decapsulated copy of the tunnel captures of
+// a stopped session, from the files in md, into the session directory.
+// Copies already written are kept. It reports whether it wrote any.
+func decapsulateTunnels(dir string, md *SessionMetadata) bool {
+	wrote := false
+	for _, iface := range md.Interfaces {
+		if iface.Role != NodeInterfaceTunnel {
+			continue
+		}
+		var paths []string
+		for _, f := range md.Files {
+			if f.Interface == iface.Name && !f.Decapsulated && !f.Summary {
+				paths = append(paths, filepath.Join(dir, f.Name))
+			}
+		}
+		output := filepath.Join(dir, iface.Name+decapSuffix)
+		if _, err := os.Stat(output); len(paths) == 0 || err == nil {
+			continue
+		}
+		n, err := decapsulateFiles(output, paths)
+		if err != nil {
+			klog.ErrorS(err, "Failed to decapsulate tunnel capture", "dir", dir, "interface", iface.Name)
+			continue
+		}
+		klog.InfoS("Decapsulated tunnel capture", "dir", dir, "interface", iface.Name, "packets", n)
+		wrote = true
+	}
+	return wrote
+}
+
+// decapsulateFiles decapsulates the pcap files at paths, oldest first, into
+// output. Files without a header yet are skipped. The headers are read
+// first, and each file is then open only while it is copied.
+func decapsulateFiles(output string, paths []string) (int, error) {
+	var (
+		headers  []pcap.FileHeader
+		readable []string
+	)
+	for _, path := range paths {
+		hdr, err := readPcapHeader(path)
+		if errors.Is(err, errNoHeader) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		headers = append(headers, hdr)
+		readable = append(readable, path)
+	}
+	if len(readable) == 0 {
+		return 0, fmt.Errorf("no readable capture files")
+	}
+
+	// Written under a hidden name, which session file lists skip
+	tmp := filepath.Join(filepath.Dir(output), "."+filepath.Base(output))
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	n, err := copyDecapsulated(out, headers, readable)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return n, os.Rename(tmp, output)
+}
+
+func copyDecapsulated(out io.Writer, headers []pcap.FileHeader, paths []string) (int, error) {
+	d, err := newDecapWriter(out, headers)
+	if err != nil {
+		return 0, err
+	}
+	for _, path := range paths {
+		if err := copyDecapsulatedFile(d, path); err != nil {
+			return d.decapsulated, err
+		}
+	}
+	return d.decapsulated, nil
+}
+
+func copyDecapsulatedFile(d *decapWriter, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		return err
+	}
+	return d.copy(r)
+}
+
+// errNoHeader reports a pcap file without a complete header, such as one
+// tcpdump just rotated into.
+var errNoHeader = errors.New("no pcap header")
+
+// readPcapHeader returns the header of the pcap file at path.
+func readPcapHeader(path string) (pcap.FileHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return pcap.FileHeader{}, err
+	}
+	defer f.Close()
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		return pcap.FileHeader{}, fmt.Errorf("%w: %v", errNoHeader, err)
+	}
+	return r.Header(), nil
+}
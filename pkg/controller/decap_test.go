@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+func TestDecapsulateTunnels(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "capture-default_web_1_20260301T123000Z")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// An Ethernet frame with an IPv4 header, and the same frame in VXLAN
+	inner := make([]byte, 14+20)
+	binary.BigEndian.PutUint16(inner[12:14], 0x0800)
+	inner[14] = 0x45
+	binary.BigEndian.PutUint16(inner[16:18], 20)
+	outer := make([]byte, 14+20+8+8)
+	binary.BigEndian.PutUint16(outer[12:14], 0x0800)
+	outer[14] = 0x45
+	binary.BigEndian.PutUint16(outer[16:18], uint16(20+8+8+len(inner)))
+	outer[14+9] = 17
+	copy(outer[14+12:], []byte{192, 168, 77, 2, 192, 168, 77, 3})
+	binary.BigEndian.PutUint16(outer[34:36], 43210)
+	binary.BigEndian.PutUint16(outer[36:38], 4789)
+	outer[42] = 0x08
+	outer[48] = 1
+	outer = append(outer, inner...)
+
+	var buf bytes.Buffer
+	w, _ := pcap.NewWriter(&buf, pcap.DefaultHeader())
+	ts := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	w.WriteRecord(&pcap.Record{Timestamp: ts, Data: outer})
+	w.WriteRecord(&pcap.Record{Timestamp: ts.Add(time.Second), Data: inner})
+	if err := os.WriteFile(filepath.Join(dir, "eth0.pcap0"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	md := &SessionMetadata{
+		Interfaces: []SessionInterface{{Name: "eth0", Role: NodeInterfaceTunnel}},
+		Files:      sessionFiles(dir, nil),
+	}
+	if !decapsulateTunnels(dir, md) {
+		t.Fatal("decapsulateTunnels wrote nothing")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "eth0"+decapSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]byte{inner, []byte("vxlan vni=1 192.168.77.2:43210 > 192.168.77.3:4789")} {
+		if !bytes.Contains(data, want) {
+			t.Errorf("decapsulated capture lacks %q", want)
+		}
+	}
+	if bytes.Contains(data, outer[:42]) {
+		t.Error("decapsulated capture still holds the outer headers")
+	}
+	if decapsulateTunnels(dir, md) {
+		t.Error("decapsulated copy written again")
+	}
+
+	for _, f := range sessionFiles(dir, md.Files) {
+		if f.Interface != "eth0" || f.Decapsulated != (f.Name == "eth0"+decapSuffix) {
+			t.Errorf("file = %+v", f)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// flowPeerIndex indexes Pods by the peer of their two-ended capture, so the
+// controller of the destination finds the source.
+const flowPeerIndex = "flowPeer"
+
+// parsePeer validates a PeerAnnotationKey value.
+func parsePeer(value string) (string, error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid peer %q: %w", value, err)
+	}
+	if namespace != "" {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return "", fmt.Errorf("invalid peer namespace %q: %s", namespace, strings.Join(errs, ", "))
+		}
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", fmt.Errorf("invalid peer name %q: %s", name, strings.Join(errs, ", "))
+	}
+	return value, nil
+}
+
+// peerKey returns the key of the peer named by the annotations of pod, or ""
+// if it names none.
+func peerKey(pod *corev1.Pod) string {
+	peer := pod.Annotations[PeerAnnotationKey]
+	if peer == "" || pod.Annotations[AnnotationKey] == "" {
+		return ""
+	}
+	if !strings.Contains(peer, "/") {
+		return pod.Namespace + "/" + peer
+	}
+	return peer
+}
+
+// indexFlowPeer is the flowPeerIndex function.
+func indexFlowPeer(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	if peer := peerKey(pod); peer != "" {
+		return []string{peer}, nil
+	}
+	return nil, nil
+}
+
+// enqueueFlowPeers queues the local Pods at the other end of the two-ended
+// captures of pod: its peer, if it is a source, and the sources that name it.
+func (c *Controller) enqueueFlowPeers(pod *corev1.Pod) {
+	if peer := peerKey(pod); peer != "" {
+		namespace, name, _ := cache.SplitMetaNamespaceKey(peer)
+		if p, err := c.podLister.Pods(namespace).Get(name); err == nil && p.Spec.NodeName == c.nodeName {
+			c.queue.Add(peer)
+		}
+	}
+	if c.podIndexer == nil {
+		return
+	}
+	sources, err := c.podIndexer.ByIndex(flowPeerIndex, podKey(pod))
+	if err != nil {
+		klog.ErrorS(err, "Failed to look up two-ended captures", "pod", podKey(pod))
+		return
+	}
+	for _, obj := range sources {
+		if source := obj.(*corev1.Pod); source.Spec.NodeName == c.nodeName {
+			c.queue.Add(podKey(source))
+		}
+	}
+}
+
+// sourceFlowConfig resolves the two-ended capture cfg that the source Pod
+// requests.
+func (c *Controller) sourceFlowConfig(source *corev1.Pod, cfg *CaptureConfig) (*CaptureConfig, error) {
+	peer := peerKey(source)
+	namespace, name, _ := cache.SplitMetaNamespaceKey(peer)
+	destination, err := c.podLister.Pods(namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("peer %s: %w", peer, err)
+	}
+	flow, err := resolveFlow(source, destination, cfg)
+	if err != nil {
+		return nil, err
+	}
+	flow.Peer = peer
+	return flow, nil
+}
+
+// destinationFlowConfig returns the two-ended capture that a source Pod
+// requests with destination as its peer, and the source. It returns nil if
+// none does. When several do, the first by key wins.
+func (c *Controller) destinationFlowConfig(destination *corev1.Pod) (*CaptureConfig, string, error) {
+	if c.podIndexer == nil {
+		return nil, "", nil
+	}
+	objs, err := c.podIndexer.ByIndex(flowPeerIndex, podKey(destination))
+	if err != nil || len(objs) == 0 {
+		return nil, "", err
+	}
+	sources := make([]*corev1.Pod, len(objs))
+	for i, obj := range objs {
+		sources[i] = obj.(*corev1.Pod)
+	}
+	slices.SortFunc(sources, func(a, b *corev1.Pod) int { return strings.Compare(podKey(a), podKey(b)) })
+	source := sources[0]
+	key := podKey(source)
+	if len(sources) > 1 {
+		klog.V(2).InfoS("Several Pods request a two-ended capture with this Pod, using the first", "pod", podKey(destination), "source", key)
+	}
+
+	cfg, err := ParseCaptureConfig(source.Annotations)
+	if err != nil {
+		return nil, key, fmt.Errorf("capture request of %s: %w", key, err)
+	}
+	flow, err := resolveFlow(source, destination, cfg)
+	if err != nil {
+		return nil, key, err
+	}
+	flow.Peer = key
+	return flow, key, nil
+}
+
+// resolveFlow returns cfg restricted to the flows between source and
+// destination, in both directions, with the ID both ends share. Both ends
+// build the same filter, so they capture the same packets.
+func resolveFlow(source, destination *corev1.Pod, cfg *CaptureConfig) (*CaptureConfig, error) {
+	sourceAddrs, err := podAddrs(source)
+	if err != nil {
+		return nil, err
+	}
+	destinationAddrs, err := podAddrs(destination)
+	if err != nil {
+		return nil, err
+	}
+	flow := *cfg
+	flow.Filter = joinFilters(hostFilter(sourceAddrs), hostFilter(destinationAddrs), cfg.Filter)
+	flow.FlowID = flowID(source, destination)
+	return &flow, nil
+}
+
+// podAddrs returns the IPs of pod, or an error if it has none yet.
+func podAddrs(pod *corev1.Pod) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, ip := range pod.Status.PodIPs {
+		addr, err := netip.ParseAddr(ip.IP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q of %s: %w", ip.IP, podKey(pod), err)
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s has no IPs yet", podKey(pod))
+	}
+	return addrs, nil
+}
+
+// flowID identifies a two-ended capture by the UIDs of its Pods, so both
+// controllers derive it on their own, and a recreated Pod gets a new one.
+func flowID(source, destination *corev1.Pod) string {
+	sum := sha1.Sum([]byte(string(source.UID) + "/" + string(destination.UID)))
+	return "flow-" + hex.EncodeToString(sum[:])[:12]
+}
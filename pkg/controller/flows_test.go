@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestTwoEndedCapture(t *testing.T) {
+	pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{flowPeerIndex: indexFlowPeer})
+	client := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web-1", UID: "u1", Annotations: map[string]string{
+			AnnotationKey:       "3",
+			FilterAnnotationKey: "tcp port 5432",
+			PeerAnnotationKey:   "data/db-0",
+		}},
+		Spec:   corev1.PodSpec{NodeName: "node-1"},
+		Status: corev1.PodStatus{PodIPs: []corev1.PodIP{{IP: "10.244.1.5"}}},
+	}
+	server := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "data", Name: "db-0", UID: "u2"},
+		Spec:       corev1.PodSpec{NodeName: "node-2"},
+	}
+	pods.Add(client)
+	pods.Add(server)
+	newController := func(node string) *Controller {
+		return &Controller{
+			podLister:  corelisters.NewPodLister(pods),
+			podIndexer: pods,
+			queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+			nodeName:   node,
+		}
+	}
+	node1, node2 := newController("node-1"), newController("node-2")
+	defer node1.queue.ShutDown()
+	defer node2.queue.ShutDown()
+
+	// Without the peer's IPs neither end can build the filter
+	if _, _, err := node1.podCaptureConfig(client); err == nil {
+		t.Error("source end started without the peer's IPs")
+	}
+	if _, _, err := node2.podCaptureConfig(server); err == nil {
+		t.Error("destination end started without the peer's IPs")
+	}
+
+	// The peer's IPs are known once it updates, which queues the source
+	server = server.DeepCopy()
+	server.Status.PodIPs = []corev1.PodIP{{IP: "10.244.2.9"}, {IP: "fd00:10:244:2::9"}}
+	pods.Update(server)
+	node1.enqueuePod(server)
+	if node1.queue.Len() != 1 {
+		t.Errorf("source not queued on node-1, queue length %d", node1.queue.Len())
+	}
+
+	source, srcFrom, err := node1.podCaptureConfig(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination, dstFrom, err := node2.podCaptureConfig(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFilter := "((host 10.244.1.5) and (host 10.244.2.9 or host fd00:10:244:2::9)) and (tcp port 5432)"
+	if source.Filter != wantFilter || destination.Filter != wantFilter {
+		t.Errorf("filters = %q, %q; want %q", source.Filter, destination.Filter, wantFilter)
+	}
+	if source.FlowID == "" || source.FlowID != destination.FlowID {
+		t.Errorf("flow IDs = %q, %q", source.FlowID, destination.FlowID)
+	}
+	if source.Peer != "data/db-0" || destination.Peer != "shop/web-1" || destination.MaxFiles != 3 {
+		t.Errorf("source = %+v, destination = %+v", source, destination)
+	}
+	if srcFrom.flowSource != "" || dstFrom.flowSource != "shop/web-1" {
+		t.Errorf("sources = %+v, %+v", srcFrom, dstFrom)
+	}
+
+	// The source changing queues the destination on its node
+	node2.enqueuePod(client)
+	if key, _ := node2.queue.Get(); key != "data/db-0" {
+		t.Errorf("queued %v, want data/db-0", key)
+	}
+}
+
+func TestParsePeer(t *testing.T) {
+	for value, valid := range map[string]bool{"db-0": true, "data/db-0": true, "Data/db-0": false, "a/b/c": false, "": false} {
+		if _, err := parsePeer(value); (err == nil) != valid {
+			t.Errorf("parsePeer(%q) = %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// GCConfig configures the orphaned capture file garbage collector.
+type GCConfig struct {
+	// Interval between sweeps.
+	Interval time.Duration
+	// GracePeriod is how long a file must be left unmodified before it is
+	// reclaimed, so files of a Pod that is being recreated survive.
+	GracePeriod time.Duration
+	// DryRun only logs and counts what would be reclaimed.
+	DryRun bool
+	// ArchiveDir, if set, receives orphaned files instead of deleting them.
+	ArchiveDir string
+}
+
+// RunGarbageCollector periodically reclaims capture sessions and files whose
+// Pod no longer exists. stopCapture only cleans up when it sees the Pod go away, so this
+// catches Pods deleted while the controller was down or crash-looping.
+func (c *Controller) RunGarbageCollector(ctx context.Context, cfg GCConfig) {
+	if !cache.WaitForCacheSync(ctx.Done(), c.podSynced) {
+		return
+	}
+
+	klog.InfoS("Starting capture file garbage collector",
+		"interval", cfg.Interval, "gracePeriod", cfg.GracePeriod, "dryRun", cfg.DryRun, "archiveDir", cfg.ArchiveDir)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		c.collectGarbage(cfg, time.Now())
+	}, cfg.Interval)
+}
+
+// collectGarbage runs one sweep over the capture directory. Session
+// directories are reclaimed as a whole; files written directly into the
+// capture directory by earlier versions one by one.
+func (c *Controller) collectGarbage(cfg GCConfig, now time.Time) {
+	files, err := c.listCaptureFiles()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list capture files")
+		return
+	}
+	localPods, err := c.localPodsByName()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list Pods for garbage collection")
+		return
+	}
+
+	action := "delete"
+	switch {
+	case cfg.DryRun:
+		action = "dry-run"
+	case cfg.ArchiveDir != "":
+		action = "archive"
+	}
+
+	for _, cf := range files {
+		f, podName := cf.path, cf.fields.Pod
+		if hasLocalOwner(cf, localPods) || c.ownedByActiveCapture(f) {
+			continue
+		}
+
+		info, err := os.Stat(f)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if now.Sub(info.ModTime()) < cfg.GracePeriod {
+			continue
+		}
+
+		switch action {
+		case "dry-run":
+			klog.InfoS("Would reclaim orphaned capture file", "file", f, "podName", podName, "bytes", info.Size())
+		case "archive":
+			if err := moveFile(f, filepath.Join(cfg.ArchiveDir, filepath.Base(f))); err != nil {
+				klog.ErrorS(err, "Failed to archive orphaned capture file", "file", f)
+				continue
+			}
+			klog.InfoS("Archived orphaned capture file", "file", f, "podName", podName, "bytes", info.Size())
+		default:
+			if err := os.Remove(f); err != nil {
+				klog.ErrorS(err, "Failed to remove orphaned capture file", "file", f)
+				continue
+			}
+			klog.InfoS("Removed orphaned capture file", "file", f, "podName", podName, "bytes", info.Size())
+		}
+		gcReclaimedBytes.WithLabelValues(action).Add(float64(info.Size()))
+		gcReclaimedFiles.WithLabelValues(action).Inc()
+	}
+
+	sessions, err := c.listSessions()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list capture sessions")
+		return
+	}
+	for _, s := range sessions {
+		if hasLocalOwner(s.captureFile, localPods) || c.ownedByActiveSession(s.path) {
+			continue
+		}
+		c.collectSession(s, cfg, action, now)
+	}
+}
+
+// collectSession reclaims an orphaned session directory once nothing in it
+// changed for the grace period.
+func (c *Controller) collectSession(s captureSession, cfg GCConfig, action string, now time.Time) {
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return
+	}
+	var bytes int64
+	var files int
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if now.Sub(info.ModTime()) < cfg.GracePeriod {
+			return
+		}
+		if info.Mode().IsRegular() && e.Name() != metadataFileName {
+			bytes += info.Size()
+			files++
+		}
+	}
+
+	podName := klog.KRef(s.fields.Namespace, s.fields.Pod)
+	switch action {
+	case "dry-run":
+		klog.InfoS("Would reclaim orphaned capture session", "dir", s.path, "pod", podName, "bytes", bytes)
+	case "archive":
+		if err := moveDir(s.path, filepath.Join(cfg.ArchiveDir, filepath.Base(s.path))); err != nil {
+			klog.ErrorS(err, "Failed to archive orphaned capture session", "dir", s.path)
+			return
+		}
+		klog.InfoS("Archived orphaned capture session", "dir", s.path, "pod", podName, "bytes", bytes)
+	default:
+		if err := os.RemoveAll(s.path); err != nil {
+			klog.ErrorS(err, "Failed to remove orphaned capture session", "dir", s.path)
+			return
+		}
+		klog.InfoS("Removed orphaned capture session", "dir", s.path, "pod", podName, "bytes", bytes)
+	}
+	gcReclaimedBytes.WithLabelValues(action).Add(float64(bytes))
+	gcReclaimedFiles.WithLabelValues(action).Add(float64(files))
+}
+
+// hasLocalOwner reports whether a Pod on this node may own f. Legacy files
+// only carry a name, so any Pod of that name keeps them.
+func hasLocalOwner(f captureFile, localPods map[string][]*corev1.Pod) bool {
+	for _, pod := range localPods[f.fields.Pod] {
+		if f.belongsTo(pod) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedByActiveCapture reports whether a tracked capture wrote the file.
+func (c *Controller) ownedByActiveCapture(file string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, state := range c.activeCaptures {
+		if ok, _ := filepath.Match(state.filePattern, file); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedByActiveSession reports whether dir is the session of a tracked
+// capture.
+func (c *Controller) ownedByActiveSession(dir string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, state := range c.activeCaptures {
+		if state.sessionDir == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// moveDir moves a session directory, file by file when src and dst are on
+// different filesystems.
+func moveDir(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := moveFile(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(src)
+}
+
+// moveFile renames src to dst, copying when they are on different
+// filesystems.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
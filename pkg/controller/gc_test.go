@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	dir := t.TempDir()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "alive"},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+	})
+	c := &Controller{
+		podLister:      corelisters.NewPodLister(indexer),
+		nodeName:       "node-1",
+		naming:         defaultFileNaming,
+		captureDir:     dir,
+		activeCaptures: map[string]*CaptureState{},
+	}
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	files := map[string]time.Time{
+		"capture-alive.pcap0":  old, // Pod still exists
+		"capture-gone.pcap0":   old, // orphaned past the grace period
+		"capture-gone.pcap1":   old,
+		"capture-recent.pcap0": now, // orphaned but within the grace period
+	}
+	for name, mtime := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	c.collectGarbage(GCConfig{GracePeriod: time.Hour, DryRun: true}, now)
+	if !exists("capture-gone.pcap0") {
+		t.Fatal("dry run must not remove files")
+	}
+
+	archive := filepath.Join(dir, "archive")
+	c.collectGarbage(GCConfig{GracePeriod: time.Hour, ArchiveDir: archive}, now)
+	for name, want := range map[string]bool{
+		"capture-alive.pcap0":  true,
+		"capture-gone.pcap0":   false,
+		"capture-gone.pcap1":   false,
+		"capture-recent.pcap0": true,
+	} {
+		if got := exists(name); got != want {
+			t.Errorf("%s exists = %v, want %v", name, got, want)
+		}
+	}
+	if !exists("archive/capture-gone.pcap0") {
+		t.Error("orphaned file should have been archived")
+	}
+}
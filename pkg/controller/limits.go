@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+// annotationPrefix is shared by every capture annotation key.
+const annotationPrefix = AnnotationKey + "/"
+
+// Limits are operator bounds on capture requests, enforced by the controller
+// and the admission webhook alike. Zero values are unlimited.
+type Limits struct {
+	MaxFiles    int
+	MaxDuration time.Duration
+}
+
+// Check returns an error if cfg is over a limit.
+func (l Limits) Check(cfg *CaptureConfig) error {
+	if l.MaxFiles > 0 && cfg.MaxFiles > l.MaxFiles {
+		return fmt.Errorf("max files %d exceeds the limit of %d", cfg.MaxFiles, l.MaxFiles)
+	}
+	if l.MaxDuration > 0 && cfg.Duration > l.MaxDuration {
+		return fmt.Errorf("duration %s exceeds the limit of %s", cfg.Duration, l.MaxDuration)
+	}
+	if l.MaxDuration > 0 && cfg.Duration == 0 {
+		return fmt.Errorf("a duration of at most %s is required", l.MaxDuration)
+	}
+	return nil
+}
+
+// SetLimits configures the operator limits on capture requests. It must be
+// called before Run.
+func (c *Controller) SetLimits(limits Limits) {
+	c.limits = limits
+}
+
+// ValidateAnnotations checks a Pod's capture annotations the way the
+// controller reads them: their format, unknown keys under the
+// tcpdump.antrea.io/ prefix, the operator limits and the namespace's priority
+// policy. It returns the parsed config, which is nil if no capture is
+// requested.
+func ValidateAnnotations(namespace string, annotations map[string]string, limits Limits, priorities PriorityPolicy) (*CaptureConfig, error) {
+	if err := checkAnnotationKeys(annotations); err != nil {
+		return nil, err
+	}
+
+	cfg, err := ParseCaptureConfig(annotations)
+	if err != nil || cfg == nil {
+		return nil, err
+	}
+	if err := limits.Check(cfg); err != nil {
+		return nil, err
+	}
+	if err := priorities.Check(namespace, cfg.Priority); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// checkAnnotationKeys rejects unknown keys under the tcpdump.antrea.io/
+// prefix, typically misspelt ones.
+func checkAnnotationKeys(annotations map[string]string) error {
+	for key := range annotations {
+		if strings.HasPrefix(key, annotationPrefix) && !knownAnnotation(key) {
+			return fmt.Errorf("unknown annotation %q", key)
+		}
+	}
+	return nil
+}
+
+func knownAnnotation(key string) bool {
+	switch key {
+	case FilterAnnotationKey, DurationAnnotationKey, PriorityAnnotationKey, ScheduleAnnotationKey, KeepSessionsAnnotationKey,
+		FlightRecorderAnnotationKey, PostTriggerAnnotationKey, TriggerMatchAnnotationKey, TriggerAnnotationKey,
+		StopOnAnnotationKey, StopOnFilterAnnotationKey, StopTailAnnotationKey, NodeInterfacesAnnotationKey, PeerAnnotationKey,
+		PacketCountAnnotationKey, StatusAnnotationKey:
+		return true
+	}
+	return false
+}
+
+// CompileFilter checks that tcpdump accepts filter by compiling it against an
+// empty Ethernet capture file, which needs no capture privileges.
+func CompileFilter(ctx context.Context, filter string) error {
+	if filter == "" {
+		return nil
+	}
+
+	f, err := os.CreateTemp("", "filter-*.pcap")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := pcap.NewWriter(f, pcap.DefaultHeader()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	out, err := exec.CommandContext(ctx, "tcpdump", "-d", "-r", f.Name(), "--", filter).CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return fmt.Errorf("invalid filter %q: %s", filter, msg)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package controller
+
+import "testing"
+
+func TestCheckAnnotationKeys(t *testing.T) {
+	valid := map[string]string{
+		AnnotationKey:           "5",
+		FilterAnnotationKey:     "tcp port 80",
+		StatusAnnotationKey:     "{}",
+		"example.com/unrelated": "x",
+	}
+	if err := checkAnnotationKeys(valid); err != nil {
+		t.Errorf("checkAnnotationKeys(%v) = %v", valid, err)
+	}
+	typo := map[string]string{AnnotationKey: "5", annotationPrefix + "fitler": "tcp port 80"}
+	if err := checkAnnotationKeys(typo); err == nil {
+		t.Errorf("checkAnnotationKeys accepted %v", typo)
+	}
+}
@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const metricsSubsystem = "packet_capture"
+
+var (
+	gcReclaimedBytes = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "gc_reclaimed_bytes_total",
+			Help:           "Bytes of orphaned capture files reclaimed by the garbage collector, by action (delete, archive, dry-run).",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"action"},
+	)
+
+	gcReclaimedFiles = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "gc_reclaimed_files_total",
+			Help:           "Orphaned capture files reclaimed by the garbage collector, by action (delete, archive, dry-run).",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"action"},
+	)
+
+	diskPressureLevel = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "disk_pressure_level",
+			Help:           "Free-space pressure on the capture filesystem: 0 none, 1 below the soft threshold, 2 below the hard threshold.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+)
+
+var registerMetricsOnce sync.Once
+
+// registerMetrics registers the controller's metrics with the legacy registry
+// served on /metrics.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(gcReclaimedBytes)
+		legacyregistry.MustRegister(gcReclaimedFiles)
+		legacyregistry.MustRegister(diskPressureLevel)
+	})
+}
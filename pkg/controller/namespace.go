@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"fmt"
+	"maps"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// SetNamespaceCaptures lets the capture annotations of a Namespace apply to
+// all its Pods. It must be called before Run.
+func (c *Controller) SetNamespaceCaptures(namespaceInformer coreinformers.NamespaceInformer) {
+	c.namespaceCaptures = true
+	c.watchNamespaces(namespaceInformer)
+}
+
+// watchNamespaces starts using the Namespace informer, once.
+func (c *Controller) watchNamespaces(namespaceInformer coreinformers.NamespaceInformer) {
+	if c.namespaceLister != nil {
+		return
+	}
+	c.namespaceLister = namespaceInformer.Lister()
+	c.namespaceSynced = namespaceInformer.Informer().HasSynced
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: c.updateNamespace,
+	})
+}
+
+// updateNamespace resyncs the Pods of a Namespace whose labels changed, as
+// they may no longer satisfy the policy, or whose capture annotations
+// changed.
+func (c *Controller) updateNamespace(oldObj, newObj interface{}) {
+	oldNamespace := oldObj.(*corev1.Namespace)
+	newNamespace := newObj.(*corev1.Namespace)
+	if labels.Equals(oldNamespace.Labels, newNamespace.Labels) &&
+		(!c.namespaceCaptures || maps.Equal(CaptureRequestAnnotations(oldNamespace.Annotations), CaptureRequestAnnotations(newNamespace.Annotations))) {
+		return
+	}
+	pods, err := c.podLister.Pods(newNamespace.Name).List(labels.Everything())
+	if err != nil {
+		klog.ErrorS(err, "Failed to list Pods", "namespace", newNamespace.Name)
+		return
+	}
+	for _, pod := range pods {
+		c.enqueuePod(pod)
+	}
+}
+
+// namespaceCaptureAnnotations returns the capture annotations of a Namespace
+// when namespace-wide captures are enabled.
+func (c *Controller) namespaceCaptureAnnotations(namespace string) map[string]string {
+	if !c.namespaceCaptures {
+		return nil
+	}
+	ns, err := c.namespaceLister.Get(namespace)
+	if err != nil {
+		return nil
+	}
+	return CaptureRequestAnnotations(ns.Annotations)
+}
+
+// reportNamespaceCapture records a Warning Event on the Namespace when a Pod
+// of a namespace-wide capture could not be captured, such as when it was
+// refused or has to wait for a free slot. Each Pod is reported again only
+// when the reason changes.
+func (c *Controller) reportNamespaceCapture(key string, pod *corev1.Pod, status *CaptureStatus) {
+	var reason string
+	switch {
+	case status == nil || !status.NamespaceWide:
+	case status.Phase == CaptureFailed || status.Phase == CaptureRefused:
+		reason = fmt.Sprintf("%s: %s", status.Phase, status.Message)
+	case status.Phase == CapturePending && status.QueuePosition > 0:
+		reason = "waiting for a free capture slot"
+	}
+
+	c.mu.Lock()
+	last := c.namespaceReports[key]
+	if reason == "" {
+		delete(c.namespaceReports, key)
+	} else {
+		c.namespaceReports[key] = reason
+	}
+	c.mu.Unlock()
+	if reason == "" || reason == last {
+		return
+	}
+
+	ns, err := c.namespaceLister.Get(pod.Namespace)
+	if err != nil {
+		return
+	}
+	c.recorder.Eventf(ns, corev1.EventTypeWarning, EventReasonCaptureNotStarted,
+		"Pod %s on node %s was not captured: %s", pod.Name, c.nodeName, reason)
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestNamespaceCaptures(t *testing.T) {
+	namespaces := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	namespaces.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "noisy",
+		Annotations: map[string]string{AnnotationKey: "2", DurationAnnotationKey: "1m"},
+	}})
+	namespaces.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "quiet"}})
+
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{
+		namespaceLister:   corelisters.NewNamespaceLister(namespaces),
+		namespaceCaptures: true,
+		namespaceReports:  map[string]string{},
+		nodeName:          "node-1",
+		recorder:          recorder,
+	}
+
+	pod := func(namespace string, annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "p", Annotations: annotations}}
+	}
+	cfg, source, err := c.podCaptureConfig(pod("noisy", map[string]string{FilterAnnotationKey: "udp"}))
+	if err != nil || cfg == nil || !source.namespaceWide || cfg.MaxFiles != 2 || cfg.Filter != "udp" {
+		t.Fatalf("noisy Pod: cfg %+v source %+v err %v", cfg, source, err)
+	}
+	if cfg, source, _ := c.podCaptureConfig(pod("noisy", map[string]string{AnnotationKey: "5"})); cfg.MaxFiles != 5 || source.namespaceWide {
+		t.Errorf("Pod annotations must take precedence, got %+v %+v", cfg, source)
+	}
+	if cfg, _, _ := c.podCaptureConfig(pod("quiet", nil)); cfg != nil {
+		t.Errorf("quiet Pod: cfg %+v", cfg)
+	}
+
+	// Pods that cannot be captured are reported once per reason.
+	p := pod("noisy", nil)
+	queued := &CaptureStatus{Phase: CapturePending, QueuePosition: 3, NamespaceWide: true}
+	c.reportNamespaceCapture("noisy/p", p, queued)
+	c.reportNamespaceCapture("noisy/p", p, queued)
+	c.reportNamespaceCapture("noisy/p", p, &CaptureStatus{Phase: CaptureRunning, NamespaceWide: true})
+	c.reportNamespaceCapture("noisy/p", p, queued)
+	if n := len(recorder.Events); n != 2 {
+		t.Errorf("expected 2 events, got %d", n)
+	}
+}
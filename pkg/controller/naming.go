@@ -0,0 +1,333 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// DefaultFileNameTemplate names each capture session's files after the Pod's
+// namespace, name and UID and the session start time, so no two sessions
+// share files.
+const DefaultFileNameTemplate = "capture-{{.Namespace}}_{{.Pod}}_{{.UID}}_{{.Start}}.pcap"
+
+// sessionTimeFormat formats FileNameFields.Start.
+const sessionTimeFormat = "20060102T150405Z"
+
+// FileNameFields are the values available to a file name template.
+type FileNameFields struct {
+	Namespace string
+	Pod       string
+	UID       string
+	Container string
+	Start     string
+}
+
+// fileNameFieldPatterns match what each field can hold once rendered.
+var fileNameFieldPatterns = map[string]string{
+	"Namespace": `[a-z0-9-]+`,
+	"Pod":       `[a-z0-9.-]+`,
+	"UID":       `[0-9a-f-]+`,
+	"Container": `[a-z0-9-]+`,
+	"Start":     `[0-9]{8}T[0-9]{6}Z`,
+}
+
+// legacyFileName matches capture-<pod>.pcap* files written before file name
+// templates existed.
+var legacyFileName = regexp.MustCompile(`^capture-(.+)\.pcap([0-9]*(?:` + regexp.QuoteMeta(archiveMarker) + `[0-9]+)?)$`)
+
+// defaultFileNaming uses DefaultFileNameTemplate.
+var defaultFileNaming = func() *FileNaming {
+	naming, err := NewFileNaming(DefaultFileNameTemplate)
+	if err != nil {
+		panic(err)
+	}
+	return naming
+}()
+
+// FileNaming renders capture file names from a template and parses them back.
+type FileNaming struct {
+	tmpl *template.Template
+	re   *regexp.Regexp
+}
+
+// NewFileNaming compiles a file name template such as
+// DefaultFileNameTemplate. The template must produce a plain file name ending
+// in ".pcap" that contains at least the namespace and Pod name. Separate
+// fields with characters they cannot contain, such as "_", so names parse
+// back unambiguously.
+func NewFileNaming(text string) (*FileNaming, error) {
+	tmpl, err := template.New("filename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file name template: %w", err)
+	}
+
+	// Render with markers in place of the fields, then turn the result into
+	// a regexp with a group per field.
+	var markers FileNameFields
+	markers.Namespace, markers.Pod, markers.UID, markers.Container, markers.Start =
+		"\x00Namespace\x00", "\x00Pod\x00", "\x00UID\x00", "\x00Container\x00", "\x00Start\x00"
+	var b strings.Builder
+	if err := tmpl.Execute(&b, markers); err != nil {
+		return nil, fmt.Errorf("invalid file name template: %w", err)
+	}
+	rendered := b.String()
+	if !strings.HasSuffix(rendered, ".pcap") {
+		return nil, fmt.Errorf("file name template must end in .pcap")
+	}
+	if strings.ContainsAny(rendered, "/*?[") {
+		return nil, fmt.Errorf("file name template must not contain path separators or glob characters")
+	}
+	if !strings.Contains(rendered, markers.Namespace) || !strings.Contains(rendered, markers.Pod) {
+		return nil, fmt.Errorf("file name template must contain {{.Namespace}} and {{.Pod}}")
+	}
+
+	parts := strings.Split(rendered, "\x00")
+	var expr strings.Builder
+	expr.WriteString("^")
+	seen := make(map[string]bool)
+	for i, part := range parts {
+		if i%2 == 0 {
+			expr.WriteString(regexp.QuoteMeta(part))
+			continue
+		}
+		if seen[part] {
+			expr.WriteString("(?:" + fileNameFieldPatterns[part] + ")")
+			continue
+		}
+		seen[part] = true
+		expr.WriteString("(?P<" + part + ">" + fileNameFieldPatterns[part] + ")")
+	}
+	expr.WriteString(`(?P<suffix>[0-9]*(?:` + regexp.QuoteMeta(archiveMarker) + `[0-9]+)?)$`)
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid file name template: %w", err)
+	}
+	return &FileNaming{tmpl: tmpl, re: re}, nil
+}
+
+// Name renders the base name of a session's first file. tcpdump appends the
+// rotation number.
+func (n *FileNaming) Name(fields FileNameFields) string {
+	var b strings.Builder
+	// Execution cannot fail; the template was checked with the same fields.
+	n.tmpl.Execute(&b, fields)
+	return b.String()
+}
+
+// Parse extracts the fields of a file name, and the session's base name
+// without the rotation or archive suffix.
+func (n *FileNaming) Parse(name string) (FileNameFields, string, bool) {
+	var fields FileNameFields
+	m := n.re.FindStringSubmatch(name)
+	if m == nil {
+		return fields, "", false
+	}
+	suffix := ""
+	for i, group := range n.re.SubexpNames() {
+		switch group {
+		case "Namespace":
+			fields.Namespace = m[i]
+		case "Pod":
+			fields.Pod = m[i]
+		case "UID":
+			fields.UID = m[i]
+		case "Container":
+			fields.Container = m[i]
+		case "Start":
+			fields.Start = m[i]
+		case "suffix":
+			suffix = m[i]
+		}
+	}
+	return fields, strings.TrimSuffix(name, suffix), true
+}
+
+// captureFile is a file or session directory in the capture directory and
+// what its name says.
+type captureFile struct {
+	path   string
+	fields FileNameFields
+	// base is the session's file name without the rotation suffix, or the
+	// session directory's name.
+	base string
+	// legacy files only carry the Pod name.
+	legacy bool
+}
+
+// SetFileNaming configures how capture files are named. It must be called
+// before Run.
+func (c *Controller) SetFileNaming(naming *FileNaming) {
+	c.naming = naming
+}
+
+// parseCaptureFile recognises a file in the capture directory by the
+// configured template or the legacy capture-<pod>.pcap* layout.
+func (c *Controller) parseCaptureFile(path string) (captureFile, bool) {
+	name := filepath.Base(path)
+	if fields, base, ok := c.naming.Parse(name); ok {
+		return captureFile{path: path, fields: fields, base: base}, true
+	}
+	if m := legacyFileName.FindStringSubmatch(name); m != nil {
+		return captureFile{
+			path:   path,
+			fields: FileNameFields{Pod: m[1]},
+			base:   strings.TrimSuffix(name, m[2]),
+			legacy: true,
+		}, true
+	}
+	return captureFile{}, false
+}
+
+// listCaptureFiles returns the capture files directly in the capture
+// directory, written before captures had session directories.
+func (c *Controller) listCaptureFiles() ([]captureFile, error) {
+	entries, err := os.ReadDir(c.captureDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []captureFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if f, ok := c.parseCaptureFile(filepath.Join(c.captureDir, e.Name())); ok {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// captureDirUsage sums the sizes of all capture files, in session
+// directories or not.
+func (c *Controller) captureDirUsage() int64 {
+	files, err := c.listCaptureFiles()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list capture files", "dir", c.captureDir)
+		return 0
+	}
+	var total int64
+	for _, f := range files {
+		if info, err := os.Stat(f.path); err == nil {
+			total += info.Size()
+		}
+	}
+	sessions, err := c.listSessions()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list capture sessions", "dir", c.captureDir)
+		return total
+	}
+	for _, s := range sessions {
+		total += filesSize(filepath.Join(s.path, "*.pcap*"))
+	}
+	return total
+}
+
+// belongsTo reports whether f was written for pod. Legacy files only match
+// by name, so they are never attributed when the name is ambiguous.
+func (f captureFile) belongsTo(pod *corev1.Pod) bool {
+	if f.legacy {
+		return f.fields.Pod == pod.Name
+	}
+	if f.fields.Namespace != pod.Namespace || f.fields.Pod != pod.Name {
+		return false
+	}
+	return f.fields.UID == "" || f.fields.UID == string(pod.UID)
+}
+
+// fileOwner returns the only local Pod f belongs to, or nil.
+func fileOwner(f captureFile, localPods map[string][]*corev1.Pod) *corev1.Pod {
+	var owner *corev1.Pod
+	for _, pod := range localPods[f.fields.Pod] {
+		if !f.belongsTo(pod) {
+			continue
+		}
+		if owner != nil {
+			return nil
+		}
+		owner = pod
+	}
+	return owner
+}
+
+// migrateFlatFiles moves capture files written directly into the capture
+// directory by earlier versions into session directories with a manifest.
+// Files named by the template keep their names. Legacy capture-<pod>.pcap*
+// files are renamed to the template, but only when exactly one Pod on the
+// node has that name. It returns the new path of each migrated session's
+// first file, keyed by the old base name.
+func (c *Controller) migrateFlatFiles(files []captureFile, localPods map[string][]*corev1.Pod) map[string]string {
+	sessions := make(map[string][]captureFile)
+	for _, f := range files {
+		sessions[f.base] = append(sessions[f.base], f)
+	}
+
+	migrated := make(map[string]string)
+	for base, session := range sessions {
+		first := session[0]
+		var oldest, newest time.Time
+		for _, f := range session {
+			info, err := os.Stat(f.path)
+			if err != nil {
+				continue
+			}
+			if oldest.IsZero() || info.ModTime().Before(oldest) {
+				oldest = info.ModTime()
+			}
+			if info.ModTime().After(newest) {
+				newest = info.ModTime()
+			}
+		}
+
+		md := &SessionMetadata{Node: c.nodeName}
+		var dir, outputFile string
+		if first.legacy {
+			pods := localPods[first.fields.Pod]
+			if len(pods) != 1 {
+				continue
+			}
+			dir, outputFile = c.newSession(pods[0], oldest)
+			md.Namespace, md.Pod, md.UID = pods[0].Namespace, pods[0].Name, string(pods[0].UID)
+			md.StartTime = metav1.NewTime(oldest)
+		} else {
+			dir = filepath.Join(c.captureDir, strings.TrimSuffix(base, ".pcap"))
+			outputFile = filepath.Join(dir, base)
+			md.Namespace, md.Pod, md.UID, md.Container = first.fields.Namespace, first.fields.Pod, first.fields.UID, first.fields.Container
+			md.StartTime = metav1.NewTime(oldest)
+			if start, err := time.Parse(sessionTimeFormat, first.fields.Start); err == nil {
+				md.StartTime = metav1.NewTime(start)
+			}
+		}
+		stop := metav1.NewTime(newest)
+		md.StopTime = &stop
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			klog.ErrorS(err, "Failed to create session directory", "dir", dir)
+			continue
+		}
+		for _, f := range session {
+			suffix := strings.TrimPrefix(filepath.Base(f.path), base)
+			dst := outputFile + suffix
+			if err := os.Rename(f.path, dst); err != nil {
+				klog.ErrorS(err, "Failed to migrate capture file", "file", f.path)
+				continue
+			}
+			klog.InfoS("Migrated capture file", "file", f.path, "to", dst)
+		}
+		md.Files = sessionFiles(dir, nil)
+		if err := writeSessionMetadata(dir, md); err != nil {
+			klog.ErrorS(err, "Failed to write session metadata", "dir", dir)
+		}
+		migrated[base] = outputFile
+	}
+	return migrated
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFileNaming(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web-0", UID: "5f1c2a9e-0b7d-4c1e-9a53-3e2d1f0c9b8a"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	start := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	for _, text := range []string{"{{.Namespace}}/{{.Pod}}.pcap", "{{.Pod}}.pcap", "{{.Namespace}}_{{.Pod}}.cap", "{{.Namespace}}_{{.Pod}}_{{.Bogus}}.pcap"} {
+		if _, err := NewFileNaming(text); err == nil {
+			t.Errorf("NewFileNaming(%q) succeeded, want error", text)
+		}
+	}
+
+	naming, err := NewFileNaming("{{.Namespace}}_{{.Pod}}_{{.Container}}_{{.Start}}.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	c := &Controller{captureDir: dir, naming: naming}
+	sessionDir, file := c.newSession(pod, start)
+	if want := filepath.Join(dir, "team-a_web-0_app_20260301T123000Z"); sessionDir != want {
+		t.Fatalf("newSession() dir = %q, want %q", sessionDir, want)
+	}
+	if want := filepath.Join(sessionDir, "team-a_web-0_app_20260301T123000Z.pcap"); file != want {
+		t.Fatalf("newSession() file = %q, want %q", file, want)
+	}
+	f, ok := c.parseCaptureFile(file + "2")
+	if !ok || f.legacy || f.base != filepath.Base(file) || !f.belongsTo(pod) {
+		t.Fatalf("parseCaptureFile() = %+v, %v", f, ok)
+	}
+	if f.fields.Container != "app" || f.fields.Start != "20260301T123000Z" {
+		t.Errorf("parsed fields = %+v", f.fields)
+	}
+
+	// Legacy files are recognised and moved into a session directory when
+	// the Pod is unambiguous.
+	c.naming = defaultFileNaming
+	for _, name := range []string{"capture-web-0.pcap0", "capture-web-0.pcap1", "capture-db.pcap0"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := c.listCaptureFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPods := map[string][]*corev1.Pod{
+		"web-0": {pod},
+		"db":    {{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "db"}}, {ObjectMeta: metav1.ObjectMeta{Namespace: "b", Name: "db"}}},
+	}
+	migrated := c.migrateFlatFiles(files, localPods)
+	newFile, ok := migrated["capture-web-0.pcap"]
+	if !ok || len(migrated) != 1 {
+		t.Fatalf("migrated = %v", migrated)
+	}
+	for _, path := range []string{newFile + "0", newFile + "1", filepath.Join(dir, "capture-db.pcap0")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s: %v", path, err)
+		}
+	}
+	if f, ok := c.parseCaptureFile(newFile + "0"); !ok || f.legacy || f.fields.UID != string(pod.UID) {
+		t.Errorf("migrated file parsed as %+v, %v", f, ok)
+	}
+	md, err := readSessionMetadata(filepath.Dir(newFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Namespace != "team-a" || md.Pod != "web-0" || len(md.Files) != 2 || md.StopTime == nil {
+		t.Errorf("migrated session metadata = %+v", md)
+	}
+}
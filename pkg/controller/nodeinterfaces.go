@@ -0,0 +1,321 @@
+package controller
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/packet"
+)
+
+// Node-level interfaces a capture can add with NodeInterfacesAnnotationKey.
+const (
+	// NodeInterfaceGateway is the node's gateway to its Pods, antrea-gw0 by
+	// default.
+	NodeInterfaceGateway = "gateway"
+	// NodeInterfaceTunnel is the encapsulated traffic to Pods on other
+	// nodes, captured on the node's uplink by default.
+	NodeInterfaceTunnel = "tunnel"
+)
+
+// Default node interface names. The gateway is the one Antrea creates. The
+// tunnel has no default name: antrea-tun0 is an OVS port, and on the kernel
+// datapath its netdev, genev_sys_6081 or vxlan_sys_4789, shows tcpdump the
+// packets already decapsulated. The encapsulated packets are on the uplink,
+// the interface of the host's default route.
+const (
+	DefaultGatewayInterface = "antrea-gw0"
+	DefaultTunnelInterface  = ""
+)
+
+// nodeCaptureWaitDelay bounds how long a node interface capture may take to
+// flush its last file once the Pod's capture ends.
+const nodeCaptureWaitDelay = 5 * time.Second
+
+// parseNodeInterfaces parses a comma-separated list of node interfaces and
+// returns it deduplicated in canonical order.
+func parseNodeInterfaces(value string) (string, error) {
+	var roles []string
+	for _, role := range strings.Split(value, ",") {
+		role = strings.TrimSpace(role)
+		if role != NodeInterfaceGateway && role != NodeInterfaceTunnel {
+			return "", fmt.Errorf("invalid node interface %q: want %s or %s", role, NodeInterfaceGateway, NodeInterfaceTunnel)
+		}
+		if !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	// gateway sorts before tunnel
+	slices.Sort(roles)
+	return strings.Join(roles, ","), nil
+}
+
+// SetNodeInterfaces names the node's gateway and tunnel interfaces, the
+// defaults if not called. An empty tunnel is the uplink. It must be called
+// before Run.
+func (c *Controller) SetNodeInterfaces(gateway, tunnel string) {
+	c.processManager.mu.Lock()
+	defer c.processManager.mu.Unlock()
+	c.processManager.gatewayInterface = gateway
+	c.processManager.tunnelInterface = tunnel
+}
+
+// SetPodIPLookup registers how the IPs of the Pod key are found, for node
+// interface captures.
+func (pm *ProcessManager) SetPodIPLookup(podIPs func(key string) []string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.podIPs = podIPs
+}
+
+// nodeInterfaceCapture is a capture of a node-level interface filtered to
+// one Pod.
+type nodeInterfaceCapture struct {
+	role   string
+	iface  string
+	filter string
+}
+
+// nodeInterfaceCaptures returns the node interface captures of cfg for a Pod
+// with podIPs. A gateway capture also applies the capture filter. A tunnel
+// capture does not, as tcpdump would apply it to the outer headers.
+// Caller holds pm.mu.
+func (pm *ProcessManager) nodeInterfaceCaptures(cfg *CaptureConfig, podIPs []string) ([]nodeInterfaceCapture, error) {
+	if cfg.NodeInterfaces == "" {
+		return nil, nil
+	}
+	var addrs []netip.Addr
+	for _, ip := range podIPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Pod IP %q: %w", ip, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("node interface captures need the Pod's IPs, which are not known yet")
+	}
+
+	var captures []nodeInterfaceCapture
+	for _, role := range strings.Split(cfg.NodeInterfaces, ",") {
+		switch role {
+		case NodeInterfaceGateway:
+			captures = append(captures, nodeInterfaceCapture{role: role, iface: pm.gatewayInterface,
+				filter: joinFilters(hostFilter(addrs), cfg.Filter)})
+		case NodeInterfaceTunnel:
+			iface := pm.tunnelInterface
+			if iface == "" {
+				var err error
+				if iface, err = uplinkInterface(); err != nil {
+					return nil, err
+				}
+			}
+			captures = append(captures, nodeInterfaceCapture{role: role, iface: iface,
+				filter: tunnelFilter(addrs)})
+		}
+	}
+	return captures, nil
+}
+
+// outputFile returns where the capture writes in the session directory of
+// the Pod's capture, which writes podOutputFile.
+func (n nodeInterfaceCapture) outputFile(podOutputFile string) string {
+	return filepath.Join(filepath.Dir(podOutputFile), n.iface+".pcap")
+}
+
+// hostFilter matches packets to or from any of addrs.
+func hostFilter(addrs []netip.Addr) string {
+	terms := make([]string, len(addrs))
+	for i, addr := range addrs {
+		terms[i] = "host " + addr.String()
+	}
+	return strings.Join(terms, " or ")
+}
+
+// tunnelFilter matches the packets of a Pod with addrs between nodes: those
+// encapsulated in VXLAN or Geneve with the Pod's addresses in the inner IP
+// header. The geneve primitive moves the offsets of everything after it to
+// the inner packet, so it comes last.
+func tunnelFilter(addrs []netip.Addr) string {
+	return fmt.Sprintf("(%s) or (geneve and (%s))", vxlanFilter(addrs), hostFilter(addrs))
+}
+
+// uplinkInterface returns the interface of the host's default route, IPv4 or
+// else IPv6, from the routing tables of the host's PID 1.
+func uplinkInterface() (string, error) {
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+	if iface := defaultRoute(filepath.Join(procRoot, "1", "net", "route"), func(fields []string) string {
+		if len(fields) > 7 && fields[1] == "00000000" && fields[7] == "00000000" {
+			return fields[0]
+		}
+		return ""
+	}); iface != "" {
+		return iface, nil
+	}
+	// Destination PrefixLen Source SourcePrefixLen NextHop Metric RefCnt Use Flags Iface
+	if iface := defaultRoute(filepath.Join(procRoot, "1", "net", "ipv6_route"), func(fields []string) string {
+		if len(fields) == 10 && fields[1] == "00" && strings.Trim(fields[0], "0") == "" && fields[9] != "lo" {
+			return fields[9]
+		}
+		return ""
+	}); iface != "" {
+		return iface, nil
+	}
+	return "", fmt.Errorf("the host has no default route to capture the tunnel on; set --tunnel-interface")
+}
+
+// defaultRoute returns the interface that defaultIface finds in the first
+// line of the routing table at path it matches, or empty.
+func defaultRoute(path string, defaultIface func(fields []string) string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if iface := defaultIface(strings.Fields(scanner.Text())); iface != "" {
+			return iface
+		}
+	}
+	return ""
+}
+
+// vxlanFilter matches VXLAN packets whose inner IP header has one of addrs as
+// source or destination. libpcap has no VXLAN primitive everywhere, so the
+// inner headers are read at fixed offsets from the UDP header: 8 bytes of
+// UDP, 8 of VXLAN and 14 of inner Ethernet.
+func vxlanFilter(addrs []netip.Addr) string {
+	const (
+		innerEtherType = 8 + 8 + 12
+		innerIP        = 8 + 8 + 14
+	)
+	var terms []string
+	for _, addr := range addrs {
+		b := addr.AsSlice()
+		var etherType string
+		srcOffset, dstOffset := innerIP+12, innerIP+16
+		if addr.Is4() {
+			etherType = "0x0800"
+		} else {
+			etherType = "0x86dd"
+			srcOffset, dstOffset = innerIP+8, innerIP+24
+		}
+		var src, dst []string
+		for i := 0; i < len(b); i += 4 {
+			word := fmt.Sprintf("0x%02x%02x%02x%02x", b[i], b[i+1], b[i+2], b[i+3])
+			src = append(src, fmt.Sprintf("udp[%d:4] = %s", srcOffset+i, word))
+			dst = append(dst, fmt.Sprintf("udp[%d:4] = %s", dstOffset+i, word))
+		}
+		terms = append(terms, fmt.Sprintf("(udp[%d:2] = %s and ((%s) or (%s)))", innerEtherType, etherType,
+			strings.Join(src, " and "), strings.Join(dst, " and ")))
+	}
+	return fmt.Sprintf("udp dst port %d and (%s)", packet.PortVXLAN, strings.Join(terms, " or "))
+}
+
+// hostTarget captures iface in the host network namespace. Without
+// hostNetwork, that is the namespace of the host's PID 1, which hostPID
+// shows.
+func (pm *ProcessManager) hostTarget(iface string) captureTarget {
+	if pm.captureMode == CaptureModeVeth {
+		return captureTarget{iface: iface}
+	}
+	return captureTarget{netnsPID: 1, iface: iface}
+}
+
+// startNodeInterfaceCaptures starts a tcpdump for each node interface capture
+// of the Pod key. They rotate like the Pod's capture, into its session
+// directory, and are terminated with it; capture.nodeCaptures waits for them
+// to exit. Caller holds pm.mu.
+func (pm *ProcessManager) startNodeInterfaceCaptures(key, outputFile string, capture *CaptureProcess, cfg *CaptureConfig) error {
+	if cfg.NodeInterfaces == "" {
+		return nil
+	}
+	var podIPs []string
+	if pm.podIPs != nil {
+		podIPs = pm.podIPs(key)
+	}
+	captures, err := pm.nodeInterfaceCaptures(cfg, podIPs)
+	if err != nil {
+		return err
+	}
+	for _, n := range captures {
+		if err := pm.startNodeInterfaceCapture(capture, key, outputFile, n, cfg.MaxFiles); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pm *ProcessManager) startNodeInterfaceCapture(capture *CaptureProcess, key, podOutputFile string, n nodeInterfaceCapture, maxFiles int) error {
+	ctx := capture.ctx
+	cmd := pm.hostTarget(n.iface).command(ctx,
+		"-C", "1",
+		"-W", fmt.Sprintf("%d", maxFiles),
+		"-w", n.outputFile(podOutputFile),
+		"-Z", "root",
+		"--", n.filter)
+	markCapture(cmd, pm.captureDir)
+	// Let tcpdump flush its last file when the Pod's capture ends
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = nodeCaptureWaitDelay
+	stderr, _ := cmd.StderrPipe()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start tcpdump on %s: %w", n.iface, err)
+	}
+	klog.InfoS("Node interface capture started", "pod", key, "interface", n.iface, "role", n.role, "pid", cmd.Process.Pid)
+
+	capture.nodeCaptures.Add(1)
+	go func() {
+		defer capture.nodeCaptures.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			klog.InfoS("tcpdump stderr", "pod", key, "interface", n.iface, "msg", scanner.Text())
+		}
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			klog.ErrorS(err, "Node interface capture exited", "pod", key, "interface", n.iface)
+		}
+	}()
+	return nil
+}
+
+// sessionInterfaces describes the node interface captures of cfg for the
+// session manifest of a Pod with podIPs.
+func (pm *ProcessManager) sessionInterfaces(cfg *CaptureConfig, podIPs []string) []SessionInterface {
+	pm.mu.Lock()
+	captures, err := pm.nodeInterfaceCaptures(cfg, podIPs)
+	pm.mu.Unlock()
+	if err != nil {
+		return nil
+	}
+	interfaces := make([]SessionInterface, len(captures))
+	for i, n := range captures {
+		interfaces[i] = SessionInterface{Name: n.iface, Role: n.role, Filter: n.filter}
+	}
+	return interfaces
+}
+
+// podIPs returns the IPs of the Pod key, as its status lists them.
+func (c *Controller) podIPs(key string) []string {
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	pod, err := c.podLister.Pods(namespace).Get(name)
+	if err != nil {
+		return nil
+	}
+	ips := make([]string, 0, len(pod.Status.PodIPs))
+	for _, ip := range pod.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	return ips
+}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeRoutes fakes the routing tables of the host's PID 1 under procRoot.
+func writeRoutes(t *testing.T, ipv4, ipv6 string) {
+	t.Helper()
+	dir := filepath.Join(procRoot, "1", "net")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	header := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+	if err := os.WriteFile(filepath.Join(dir, "route"), []byte(header+ipv4), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ipv6_route"), []byte(ipv6), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeInterfaceCaptures(t *testing.T) {
+	originalProcRoot := procRoot
+	defer func() { procRoot = originalProcRoot }()
+	procRoot = t.TempDir()
+	writeRoutes(t, "eth0\t0012A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n"+
+		"eth0\t00000000\t0112A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n", "")
+
+	pm := NewProcessManager(1, t.TempDir(), "")
+	cfg := &CaptureConfig{MaxFiles: 1, Filter: "tcp port 80", NodeInterfaces: "gateway,tunnel"}
+
+	if _, err := pm.nodeInterfaceCaptures(cfg, nil); err == nil {
+		t.Error("nodeInterfaceCaptures without Pod IPs succeeded")
+	}
+
+	captures, err := pm.nodeInterfaceCaptures(cfg, []string{"10.244.1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []nodeInterfaceCapture{
+		{role: NodeInterfaceGateway, iface: DefaultGatewayInterface, filter: "(host 10.244.1.5) and (tcp port 80)"},
+		{role: NodeInterfaceTunnel, iface: "eth0", filter: "(udp dst port 4789 and ((udp[28:2] = 0x0800 and ((udp[42:4] = 0x0af40105) or (udp[46:4] = 0x0af40105))))) or " +
+			"(geneve and (host 10.244.1.5))"},
+	}
+	if len(captures) != len(want) {
+		t.Fatalf("captures = %+v", captures)
+	}
+	for i := range want {
+		if captures[i] != want[i] {
+			t.Errorf("capture %d = %+v, want %+v", i, captures[i], want[i])
+		}
+	}
+}
+
+func TestUplinkInterface(t *testing.T) {
+	originalProcRoot := procRoot
+	defer func() { procRoot = originalProcRoot }()
+	procRoot = t.TempDir()
+
+	// An IPv6-only node, whose table also has the loopback's unreachable route
+	writeRoutes(t, "", "00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo\n"+
+		"00000000000000000000000000000000 00 00000000000000000000000000000000 00 fd000000000000000000000000000001 00000400 00000001 00000000 00000003     ens5\n")
+	if iface, err := uplinkInterface(); err != nil || iface != "ens5" {
+		t.Errorf("uplinkInterface = %q, %v, want ens5", iface, err)
+	}
+
+	writeRoutes(t, "", "")
+	if _, err := uplinkInterface(); err == nil {
+		t.Error("uplinkInterface without a default route succeeded")
+	}
+}
+
+func TestVXLANFilterIPv6(t *testing.T) {
+	got := vxlanFilter([]netip.Addr{netip.MustParseAddr("fd00:10:244::5")})
+	want := "udp dst port 4789 and ((udp[28:2] = 0x86dd and (" +
+		"(udp[38:4] = 0xfd000010 and udp[42:4] = 0x02440000 and udp[46:4] = 0x00000000 and udp[50:4] = 0x00000005) or " +
+		"(udp[54:4] = 0xfd000010 and udp[58:4] = 0x02440000 and udp[62:4] = 0x00000000 and udp[66:4] = 0x00000005))))"
+	if got != want {
+		t.Errorf("vxlanFilter = %s\nwant %s", got, want)
+	}
+}
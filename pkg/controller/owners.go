@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"maps"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
+	batchinformers "k8s.io/client-go/informers/batch/v1"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// OwnerInformers watch the workloads whose capture annotations their Pods
+// inherit.
+type OwnerInformers struct {
+	ReplicaSets  appsinformers.ReplicaSetInformer
+	Deployments  appsinformers.DeploymentInformer
+	StatefulSets appsinformers.StatefulSetInformer
+	DaemonSets   appsinformers.DaemonSetInformer
+	Jobs         batchinformers.JobInformer
+}
+
+// ownerListers resolve a Pod's owners.
+type ownerListers struct {
+	replicaSets  appslisters.ReplicaSetLister
+	deployments  appslisters.DeploymentLister
+	statefulSets appslisters.StatefulSetLister
+	daemonSets   appslisters.DaemonSetLister
+	jobs         batchlisters.JobLister
+}
+
+// CaptureRequestAnnotations returns the capture annotations a user sets,
+// leaving out the status written by the controller.
+func CaptureRequestAnnotations(annotations map[string]string) map[string]string {
+	request := map[string]string{}
+	for key, value := range annotations {
+		if (key == AnnotationKey || strings.HasPrefix(key, annotationPrefix)) && key != StatusAnnotationKey {
+			request[key] = value
+		}
+	}
+	return request
+}
+
+// SetOwnerInformers lets Pods inherit the capture annotations of their
+// Deployment, StatefulSet, DaemonSet, Job or bare ReplicaSet. It must be
+// called before Run.
+func (c *Controller) SetOwnerInformers(informers OwnerInformers) {
+	c.owners = &ownerListers{
+		replicaSets:  informers.ReplicaSets.Lister(),
+		deployments:  informers.Deployments.Lister(),
+		statefulSets: informers.StatefulSets.Lister(),
+		daemonSets:   informers.DaemonSets.Lister(),
+		jobs:         informers.Jobs.Lister(),
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.addOwner,
+		UpdateFunc: c.updateOwner,
+		DeleteFunc: c.deleteOwner,
+	}
+	for _, informer := range []cache.SharedIndexInformer{
+		informers.ReplicaSets.Informer(),
+		informers.Deployments.Informer(),
+		informers.StatefulSets.Informer(),
+		informers.DaemonSets.Informer(),
+		informers.Jobs.Informer(),
+	} {
+		informer.AddEventHandler(handler)
+		c.ownersSynced = append(c.ownersSynced, informer.HasSynced)
+	}
+}
+
+func (c *Controller) addOwner(obj interface{}) {
+	if owner, ok := obj.(metav1.Object); ok && owner.GetAnnotations()[AnnotationKey] != "" {
+		c.enqueueOwnedPods(owner)
+	}
+}
+
+// updateOwner resyncs the Pods of a workload whose capture annotations
+// changed, including their removal, which stops the captures.
+func (c *Controller) updateOwner(oldObj, newObj interface{}) {
+	oldOwner, ok1 := oldObj.(metav1.Object)
+	newOwner, ok2 := newObj.(metav1.Object)
+	if !ok1 || !ok2 {
+		return
+	}
+	if maps.Equal(CaptureRequestAnnotations(oldOwner.GetAnnotations()), CaptureRequestAnnotations(newOwner.GetAnnotations())) {
+		return
+	}
+	c.enqueueOwnedPods(newOwner)
+}
+
+func (c *Controller) deleteOwner(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	c.addOwner(obj)
+}
+
+// enqueueOwnedPods resyncs the local Pods that owner controls, directly or
+// through a ReplicaSet.
+func (c *Controller) enqueueOwnedPods(owner metav1.Object) {
+	pods, err := c.podLister.Pods(owner.GetNamespace()).List(labels.Everything())
+	if err != nil {
+		klog.ErrorS(err, "Failed to list Pods", "namespace", owner.GetNamespace())
+		return
+	}
+	for _, pod := range pods {
+		if pod.Spec.NodeName == c.nodeName && c.ownedBy(pod, owner.GetUID()) {
+			c.enqueuePod(pod)
+		}
+	}
+}
+
+// ownedBy reports whether uid is the Pod's controller or its ReplicaSet's.
+func (c *Controller) ownedBy(pod *corev1.Pod, uid types.UID) bool {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return false
+	}
+	if ref.UID == uid {
+		return true
+	}
+	if ref.Kind != "ReplicaSet" || c.owners == nil {
+		return false
+	}
+	rs, err := c.owners.replicaSets.ReplicaSets(pod.Namespace).Get(ref.Name)
+	if err != nil || rs.UID != ref.UID {
+		return false
+	}
+	rsRef := metav1.GetControllerOf(rs)
+	return rsRef != nil && rsRef.UID == uid
+}
+
+// ownerCaptureAnnotations returns the capture annotations of the workload
+// controlling pod, and the workload as Kind/name. A ReplicaSet controlled by
+// a Deployment is skipped: the Deployment copies its annotations to new
+// ReplicaSets but leaves stale ones on old ReplicaSets.
+func (c *Controller) ownerCaptureAnnotations(pod *corev1.Pod) (map[string]string, string) {
+	if c.owners == nil {
+		return nil, ""
+	}
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return nil, ""
+	}
+
+	var owner metav1.Object
+	var err error
+	switch ref.Kind {
+	case "ReplicaSet":
+		owner, err = c.owners.replicaSets.ReplicaSets(pod.Namespace).Get(ref.Name)
+		if err == nil && owner.GetUID() == ref.UID {
+			if rsRef := metav1.GetControllerOf(owner); rsRef != nil && rsRef.Kind == "Deployment" {
+				ref = rsRef
+				owner, err = c.owners.deployments.Deployments(pod.Namespace).Get(ref.Name)
+			}
+		}
+	case "StatefulSet":
+		owner, err = c.owners.statefulSets.StatefulSets(pod.Namespace).Get(ref.Name)
+	case "DaemonSet":
+		owner, err = c.owners.daemonSets.DaemonSets(pod.Namespace).Get(ref.Name)
+	case "Job":
+		owner, err = c.owners.jobs.Jobs(pod.Namespace).Get(ref.Name)
+	default:
+		return nil, ""
+	}
+	if err != nil || owner.GetUID() != ref.UID {
+		return nil, ""
+	}
+	return CaptureRequestAnnotations(owner.GetAnnotations()), ref.Kind + "/" + ref.Name
+}
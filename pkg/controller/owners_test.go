@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestOwnerAnnotations(t *testing.T) {
+	controllerRef := func(kind, name string, uid types.UID) []metav1.OwnerReference {
+		isController := true
+		return []metav1.OwnerReference{{Kind: kind, Name: name, UID: uid, Controller: &isController}}
+	}
+
+	deployments := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	deployments.Add(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "shop", Name: "web", UID: "d1",
+		Annotations: map[string]string{AnnotationKey: "4", FilterAnnotationKey: "tcp"},
+	}})
+	replicaSets := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	replicaSets.Add(&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "shop", Name: "web-abc", UID: "r1",
+		OwnerReferences: controllerRef("Deployment", "web", "d1"),
+		// Stale copy left on an old ReplicaSet; the Deployment wins
+		Annotations: map[string]string{AnnotationKey: "9"},
+	}})
+
+	pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	pod := func(name string, annotations map[string]string, owners []metav1.OwnerReference) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: name, Annotations: annotations, OwnerReferences: owners},
+			Spec:       corev1.PodSpec{NodeName: "node-1"},
+		}
+		pods.Add(p)
+		return p
+	}
+	inherited := pod("web-abc-1", nil, controllerRef("ReplicaSet", "web-abc", "r1"))
+	override := pod("web-abc-2", map[string]string{FilterAnnotationKey: "udp"}, controllerRef("ReplicaSet", "web-abc", "r1"))
+	own := pod("web-abc-3", map[string]string{AnnotationKey: "1"}, controllerRef("ReplicaSet", "web-abc", "r1"))
+	orphan := pod("other", nil, controllerRef("ReplicaSet", "gone", "r2"))
+
+	c := &Controller{
+		podLister: corelisters.NewPodLister(pods),
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		nodeName:  "node-1",
+		owners: &ownerListers{
+			replicaSets: appslisters.NewReplicaSetLister(replicaSets),
+			deployments: appslisters.NewDeploymentLister(deployments),
+		},
+	}
+	defer c.queue.ShutDown()
+
+	for _, tc := range []struct {
+		pod      *corev1.Pod
+		owner    string
+		maxFiles int
+		filter   string
+	}{
+		{inherited, "Deployment/web", 4, "tcp"},
+		{override, "Deployment/web", 4, "udp"},
+		{own, "", 1, ""},
+		{orphan, "", 0, ""},
+	} {
+		cfg, source, err := c.podCaptureConfig(tc.pod)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.pod.Name, err)
+		}
+		var maxFiles int
+		var filter string
+		if cfg != nil {
+			maxFiles, filter = cfg.MaxFiles, cfg.Filter
+		}
+		if source.owner != tc.owner || maxFiles != tc.maxFiles || filter != tc.filter {
+			t.Errorf("%s: got owner %q files %d filter %q, want %q %d %q", tc.pod.Name, source.owner, maxFiles, filter, tc.owner, tc.maxFiles, tc.filter)
+		}
+	}
+
+	// Removing the Deployment's annotation resyncs every Pod it owns.
+	deployment, _ := c.owners.deployments.Deployments("shop").Get("web")
+	updated := deployment.DeepCopy()
+	updated.Annotations = nil
+	c.updateOwner(deployment, updated)
+	if c.queue.Len() != 3 {
+		t.Errorf("expected the Deployment's 3 Pods to be resynced, queue has %d", c.queue.Len())
+	}
+}
@@ -0,0 +1,523 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// PacketCaptureGVR is the resource of Antrea's PacketCapture, which the
+// controller can reconcile like capture annotations.
+var PacketCaptureGVR = schema.GroupVersionResource{Group: "crd.antrea.io", Version: "v1alpha1", Resource: "packetcaptures"}
+
+// packetCapturePodIndex indexes PacketCaptures by the Pods at either end.
+const packetCapturePodIndex = "packetCapturePod"
+
+// PacketCapture defaults, those of Antrea.
+const (
+	DefaultPacketCaptureTimeout = 60 * time.Second
+	// packetCaptureMaxFiles is how many 1MB files a PacketCapture rotates
+	// through before its packet count is reached.
+	packetCaptureMaxFiles = 10
+)
+
+// Directions of a PacketCapture.
+const (
+	PacketCaptureSourceToDestination = "SourceToDestination"
+	PacketCaptureDestinationToSource = "DestinationToSource"
+	PacketCaptureBoth                = "Both"
+)
+
+// Condition types of the status of a PacketCapture, as Antrea writes them.
+const (
+	PacketCaptureStarted  = "PacketCaptureStarted"
+	PacketCaptureComplete = "PacketCaptureComplete"
+)
+
+// packetCaptureSpec is the part of a PacketCapture spec the controller
+// understands. fileServer is ignored: files stay on the node like those of
+// other captures.
+type packetCaptureSpec struct {
+	Timeout       int32                 `json:"timeout,omitempty"`
+	CaptureConfig packetCaptureConfig   `json:"captureConfig"`
+	Source        packetCaptureEndpoint `json:"source"`
+	Destination   packetCaptureEndpoint `json:"destination"`
+	Packet        *packetCapturePacket  `json:"packet,omitempty"`
+	Direction     string                `json:"direction,omitempty"`
+}
+
+type packetCaptureConfig struct {
+	FirstN *struct {
+		Number int32 `json:"number"`
+	} `json:"firstN,omitempty"`
+}
+
+// packetCaptureEndpoint is a Pod or an IP.
+type packetCaptureEndpoint struct {
+	Pod *struct {
+		Namespace string `json:"namespace,omitempty"`
+		Name      string `json:"name"`
+	} `json:"pod,omitempty"`
+	IP string `json:"ip,omitempty"`
+}
+
+type packetCapturePacket struct {
+	IPFamily        string              `json:"ipFamily,omitempty"`
+	Protocol        *intstr.IntOrString `json:"protocol,omitempty"`
+	TransportHeader struct {
+		TCP *packetCaptureTCP `json:"tcp,omitempty"`
+		UDP *packetCaptureUDP `json:"udp,omitempty"`
+	} `json:"transportHeader"`
+}
+
+type packetCaptureTCP struct {
+	SrcPort int32 `json:"srcPort,omitempty"`
+	DstPort int32 `json:"dstPort,omitempty"`
+	// Flags match if any of them does, a packet matching one when its
+	// flags under Mask, Value if unset, equal Value.
+	Flags []struct {
+		Value int32  `json:"value"`
+		Mask  *int32 `json:"mask,omitempty"`
+	} `json:"flags,omitempty"`
+}
+
+type packetCaptureUDP struct {
+	SrcPort int32 `json:"srcPort,omitempty"`
+	DstPort int32 `json:"dstPort,omitempty"`
+}
+
+// packetCaptureStatus is the part of a PacketCapture status the controller
+// writes.
+type packetCaptureStatus struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	FilePath   string             `json:"filePath,omitempty"`
+}
+
+// podKey returns the key of the Pod of the endpoint, or "" for an IP.
+func (e *packetCaptureEndpoint) podKey() string {
+	if e.Pod == nil {
+		return ""
+	}
+	namespace := e.Pod.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	return namespace + "/" + e.Pod.Name
+}
+
+// target returns the key of the Pod whose node captures: the source Pod, or
+// the destination Pod when the source is an IP.
+func (spec *packetCaptureSpec) target() string {
+	if key := spec.Source.podKey(); key != "" {
+		return key
+	}
+	return spec.Destination.podKey()
+}
+
+// parsePacketCaptureSpec decodes the spec of a PacketCapture object.
+func parsePacketCaptureSpec(pc *unstructured.Unstructured) (*packetCaptureSpec, error) {
+	spec := &packetCaptureSpec{}
+	raw, _, _ := unstructured.NestedMap(pc.Object, "spec")
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, spec); err != nil {
+		return nil, fmt.Errorf("invalid PacketCapture %s: %w", pc.GetName(), err)
+	}
+	return spec, nil
+}
+
+// indexPacketCapturePods is the packetCapturePodIndex function.
+func indexPacketCapturePods(obj interface{}) ([]string, error) {
+	pc, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, nil
+	}
+	spec, err := parsePacketCaptureSpec(pc)
+	if err != nil {
+		return nil, nil
+	}
+	var keys []string
+	for _, key := range []string{spec.Source.podKey(), spec.Destination.podKey()} {
+		if key != "" && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// SetPacketCaptures reconciles the Antrea PacketCaptures of informer, a
+// cluster-wide informer for PacketCaptureGVR, and writes their status with
+// client. It must be called before Run.
+func (c *Controller) SetPacketCaptures(client dynamic.Interface, informer cache.SharedIndexInformer) {
+	if err := informer.AddIndexers(cache.Indexers{packetCapturePodIndex: indexPacketCapturePods}); err != nil {
+		klog.ErrorS(err, "Failed to index PacketCaptures by Pod")
+	}
+	c.dynamicClient = client
+	c.packetCaptures = informer.GetIndexer()
+	c.packetCapturesSynced = informer.HasSynced
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueuePacketCapture,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			c.enqueuePacketCapture(oldObj)
+			c.enqueuePacketCapture(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			c.enqueuePacketCapture(obj)
+		},
+	})
+}
+
+// enqueuePacketCapture queues the Pod a PacketCapture captures on, if it is
+// local.
+func (c *Controller) enqueuePacketCapture(obj interface{}) {
+	pc, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	spec, err := parsePacketCaptureSpec(pc)
+	if err != nil {
+		klog.ErrorS(err, "Ignoring PacketCapture")
+		return
+	}
+	c.enqueueLocalPod(spec.target())
+}
+
+// enqueuePacketCapturePeers queues the local Pods that PacketCaptures with
+// pod at either end capture on, as they filter on its IPs.
+func (c *Controller) enqueuePacketCapturePeers(pod *corev1.Pod) {
+	if c.packetCaptures == nil {
+		return
+	}
+	objs, err := c.packetCaptures.ByIndex(packetCapturePodIndex, podKey(pod))
+	if err != nil {
+		klog.ErrorS(err, "Failed to look up PacketCaptures", "pod", podKey(pod))
+		return
+	}
+	for _, obj := range objs {
+		c.enqueuePacketCapture(obj)
+	}
+}
+
+// enqueueLocalPod queues the Pod key if it runs on this node.
+func (c *Controller) enqueueLocalPod(key string) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil || name == "" {
+		return
+	}
+	if pod, err := c.podLister.Pods(namespace).Get(name); err == nil && pod.Spec.NodeName == c.nodeName {
+		c.queue.Add(key)
+	}
+}
+
+// packetCaptureConfig returns the capture that a PacketCapture requests on
+// pod, and its name. It returns nil if none does. When several do, the first
+// by name wins.
+func (c *Controller) packetCaptureConfig(pod *corev1.Pod) (*CaptureConfig, string, error) {
+	if c.packetCaptures == nil {
+		return nil, "", nil
+	}
+	key := podKey(pod)
+	objs, err := c.packetCaptures.ByIndex(packetCapturePodIndex, key)
+	if err != nil {
+		return nil, "", err
+	}
+	specs := make(map[string]*packetCaptureSpec)
+	for _, obj := range objs {
+		pc := obj.(*unstructured.Unstructured)
+		if spec, err := parsePacketCaptureSpec(pc); err == nil && spec.target() == key {
+			specs[pc.GetName()] = spec
+		}
+	}
+	if len(specs) == 0 {
+		return nil, "", nil
+	}
+	names := slices.Sorted(maps.Keys(specs))
+	if len(names) > 1 {
+		klog.V(2).InfoS("Several PacketCaptures capture this Pod, using the first", "pod", key, "packetCapture", names[0])
+	}
+	cfg, err := c.resolvePacketCapture(specs[names[0]])
+	if err != nil {
+		err = fmt.Errorf("PacketCapture %s: %w", names[0], err)
+	}
+	return cfg, names[0], err
+}
+
+// resolvePacketCapture maps a PacketCapture spec onto a capture that stops
+// after its packet count or its timeout, with a filter for its endpoints,
+// direction and packet.
+func (c *Controller) resolvePacketCapture(spec *packetCaptureSpec) (*CaptureConfig, error) {
+	if spec.CaptureConfig.FirstN == nil || spec.CaptureConfig.FirstN.Number <= 0 {
+		return nil, fmt.Errorf("captureConfig.firstN.number must be > 0")
+	}
+	family := "IPv4"
+	if spec.Packet != nil && spec.Packet.IPFamily != "" {
+		family = spec.Packet.IPFamily
+	}
+	if family != "IPv4" && family != "IPv6" {
+		return nil, fmt.Errorf("invalid ipFamily %q: want IPv4 or IPv6", family)
+	}
+	source, err := c.packetCaptureAddrs(&spec.Source, family)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+	destination, err := c.packetCaptureAddrs(&spec.Destination, family)
+	if err != nil {
+		return nil, fmt.Errorf("destination: %w", err)
+	}
+	filter, err := packetCaptureFilter(spec, family, source, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &CaptureConfig{
+		MaxFiles:    packetCaptureMaxFiles,
+		Filter:      filter,
+		Duration:    DefaultPacketCaptureTimeout,
+		PacketCount: int(spec.CaptureConfig.FirstN.Number),
+	}
+	if spec.Timeout > 0 {
+		cfg.Duration = time.Duration(spec.Timeout) * time.Second
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// packetCaptureAddrs returns the addresses of family of an endpoint, or none
+// if it is unset.
+func (c *Controller) packetCaptureAddrs(e *packetCaptureEndpoint, family string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	switch {
+	case e.Pod != nil && e.IP != "":
+		return nil, fmt.Errorf("set either a Pod or an IP")
+	case e.Pod != nil:
+		key := e.podKey()
+		namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+		pod, err := c.podLister.Pods(namespace).Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("pod %s: %w", key, err)
+		}
+		if addrs, err = podAddrs(pod); err != nil {
+			return nil, err
+		}
+	case e.IP != "":
+		addr, err := netip.ParseAddr(e.IP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q: %w", e.IP, err)
+		}
+		addrs = []netip.Addr{addr}
+	default:
+		return nil, nil
+	}
+	addrs = slices.DeleteFunc(addrs, func(addr netip.Addr) bool { return addr.Is4() != (family == "IPv4") })
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no %s address", family)
+	}
+	return addrs, nil
+}
+
+// packetCaptureFilter builds the tcpdump filter of a PacketCapture between
+// source and destination, either of which may be empty.
+func packetCaptureFilter(spec *packetCaptureSpec, family string, source, destination []netip.Addr) (string, error) {
+	proto, err := packetCaptureProtocol(spec.Packet, family)
+	if err != nil {
+		return "", err
+	}
+	var (
+		srcPort, dstPort int32
+		flags            string
+	)
+	if p := spec.Packet; p != nil {
+		tcp, udp := p.TransportHeader.TCP, p.TransportHeader.UDP
+		switch {
+		case tcp != nil && udp != nil:
+			return "", fmt.Errorf("set either a TCP or a UDP header")
+		case tcp != nil && proto != "tcp", udp != nil && proto != "udp":
+			return "", fmt.Errorf("transport header does not match protocol %q", proto)
+		case tcp != nil:
+			srcPort, dstPort = tcp.SrcPort, tcp.DstPort
+			var terms []string
+			for _, f := range tcp.Flags {
+				mask := f.Value
+				if f.Mask != nil {
+					mask = *f.Mask
+				}
+				terms = append(terms, fmt.Sprintf("tcp[tcpflags] & %#x = %#x", mask, f.Value))
+			}
+			flags = strings.Join(terms, " or ")
+		case udp != nil:
+			srcPort, dstPort = udp.SrcPort, udp.DstPort
+		}
+	}
+
+	// Ports and flags belong to the packets from source to destination
+	oneWay := func(from, to []netip.Addr, fromPort, toPort int32) string {
+		return joinFilters(directionFilter("src", from), directionFilter("dst", to), proto,
+			portFilter("src", fromPort), portFilter("dst", toPort), flags)
+	}
+	var filter string
+	switch spec.Direction {
+	case "", PacketCaptureSourceToDestination:
+		filter = oneWay(source, destination, srcPort, dstPort)
+	case PacketCaptureDestinationToSource:
+		filter = oneWay(destination, source, dstPort, srcPort)
+	case PacketCaptureBoth:
+		filter = fmt.Sprintf("(%s) or (%s)", oneWay(source, destination, srcPort, dstPort),
+			oneWay(destination, source, dstPort, srcPort))
+	default:
+		return "", fmt.Errorf("invalid direction %q", spec.Direction)
+	}
+	family = map[string]string{"IPv4": "ip", "IPv6": "ip6"}[family]
+	return joinFilters(family, filter), nil
+}
+
+// packetCaptureProtocol returns the filter primitive of the protocol of a
+// PacketCapture packet, a name or a number, or "" for any protocol.
+func packetCaptureProtocol(p *packetCapturePacket, family string) (string, error) {
+	if p == nil || p.Protocol == nil {
+		return "", nil
+	}
+	names := map[int]string{1: "icmp", 6: "tcp", 17: "udp", 58: "icmp6", 132: "sctp"}
+	var name string
+	if p.Protocol.Type == intstr.Int {
+		number := p.Protocol.IntValue()
+		if number < 0 || number > 255 {
+			return "", fmt.Errorf("invalid protocol number %d", number)
+		}
+		if name = names[number]; name == "" {
+			if family == "IPv6" {
+				return fmt.Sprintf("ip6 proto %d", number), nil
+			}
+			return fmt.Sprintf("ip proto %d", number), nil
+		}
+	} else {
+		name = strings.ToLower(p.Protocol.StrVal)
+		switch name {
+		case "icmp", "tcp", "udp", "icmp6", "sctp":
+		default:
+			return "", fmt.Errorf("unknown protocol %q", p.Protocol.StrVal)
+		}
+	}
+	if name == "icmp" && family == "IPv6" {
+		name = "icmp6"
+	}
+	return name, nil
+}
+
+// directionFilter matches packets with any of addrs as their dir, "src" or
+// "dst".
+func directionFilter(dir string, addrs []netip.Addr) string {
+	terms := make([]string, len(addrs))
+	for i, addr := range addrs {
+		terms[i] = dir + " host " + addr.String()
+	}
+	return strings.Join(terms, " or ")
+}
+
+// portFilter matches packets with port as their dir port, or all of them if
+// port is 0.
+func portFilter(dir string, port int32) string {
+	if port == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s port %d", dir, port)
+}
+
+// updatePacketCaptureStatus writes the capture status of a Pod into the status
+// of the PacketCapture name that requested it. It does nothing if the status
+// is unchanged, so the resulting update event settles without another write.
+func (c *Controller) updatePacketCaptureStatus(ctx context.Context, name string, status *CaptureStatus) error {
+	obj, exists, err := c.packetCaptures.GetByKey(name)
+	if err != nil || !exists {
+		return err
+	}
+	pc := obj.(*unstructured.Unstructured)
+	current, _, _ := unstructured.NestedMap(pc.Object, "status")
+
+	var pcStatus packetCaptureStatus
+	if current != nil {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(current, &pcStatus); err != nil {
+			klog.ErrorS(err, "Replacing invalid PacketCapture status", "packetCapture", name)
+			pcStatus = packetCaptureStatus{}
+		}
+	}
+	for _, cond := range packetCaptureConditions(status) {
+		meta.SetStatusCondition(&pcStatus.Conditions, cond)
+	}
+	pcStatus.FilePath = ""
+	if status.Files != "" {
+		pcStatus.FilePath = status.Node + ":" + status.Files
+	}
+	written, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pcStatus)
+	if err != nil {
+		return err
+	}
+
+	// Fields the controller does not write are kept
+	desired := maps.Clone(current)
+	if desired == nil {
+		desired = make(map[string]interface{})
+	}
+	delete(desired, "conditions")
+	delete(desired, "filePath")
+	maps.Copy(desired, written)
+	if equality.Semantic.DeepEqual(current, desired) {
+		return nil
+	}
+
+	pc = pc.DeepCopy()
+	pc.Object["status"] = desired
+	_, err = c.dynamicClient.Resource(PacketCaptureGVR).UpdateStatus(ctx, pc, metav1.UpdateOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("failed to update PacketCapture status: %w", err)
+	}
+	return nil
+}
+
+// conditionReason is the format the API requires of a condition's reason.
+var conditionReason = regexp.MustCompile(`^[A-Za-z]([A-Za-z0-9_,:]*[A-Za-z0-9_])?$`)
+
+// packetCaptureConditions maps the phase of a capture onto PacketCapture
+// conditions. A finished capture is complete with its stop reason's constant,
+// e.g. StopConditionMatched, as reason and the full stop reason as message;
+// one that failed or was refused is not.
+func packetCaptureConditions(status *CaptureStatus) []metav1.Condition {
+	started := metav1.Condition{Type: PacketCaptureStarted, Status: metav1.ConditionTrue, Reason: "Started"}
+	switch status.Phase {
+	case CaptureRunning:
+		return []metav1.Condition{started}
+	case CaptureCompleted:
+		reason, _, _ := strings.Cut(status.Message, ":")
+		if !conditionReason.MatchString(reason) {
+			reason = "Succeeded"
+		}
+		return []metav1.Condition{started, {Type: PacketCaptureComplete, Status: metav1.ConditionTrue,
+			Reason: reason, Message: status.Message}}
+	case CaptureFailed, CaptureRefused:
+		return []metav1.Condition{{Type: PacketCaptureComplete, Status: metav1.ConditionFalse,
+			Reason: string(status.Phase), Message: status.Message}}
+	default:
+		return []metav1.Condition{{Type: PacketCaptureStarted, Status: metav1.ConditionFalse,
+			Reason: string(status.Phase), Message: status.Message}}
+	}
+}
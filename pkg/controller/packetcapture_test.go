@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestPacketCapture(t *testing.T) {
+	client := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web-1"},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+		Status:     corev1.PodStatus{PodIPs: []corev1.PodIP{{IP: "10.244.1.5"}, {IP: "fd00:10:244:1::5"}}},
+	}
+	server := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "data", Name: "db-0"},
+		Spec:       corev1.PodSpec{NodeName: "node-2"},
+		Status:     corev1.PodStatus{PodIPs: []corev1.PodIP{{IP: "10.244.2.9"}}},
+	}
+	pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	pods.Add(client)
+	pods.Add(server)
+
+	pc := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "crd.antrea.io/v1alpha1",
+		"kind":       "PacketCapture",
+		"metadata":   map[string]interface{}{"name": "web-to-db"},
+		"spec": map[string]interface{}{
+			"timeout":       int64(30),
+			"captureConfig": map[string]interface{}{"firstN": map[string]interface{}{"number": int64(5)}},
+			"source":        map[string]interface{}{"pod": map[string]interface{}{"namespace": "shop", "name": "web-1"}},
+			"destination":   map[string]interface{}{"pod": map[string]interface{}{"namespace": "data", "name": "db-0"}},
+			"packet": map[string]interface{}{
+				"protocol":        "TCP",
+				"transportHeader": map[string]interface{}{"tcp": map[string]interface{}{"dstPort": int64(5432)}},
+			},
+		},
+	}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{PacketCaptureGVR: "PacketCaptureList"}, pc)
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+
+	c := &Controller{
+		client:    fake.NewSimpleClientset(client),
+		podLister: corelisters.NewPodLister(pods),
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		nodeName:  "node-1",
+	}
+	defer c.queue.ShutDown()
+	c.SetPacketCaptures(dynamicClient, factory.ForResource(PacketCaptureGVR).Informer())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.packetCapturesSynced) {
+		t.Fatal("PacketCapture informer did not sync")
+	}
+
+	cfg, source, err := c.podCaptureConfig(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &CaptureConfig{
+		MaxFiles:    packetCaptureMaxFiles,
+		Filter:      "(ip) and ((((src host 10.244.1.5) and (dst host 10.244.2.9)) and (tcp)) and (dst port 5432))",
+		Duration:    30 * time.Second,
+		PacketCount: 5,
+	}
+	if !cfg.Equal(want) || source.packetCapture != "web-to-db" {
+		t.Errorf("config = %+v from %+v, want %+v", cfg, source, want)
+	}
+	if cfg, _, _ := c.podCaptureConfig(server); cfg != nil {
+		t.Errorf("destination captured with %+v", cfg)
+	}
+
+	// The destination's IPs are in the filter, so its updates queue the
+	// source
+	c.enqueuePod(server)
+	if key, _ := c.queue.Get(); key != "shop/web-1" {
+		t.Errorf("queued %v, want shop/web-1", key)
+	}
+
+	status := &CaptureStatus{Phase: CaptureCompleted, Node: "node-1", Files: "/captures/shop_web-1/web-1.pcap*", Message: StopReasonPacketCountReached}
+	if err := c.reportStatus(ctx, "shop/web-1", client, source, status); err != nil {
+		t.Fatal(err)
+	}
+	got, err := dynamicClient.Resource(PacketCaptureGVR).Get(ctx, "web-to-db", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pcStatus packetCaptureStatus
+	raw, _, _ := unstructured.NestedMap(got.Object, "status")
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &pcStatus); err != nil {
+		t.Fatal(err)
+	}
+	if pcStatus.FilePath != "node-1:/captures/shop_web-1/web-1.pcap*" {
+		t.Errorf("filePath = %q", pcStatus.FilePath)
+	}
+	if !meta.IsStatusConditionTrue(pcStatus.Conditions, PacketCaptureStarted) {
+		t.Errorf("not started: %+v", pcStatus.Conditions)
+	}
+	if cond := meta.FindStatusCondition(pcStatus.Conditions, PacketCaptureComplete); cond == nil ||
+		cond.Status != metav1.ConditionTrue || cond.Reason != StopReasonPacketCountReached {
+		t.Errorf("complete condition = %+v", cond)
+	}
+}
+
+func TestPacketCaptureConditions(t *testing.T) {
+	for _, tc := range []struct {
+		message, reason string
+	}{
+		{StopReasonDurationElapsed, StopReasonDurationElapsed},
+		{StopReasonStopConditionMatched + ": tcp 10.0.0.5:5432 > 10.0.1.7:40000 [RST]", StopReasonStopConditionMatched},
+		{"", "Succeeded"},
+		{"finished early", "Succeeded"},
+	} {
+		conditions := packetCaptureConditions(&CaptureStatus{Phase: CaptureCompleted, Message: tc.message})
+		cond := meta.FindStatusCondition(conditions, PacketCaptureComplete)
+		if cond == nil || cond.Reason != tc.reason || cond.Message != tc.message {
+			t.Errorf("complete condition for %q = %+v, want reason %s", tc.message, cond, tc.reason)
+		}
+	}
+}
+
+func TestPacketCaptureFilter(t *testing.T) {
+	web := []netip.Addr{netip.MustParseAddr("fd00::5")}
+	db := []netip.Addr{netip.MustParseAddr("fd00::9")}
+	spec := &packetCaptureSpec{Direction: PacketCaptureBoth, Packet: &packetCapturePacket{Protocol: &intstr.IntOrString{Type: intstr.Int, IntVal: 17}}}
+	spec.Packet.TransportHeader.UDP = &packetCaptureUDP{DstPort: 53}
+
+	filter, err := packetCaptureFilter(spec, "IPv6", web, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "(ip6) and (((((src host fd00::5) and (dst host fd00::9)) and (udp)) and (dst port 53)) or " +
+		"((((src host fd00::9) and (dst host fd00::5)) and (udp)) and (src port 53)))"
+	if filter != want {
+		t.Errorf("filter = %q, want %q", filter, want)
+	}
+
+	spec.Packet.Protocol = &intstr.IntOrString{Type: intstr.String, StrVal: "ICMP"}
+	if _, err := packetCaptureFilter(spec, "IPv6", web, db); err == nil {
+		t.Error("UDP header accepted with ICMP")
+	}
+}
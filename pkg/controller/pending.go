@@ -0,0 +1,378 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"k8s.io/klog/v2"
+)
+
+// ErrCaptureQueued indicates all slots are taken and the capture waits in the
+// pending queue. It starts as soon as a slot is released.
+var ErrCaptureQueued = errors.New("capture queued until a slot is free")
+
+// pendingCapture is a capture request waiting for a free slot.
+type pendingCapture struct {
+	ctx         context.Context
+	key         string
+	namespace   string
+	outputFile  string
+	containerID string
+	config      *CaptureConfig
+}
+
+// pendingQueue orders waiting captures by priority, highest first. Within a
+// priority it is FIFO per namespace and round-robin across namespaces, so one
+// busy namespace cannot starve the others.
+type pendingQueue struct {
+	levels map[int]*fairQueue
+}
+
+func newPendingQueue() *pendingQueue {
+	return &pendingQueue{levels: make(map[int]*fairQueue)}
+}
+
+// priorities returns the priorities with waiting captures, highest first.
+func (q *pendingQueue) priorities() []int {
+	priorities := make([]int, 0, len(q.levels))
+	for priority := range q.levels {
+		priorities = append(priorities, priority)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+	return priorities
+}
+
+func (q *pendingQueue) len() int {
+	n := 0
+	for _, level := range q.levels {
+		n += level.len()
+	}
+	return n
+}
+
+// countAtLeast returns how many captures of at least priority are waiting.
+func (q *pendingQueue) countAtLeast(priority int) int {
+	n := 0
+	for p, level := range q.levels {
+		if p >= priority {
+			n += level.len()
+		}
+	}
+	return n
+}
+
+func (q *pendingQueue) find(key string) *pendingCapture {
+	for _, level := range q.levels {
+		if item := level.find(key); item != nil {
+			return item
+		}
+	}
+	return nil
+}
+
+func (q *pendingQueue) level(priority int) *fairQueue {
+	level := q.levels[priority]
+	if level == nil {
+		level = newFairQueue()
+		q.levels[priority] = level
+	}
+	return level
+}
+
+func (q *pendingQueue) push(item *pendingCapture) {
+	q.level(item.config.Priority).push(item)
+}
+
+// pushFront puts an item back at the head of its priority after a failed
+// attempt to start it.
+func (q *pendingQueue) pushFront(item *pendingCapture) {
+	q.level(item.config.Priority).pushFront(item)
+}
+
+// pop removes and returns the next capture to start.
+func (q *pendingQueue) pop() *pendingCapture {
+	for _, priority := range q.priorities() {
+		level := q.levels[priority]
+		item := level.pop()
+		if level.len() == 0 {
+			delete(q.levels, priority)
+		}
+		if item != nil {
+			return item
+		}
+	}
+	return nil
+}
+
+// remove drops key from the queue, reporting whether it was queued.
+func (q *pendingQueue) remove(key string) bool {
+	for priority, level := range q.levels {
+		if level.remove(key) {
+			if level.len() == 0 {
+				delete(q.levels, priority)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// order returns the queued keys in the order they will start.
+func (q *pendingQueue) order() []string {
+	var keys []string
+	for _, priority := range q.priorities() {
+		keys = append(keys, q.levels[priority].order()...)
+	}
+	return keys
+}
+
+// fairQueue is FIFO within a namespace and round-robin across namespaces.
+type fairQueue struct {
+	byNamespace map[string][]*pendingCapture
+	// namespaces lists namespaces with waiting captures; the head is served
+	// next and moves to the back afterwards.
+	namespaces []string
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{byNamespace: make(map[string][]*pendingCapture)}
+}
+
+func (q *fairQueue) len() int {
+	n := 0
+	for _, items := range q.byNamespace {
+		n += len(items)
+	}
+	return n
+}
+
+func (q *fairQueue) find(key string) *pendingCapture {
+	for _, item := range q.byNamespace[keyNamespace(key)] {
+		if item.key == key {
+			return item
+		}
+	}
+	return nil
+}
+
+func (q *fairQueue) push(item *pendingCapture) {
+	if len(q.byNamespace[item.namespace]) == 0 {
+		q.namespaces = append(q.namespaces, item.namespace)
+	}
+	q.byNamespace[item.namespace] = append(q.byNamespace[item.namespace], item)
+}
+
+func (q *fairQueue) pushFront(item *pendingCapture) {
+	items := q.byNamespace[item.namespace]
+	if len(items) == 0 {
+		q.namespaces = append([]string{item.namespace}, q.namespaces...)
+	} else {
+		q.moveToFront(item.namespace)
+	}
+	q.byNamespace[item.namespace] = append([]*pendingCapture{item}, items...)
+}
+
+func (q *fairQueue) moveToFront(namespace string) {
+	for i, ns := range q.namespaces {
+		if ns == namespace {
+			copy(q.namespaces[1:i+1], q.namespaces[:i])
+			q.namespaces[0] = namespace
+			return
+		}
+	}
+}
+
+func (q *fairQueue) pop() *pendingCapture {
+	if len(q.namespaces) == 0 {
+		return nil
+	}
+	namespace := q.namespaces[0]
+	q.namespaces = q.namespaces[1:]
+
+	items := q.byNamespace[namespace]
+	item := items[0]
+	if len(items) > 1 {
+		q.byNamespace[namespace] = items[1:]
+		q.namespaces = append(q.namespaces, namespace)
+	} else {
+		delete(q.byNamespace, namespace)
+	}
+	return item
+}
+
+func (q *fairQueue) remove(key string) bool {
+	namespace := keyNamespace(key)
+	items := q.byNamespace[namespace]
+	for i, item := range items {
+		if item.key != key {
+			continue
+		}
+		items = append(items[:i:i], items[i+1:]...)
+		if len(items) == 0 {
+			delete(q.byNamespace, namespace)
+			for j, ns := range q.namespaces {
+				if ns == namespace {
+					q.namespaces = append(q.namespaces[:j:j], q.namespaces[j+1:]...)
+					break
+				}
+			}
+		} else {
+			q.byNamespace[namespace] = items
+		}
+		return true
+	}
+	return false
+}
+
+func (q *fairQueue) order() []string {
+	offsets := make(map[string]int, len(q.namespaces))
+	namespaces := append([]string(nil), q.namespaces...)
+	var keys []string
+	for len(namespaces) > 0 {
+		namespace := namespaces[0]
+		namespaces = namespaces[1:]
+		items := q.byNamespace[namespace]
+		keys = append(keys, items[offsets[namespace]].key)
+		offsets[namespace]++
+		if offsets[namespace] < len(items) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return keys
+}
+
+// SetOnPendingChange registers a callback invoked with the key of every
+// queued capture whose queue position changed or that left the queue.
+func (pm *ProcessManager) SetOnPendingChange(onPendingChange func(key string)) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.onPendingChange = onPendingChange
+}
+
+// SetOnQueuedStart registers a callback invoked when a capture from the
+// pending queue has been started.
+func (pm *ProcessManager) SetOnQueuedStart(onQueuedStart func(key, outputFile, containerID string, cfg *CaptureConfig)) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.onQueuedStart = onQueuedStart
+}
+
+// QueuePosition returns the 1-based position of key in the pending queue, or
+// 0 if it is not queued.
+func (pm *ProcessManager) QueuePosition(key string) int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for i, k := range pm.pending.order() {
+		if k == key {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// CancelPending removes key from the pending queue.
+func (pm *ProcessManager) CancelPending(key string) {
+	pm.mu.Lock()
+	removed := pm.pending.remove(key)
+	pm.mu.Unlock()
+	if removed {
+		klog.V(2).InfoS("Removed capture from pending queue", "pod", key)
+		pm.notifyPending()
+	}
+}
+
+// enqueue adds a request to the pending queue, or updates it in place if the
+// key is already waiting so it keeps its position.
+func (pm *ProcessManager) enqueue(item *pendingCapture) {
+	pm.mu.Lock()
+	if existing := pm.pending.find(item.key); existing != nil && existing.config.Priority == item.config.Priority {
+		existing.ctx = item.ctx
+		existing.outputFile = item.outputFile
+		existing.containerID = item.containerID
+		existing.config = item.config
+		pm.mu.Unlock()
+		return
+	} else if existing != nil {
+		pm.pending.remove(item.key)
+	}
+	pm.pending.push(item)
+	position := pm.pending.len()
+	pm.mu.Unlock()
+
+	klog.InfoS("All capture slots busy, queued capture", "pod", item.key, "queueLength", position)
+}
+
+// dispatchPending starts queued captures while slots are free.
+func (pm *ProcessManager) dispatchPending() {
+	for {
+		if pm.checkDiskPressure() != nil {
+			return
+		}
+
+		pm.mu.Lock()
+		item := pm.pending.pop()
+		pm.mu.Unlock()
+		if item == nil {
+			return
+		}
+
+		if item.ctx.Err() != nil {
+			continue
+		}
+		if err := pm.tryAcquire(item.ctx); err != nil {
+			// Another request took the slot first.
+			pm.mu.Lock()
+			pm.pending.pushFront(item)
+			pm.mu.Unlock()
+			pm.preemptFor(item.config.Priority)
+			return
+		}
+
+		err := pm.doStartCapture(item.ctx, item.key, item.outputFile, item.containerID, item.config)
+		if err != nil {
+			// Releasing the slot dispatches the next capture; the controller
+			// resyncs this one and reports the error.
+			klog.ErrorS(err, "Failed to start queued capture", "pod", item.key)
+			pm.releaseSlot()
+		} else {
+			pm.mu.Lock()
+			onQueuedStart := pm.onQueuedStart
+			pm.mu.Unlock()
+			if onQueuedStart != nil {
+				onQueuedStart(item.key, item.outputFile, item.containerID, item.config)
+			}
+		}
+
+		pm.notifyPending()
+		if err != nil {
+			pm.mu.Lock()
+			onPendingChange := pm.onPendingChange
+			pm.mu.Unlock()
+			if onPendingChange != nil {
+				onPendingChange(item.key)
+			}
+		}
+	}
+}
+
+// notifyPending reports every queued key, as their positions may have moved.
+func (pm *ProcessManager) notifyPending() {
+	pm.mu.Lock()
+	keys := pm.pending.order()
+	onPendingChange := pm.onPendingChange
+	pm.mu.Unlock()
+
+	if onPendingChange == nil {
+		return
+	}
+	for _, key := range keys {
+		onPendingChange(key)
+	}
+}
+
+// pendingMessage describes a queued capture for its status.
+func pendingMessage(position int) string {
+	return fmt.Sprintf("waiting for a capture slot (position %d in queue)", position)
+}
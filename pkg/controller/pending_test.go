@@ -0,0 +1,32 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPendingQueueFairness(t *testing.T) {
+	q := newPendingQueue()
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1", "c/1", "b/2"} {
+		q.push(&pendingCapture{key: key, namespace: keyNamespace(key), config: &CaptureConfig{MaxFiles: 1}})
+	}
+
+	q.push(&pendingCapture{key: "c/urgent", namespace: "c", config: &CaptureConfig{MaxFiles: 1, Priority: 5}})
+
+	want := []string{"c/urgent", "a/1", "b/1", "c/1", "a/2", "b/2", "a/3"}
+	if got := q.order(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("order() = %v, want %v", got, want)
+	}
+
+	if !q.remove("c/1") {
+		t.Fatalf("remove(c/1) = false")
+	}
+	var popped []string
+	for item := q.pop(); item != nil; item = q.pop() {
+		popped = append(popped, item.key)
+	}
+	want = []string{"c/urgent", "a/1", "b/1", "a/2", "b/2", "a/3"}
+	if !reflect.DeepEqual(popped, want) {
+		t.Errorf("pop order = %v, want %v", popped, want)
+	}
+}
@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// Event reasons emitted on Pods and Namespaces.
+const (
+	EventReasonCaptureDenied     = "CaptureDenied"
+	EventReasonCaptureNotStarted = "CaptureNotStarted"
+)
+
+// CapturePolicy decides which Pods may be captured at all, independently of
+// who can annotate them.
+type CapturePolicy struct {
+	// AllowNamespaces, if not empty, lists the only namespaces where
+	// captures are allowed.
+	AllowNamespaces []string
+	// DenyNamespaces lists namespaces where captures are never allowed.
+	DenyNamespaces []string
+	// NamespaceSelector, if set, must match the Pod's namespace labels.
+	NamespaceSelector labels.Selector
+	// BlockingPodSelector, if set, blocks captures of Pods it matches.
+	BlockingPodSelector labels.Selector
+}
+
+// needsNamespaces reports whether checking the policy needs Namespace labels.
+func (p CapturePolicy) needsNamespaces() bool {
+	return p.NamespaceSelector != nil && !p.NamespaceSelector.Empty()
+}
+
+// capturePolicyFile is the format of a policy file, such as a mounted
+// ConfigMap key. Label requirements use label selector syntax, e.g.
+// "capture-allowed=true" or "no-capture".
+type capturePolicyFile struct {
+	AllowNamespaces        []string `json:"allowNamespaces,omitempty"`
+	DenyNamespaces         []string `json:"denyNamespaces,omitempty"`
+	RequiredNamespaceLabel string   `json:"requiredNamespaceLabel,omitempty"`
+	BlockingPodLabel       string   `json:"blockingPodLabel,omitempty"`
+}
+
+// policyFileCheckInterval is how often a policy file is checked for changes.
+// The kubelet updates a mounted ConfigMap within about a minute of an edit.
+const policyFileCheckInterval = 10 * time.Second
+
+// LoadCapturePolicy reads a YAML or JSON policy file.
+func LoadCapturePolicy(path string) (CapturePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return CapturePolicy{}, err
+	}
+	return parseCapturePolicy(path, data)
+}
+
+func parseCapturePolicy(path string, data []byte) (CapturePolicy, error) {
+	var (
+		policy CapturePolicy
+		err    error
+	)
+	var file capturePolicyFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return policy, fmt.Errorf("invalid capture policy %s: %w", path, err)
+	}
+
+	policy.AllowNamespaces = file.AllowNamespaces
+	policy.DenyNamespaces = file.DenyNamespaces
+	if file.RequiredNamespaceLabel != "" {
+		if policy.NamespaceSelector, err = labels.Parse(file.RequiredNamespaceLabel); err != nil {
+			return policy, fmt.Errorf("invalid requiredNamespaceLabel in %s: %w", path, err)
+		}
+	}
+	if file.BlockingPodLabel != "" {
+		if policy.BlockingPodSelector, err = labels.Parse(file.BlockingPodLabel); err != nil {
+			return policy, fmt.Errorf("invalid blockingPodLabel in %s: %w", path, err)
+		}
+	}
+	return policy, nil
+}
+
+// SetPolicy configures the capture policy. The Namespace informer is only
+// required when the policy needs Namespace labels. It must be called before
+// Run.
+func (c *Controller) SetPolicy(policy CapturePolicy, namespaceInformer coreinformers.NamespaceInformer) {
+	c.policy = policy
+	if namespaceInformer != nil {
+		c.watchNamespaces(namespaceInformer)
+	}
+}
+
+// SetPolicyFile reloads the capture policy from path, the file SetPolicy's
+// policy was loaded from, whenever its contents change, and resyncs every
+// local Pod. An invalid policy is logged and the previous one stays in
+// effect. As an edited policy may need Namespace labels, SetPolicy must have
+// been given the Namespace informer. It must be called before Run.
+func (c *Controller) SetPolicyFile(path string) {
+	c.policyFile = path
+	c.policyData, _ = os.ReadFile(path)
+}
+
+// reloadPolicyFile applies the policy file if it changed since it was last
+// read.
+func (c *Controller) reloadPolicyFile(ctx context.Context) {
+	data, err := os.ReadFile(c.policyFile)
+	if err != nil {
+		klog.ErrorS(err, "Failed to read capture policy", "file", c.policyFile)
+		return
+	}
+	if bytes.Equal(data, c.policyData) {
+		return
+	}
+	c.policyData = data
+	policy, err := parseCapturePolicy(c.policyFile, data)
+	if err != nil {
+		klog.ErrorS(err, "Ignoring invalid capture policy", "file", c.policyFile)
+		return
+	}
+	klog.InfoS("Reloaded capture policy", "file", c.policyFile)
+	c.policyMu.Lock()
+	c.policy = policy
+	c.policyMu.Unlock()
+	c.enqueueAllPods()
+}
+
+// checkPolicy returns a refused error if the policy forbids capturing pod.
+func (c *Controller) checkPolicy(pod *corev1.Pod) error {
+	c.policyMu.RLock()
+	p := c.policy
+	c.policyMu.RUnlock()
+	if slices.Contains(p.DenyNamespaces, pod.Namespace) {
+		return newRefusedError("captures are denied in namespace %s", pod.Namespace)
+	}
+	if len(p.AllowNamespaces) > 0 && !slices.Contains(p.AllowNamespaces, pod.Namespace) {
+		return newRefusedError("namespace %s is not in the capture allow list", pod.Namespace)
+	}
+	if p.needsNamespaces() {
+		if c.namespaceLister == nil {
+			return fmt.Errorf("capture policy requires Namespace labels but no Namespace informer is configured")
+		}
+		ns, err := c.namespaceLister.Get(pod.Namespace)
+		if err != nil {
+			return fmt.Errorf("failed to get namespace %s: %w", pod.Namespace, err)
+		}
+		if !p.NamespaceSelector.Matches(labels.Set(ns.Labels)) {
+			return newRefusedError("namespace %s does not have the label %s required for captures", pod.Namespace, p.NamespaceSelector)
+		}
+	}
+	if p.BlockingPodSelector != nil && !p.BlockingPodSelector.Empty() && p.BlockingPodSelector.Matches(labels.Set(pod.Labels)) {
+		return newRefusedError("pod label %s blocks captures", p.BlockingPodSelector)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestCheckPolicy(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"capture-allowed": "true"}}})
+	indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}})
+	c := &Controller{
+		namespaceLister: corelisters.NewNamespaceLister(indexer),
+		policy: CapturePolicy{
+			DenyNamespaces:      []string{"kube-system"},
+			NamespaceSelector:   labels.SelectorFromSet(labels.Set{"capture-allowed": "true"}),
+			BlockingPodSelector: labels.SelectorFromSet(labels.Set{"pci": "true"}),
+		},
+	}
+
+	tests := []struct {
+		name        string
+		namespace   string
+		labels      map[string]string
+		wantRefused bool
+	}{
+		{name: "allowed", namespace: "team-a"},
+		{name: "denied namespace", namespace: "kube-system", wantRefused: true},
+		{name: "namespace without label", namespace: "team-b", wantRefused: true},
+		{name: "blocking pod label", namespace: "team-a", labels: map[string]string{"pci": "true"}, wantRefused: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: "web", Labels: tt.labels}}
+			err := c.checkPolicy(pod)
+			var te *terminalError
+			refused := errors.As(err, &te) && te.phase == CaptureRefused
+			if refused != tt.wantRefused {
+				t.Errorf("checkPolicy() = %v, wantRefused %v", err, tt.wantRefused)
+			}
+		})
+	}
+}
+
+func TestReloadPolicyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("denyNamespaces: [kube-system]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web"}}
+	pods.Add(pod)
+	c := &Controller{
+		podLister: corelisters.NewPodLister(pods),
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	defer c.queue.ShutDown()
+	policy, err := LoadCapturePolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetPolicy(policy, nil)
+	c.SetPolicyFile(path)
+
+	c.reloadPolicyFile(context.Background())
+	if err := c.checkPolicy(pod); err != nil || c.queue.Len() != 0 {
+		t.Fatalf("unchanged policy: checkPolicy() = %v, %d Pods resynced", err, c.queue.Len())
+	}
+
+	if err := os.WriteFile(path, []byte("denyNamespaces: [kube-system, team-a]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.reloadPolicyFile(context.Background())
+	if err := c.checkPolicy(pod); err == nil || c.queue.Len() != 1 {
+		t.Errorf("edited policy: checkPolicy() = %v, %d Pods resynced", err, c.queue.Len())
+	}
+
+	// An invalid policy keeps the previous one
+	if err := os.WriteFile(path, []byte("denyNamespace: [kube-system]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.reloadPolicyFile(context.Background())
+	if err := c.checkPolicy(pod); err == nil {
+		t.Error("invalid policy replaced the previous one")
+	}
+}
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// StopReasonPreempted finishes a capture to free its slot for a capture of
+// higher priority. Its files are kept in its session, which is closed, and
+// it is queued to resume in a new session.
+const StopReasonPreempted = "Preempted"
+
+// PriorityPolicy maps a namespace to the highest capture priority its Pods
+// may request. The "*" entry applies to namespaces without their own; without
+// either, only priorities up to 0 are allowed.
+type PriorityPolicy map[string]int
+
+// maxPriority returns the highest priority allowed in namespace.
+func (p PriorityPolicy) maxPriority(namespace string) int {
+	if max, ok := p[namespace]; ok {
+		return max
+	}
+	return p["*"]
+}
+
+// ParsePriorityPolicy parses "<namespace>=<max priority>", e.g. "sre=100".
+// Use "*" as the namespace for the default.
+func ParsePriorityPolicy(value string) (string, int, error) {
+	namespace, maxValue, ok := strings.Cut(value, "=")
+	if !ok || namespace == "" {
+		return "", 0, fmt.Errorf("invalid priority policy %q, expected <namespace>=<max priority>", value)
+	}
+	max, err := strconv.Atoi(maxValue)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid max priority in priority policy %q: %w", value, err)
+	}
+	return namespace, max, nil
+}
+
+// SetPriorityPolicy configures which priorities each namespace may use. It
+// must be called before Run.
+func (c *Controller) SetPriorityPolicy(policy PriorityPolicy) {
+	c.priorityPolicy = policy
+}
+
+// Check returns an error if namespace may not use priority.
+func (p PriorityPolicy) Check(namespace string, priority int) error {
+	if max := p.maxPriority(namespace); priority > max {
+		return fmt.Errorf("priority %d exceeds the maximum of %d allowed in namespace %s", priority, max, namespace)
+	}
+	return nil
+}
+
+// admitPriority refuses priorities above the namespace's allowance.
+func (c *Controller) admitPriority(namespace string, cfg *CaptureConfig) error {
+	if err := c.priorityPolicy.Check(namespace, cfg.Priority); err != nil {
+		return newRefusedError("%s", err)
+	}
+	return nil
+}
+
+// resumePreempted marks a preempted capture until it runs again. Its files
+// are kept; the resumed capture is a new session with its own files.
+func (c *Controller) resumePreempted(key string) {
+	klog.InfoS("Queueing preempted capture to resume", "pod", key)
+	c.stopCapture(key, false)
+
+	c.mu.Lock()
+	c.preempted[key] = true
+	c.mu.Unlock()
+}
+
+// preemptFor finishes the lowest-priority running capture if a waiting
+// capture of the given priority would otherwise have no slot to take.
+// Captures already finishing count as slots about to be freed.
+func (pm *ProcessManager) preemptFor(priority int) {
+	pm.mu.Lock()
+	waiting := pm.pending.countAtLeast(priority)
+	var (
+		freeing   int
+		victimKey string
+		victim    *CaptureProcess
+	)
+	for key, capture := range pm.captures {
+		if capture.stopReason != "" {
+			freeing++
+			continue
+		}
+		if capture.priority >= priority {
+			continue
+		}
+		// Prefer the lowest priority, then the most recent start, which
+		// loses the least capture time.
+		if victim == nil || capture.priority < victim.priority ||
+			(capture.priority == victim.priority && capture.started.After(victim.started)) {
+			victimKey, victim = key, capture
+		}
+	}
+	if victim == nil || freeing >= waiting {
+		pm.mu.Unlock()
+		return
+	}
+	victim.stopReason = StopReasonPreempted
+	pm.mu.Unlock()
+
+	klog.InfoS("Preempting capture for a higher-priority request", "pod", victimKey,
+		"priority", victim.priority, "requestedPriority", priority)
+	syscall.Kill(-victim.pid, syscall.SIGTERM)
+}
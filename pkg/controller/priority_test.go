@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPreemptFor(t *testing.T) {
+	pm := NewProcessManager(2, t.TempDir(), "")
+	start := func(key string, priority int, started time.Time) *CaptureProcess {
+		cmd := exec.Command("sleep", "30")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		go cmd.Wait()
+		t.Cleanup(func() { cmd.Process.Kill() })
+		capture := &CaptureProcess{pid: cmd.Process.Pid, priority: priority, started: started}
+		pm.captures[key] = capture
+		return capture
+	}
+	now := time.Now()
+	older := start("a/old", 0, now.Add(-time.Hour))
+	newer := start("a/new", 0, now)
+	pm.pending.push(&pendingCapture{key: "sre/db", namespace: "sre", config: &CaptureConfig{MaxFiles: 1, Priority: 10}})
+
+	pm.preemptFor(10)
+	if newer.stopReason != StopReasonPreempted || older.stopReason != "" {
+		t.Fatalf("want only the newest lowest-priority capture preempted, got new=%q old=%q", newer.stopReason, older.stopReason)
+	}
+
+	// The preempted capture's slot is already on its way to the waiting request.
+	pm.preemptFor(10)
+	if older.stopReason != "" {
+		t.Errorf("second preemption for one waiting request stopped %q", "a/old")
+	}
+}
@@ -5,12 +5,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"k8s.io/klog/v2"
 )
@@ -23,29 +27,75 @@ type ProcessManager struct {
 	semaphore     chan struct{}
 	captureDir    string
 	criSocket     string
-	onExit        func(string)
+	captureMode   CaptureMode
+	// gatewayInterface and tunnelInterface are the node interfaces captures
+	// can add, and podIPs looks up the addresses they are filtered to.
+	gatewayInterface string
+	tunnelInterface  string
+	podIPs           func(key string) []string
+	onExit           func(key, filePattern, reason string)
+	streams          map[string]*liveStream
+	diskPressure     atomic.Int32 // set by the disk watchdog
+	pending          *pendingQueue
+	// onPendingChange and onQueuedStart report pending queue changes.
+	onPendingChange func(key string)
+	onQueuedStart   func(key, outputFile, containerID string, cfg *CaptureConfig)
+	// onCaptureChange reports changes to running captures that their status
+	// shows.
+	onCaptureChange func(key string)
 }
 
 // CaptureProcess tracks a running tcpdump process
 type CaptureProcess struct {
-	cmd         *exec.Cmd
+	pid         int // tcpdump PID, which also leads its process group
+	ctx         context.Context
 	cancel      context.CancelFunc
+	target      captureTarget
 	release     func()
 	releaseOnce sync.Once
 	filePattern string
+	filter      string
+	timer       *time.Timer
+	stopReason  string // set when the capture is finished on purpose
+	priority    int
+	started     time.Time
+	recorder    *flightRecorder // set for flight recorders
+	stopMatch   string          // the packet that matched the stop condition
+	packetCount int             // tcpdump exits by itself after that many packets
+	// nodeCaptures tracks the node interface captures, which exit with
+	// the capture.
+	nodeCaptures sync.WaitGroup
 }
 
+// archiveMarker separates the name of a capture file archived by earlier
+// versions from its suffix.
+const archiveMarker = ".archived-"
+
 // ErrMaxConcurrent indicates the capture limit was reached.
 var ErrMaxConcurrent = errors.New("max concurrent captures reached")
 
+// Stop reasons passed to the exit callback. An empty reason means tcpdump
+// exited on its own and the capture should be restarted.
+const (
+	StopReasonDurationElapsed = "DurationElapsed"
+	// StopReasonPacketCountReached is tcpdump exiting after the packet
+	// count of the capture.
+	StopReasonPacketCountReached = "PacketCountReached"
+)
+
 // NewProcessManager creates a new process manager
 func NewProcessManager(maxConcurrent int, captureDir, criSocket string) *ProcessManager {
 	pm := &ProcessManager{
-		captures:      make(map[string]*CaptureProcess),
-		maxConcurrent: maxConcurrent,
-		semaphore:     make(chan struct{}, maxConcurrent),
-		captureDir:    captureDir,
-		criSocket:     criSocket,
+		captures:         make(map[string]*CaptureProcess),
+		maxConcurrent:    maxConcurrent,
+		semaphore:        make(chan struct{}, maxConcurrent),
+		captureDir:       captureDir,
+		captureMode:      CaptureModeNetns,
+		gatewayInterface: DefaultGatewayInterface,
+		tunnelInterface:  DefaultTunnelInterface,
+		criSocket:        criSocket,
+		streams:          make(map[string]*liveStream),
+		pending:          newPendingQueue(),
 	}
 
 	// Ensure capture directory exists
@@ -57,12 +107,23 @@ func NewProcessManager(maxConcurrent int, captureDir, criSocket string) *Process
 }
 
 // SetOnExit registers a callback invoked when a capture process exits.
-func (pm *ProcessManager) SetOnExit(onExit func(string)) {
+// It is passed the file pattern of the capture, which tells the exit of a
+// capture stopped for a restart apart from that of its successor.
+func (pm *ProcessManager) SetOnExit(onExit func(key, filePattern, reason string)) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 	pm.onExit = onExit
 }
 
+// SetOnCaptureChange registers a callback invoked when the status of a
+// running capture changes: a flight recorder is triggered or finishes writing
+// a dump, or a stop condition matches.
+func (pm *ProcessManager) SetOnCaptureChange(onChange func(key string)) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.onCaptureChange = onChange
+}
+
 // HasCapture reports whether a capture is currently active for the key.
 func (pm *ProcessManager) HasCapture(key string) bool {
 	pm.mu.Lock()
@@ -71,13 +132,37 @@ func (pm *ProcessManager) HasCapture(key string) bool {
 	return exists
 }
 
-// StartCapture queues a capture request
-func (pm *ProcessManager) StartCapture(ctx context.Context, key, podName, containerID string, maxFiles int) error {
+// StartCapture starts a capture, or queues it and returns ErrCaptureQueued
+// when all slots are taken or other captures are already waiting.
+// tcpdump writes outputFile and appends rotation numbers to it.
+func (pm *ProcessManager) StartCapture(ctx context.Context, key, outputFile, containerID string, cfg *CaptureConfig) error {
+	if err := pm.checkDiskPressure(); err != nil {
+		return err
+	}
+
+	pm.mu.Lock()
+	waiting := pm.pending.len() > 0
+	pm.mu.Unlock()
+	queue := func() error {
+		pm.enqueue(&pendingCapture{ctx: ctx, key: key, namespace: keyNamespace(key),
+			outputFile: outputFile, containerID: containerID, config: cfg})
+		pm.preemptFor(cfg.Priority)
+		return ErrCaptureQueued
+	}
+	if waiting {
+		// Do not overtake captures that are already waiting.
+		err := queue()
+		go pm.dispatchPending()
+		return err
+	}
 	if err := pm.tryAcquire(ctx); err != nil {
+		if errors.Is(err, ErrMaxConcurrent) {
+			return queue()
+		}
 		return err
 	}
 
-	err := pm.doStartCapture(ctx, key, podName, containerID, maxFiles)
+	err := pm.doStartCapture(ctx, key, outputFile, containerID, cfg)
 	if err != nil {
 		pm.releaseSlot()
 		return err
@@ -87,7 +172,7 @@ func (pm *ProcessManager) StartCapture(ctx context.Context, key, podName, contai
 }
 
 // doStartCapture actually starts the tcpdump process
-func (pm *ProcessManager) doStartCapture(ctx context.Context, key, podName, containerID string, maxFiles int) error {
+func (pm *ProcessManager) doStartCapture(ctx context.Context, key, outputFile, containerID string, cfg *CaptureConfig) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
@@ -96,37 +181,63 @@ func (pm *ProcessManager) doStartCapture(ctx context.Context, key, podName, cont
 		return fmt.Errorf("capture already running for %s", key)
 	}
 
-	// Get container PID from container ID
-	pid, err := getContainerPID(containerID, pm.criSocket)
+	target, err := pm.captureTarget(key, containerID)
 	if err != nil {
-		return fmt.Errorf("failed to get container PID: %w", err)
+		return err
+	}
+
+	// Each session writes into its own directory
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		return fmt.Errorf("failed to create session directory: %w", err)
 	}
 
 	// Create capture context with cancellation
 	captureCtx, cancel := context.WithCancel(ctx)
 
-	// Build tcpdump command with nsenter
-	outputFile := filepath.Join(pm.captureDir, fmt.Sprintf("capture-%s.pcap", podName))
-	filePattern := filepath.Join(pm.captureDir, fmt.Sprintf("capture-%s.pcap*", podName))
+	// Build tcpdump command
+	filePattern := outputFile + "*"
 
-	// Use nsenter to enter the container's network namespace
-	cmd := exec.CommandContext(captureCtx,
-		"nsenter",
-		"--net="+fmt.Sprintf("/proc/%d/ns/net", pid),
-		"--",
-		"tcpdump",
+	args := []string{
 		"-C", "1", // 1MB file size (tcpdump expects MB as a number)
-		"-W", fmt.Sprintf("%d", maxFiles), // max files
+		"-W", fmt.Sprintf("%d", cfg.MaxFiles), // max files
 		"-w", outputFile,
-		"-i", "eth0",
 		"-Z", "root",
-	)
+	}
+	if cfg.PacketCount > 0 {
+		args = append(args, "-c", fmt.Sprintf("%d", cfg.PacketCount))
+	}
+	var recorder *flightRecorder
+	if cfg.FlightRecorder() {
+		// Packets pass through the controller instead of going to files
+		args = slices.Clone(flightRecorderArgs)
+		onChange := pm.onCaptureChange
+		recorder, err = newFlightRecorder(key, outputFile, cfg, func() {
+			if onChange != nil {
+				onChange(key)
+			}
+		})
+		if err != nil {
+			cancel()
+			return err
+		}
+	}
+	if cfg.Filter != "" {
+		args = append(args, "--", cfg.Filter)
+	}
 
-	// Set process group to ensure we can kill children (tcpdump)
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// Enter the container's network namespace, or capture the host veth
+	cmd := target.command(captureCtx, args...)
+	markCapture(cmd, pm.captureDir)
 
 	// Capture stderr for debugging
 	stderr, _ := cmd.StderrPipe()
+	var stdout io.Reader
+	if recorder != nil {
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			cancel()
+			return fmt.Errorf("failed to create flight recorder pipe: %w", err)
+		}
+	}
 
 	// Start the process
 	if err := cmd.Start(); err != nil {
@@ -134,14 +245,41 @@ func (pm *ProcessManager) doStartCapture(ctx context.Context, key, podName, cont
 		return fmt.Errorf("failed to start tcpdump: %w", err)
 	}
 
-	pm.captures[key] = &CaptureProcess{
-		cmd:         cmd,
+	capture := &CaptureProcess{
+		pid:         cmd.Process.Pid,
+		ctx:         captureCtx,
 		cancel:      cancel,
+		target:      target,
 		release:     pm.releaseSlot,
 		filePattern: filePattern,
+		filter:      cfg.Filter,
+		priority:    cfg.Priority,
+		started:     time.Now(),
+		recorder:    recorder,
+		packetCount: cfg.PacketCount,
+	}
+	if cfg.Duration > 0 {
+		capture.timer = time.AfterFunc(cfg.Duration, func() {
+			pm.finishCapture(key, capture, StopReasonDurationElapsed)
+		})
+	}
+	if cfg.StopCondition() {
+		if err := pm.startStopWatcher(key, capture, cfg); err != nil {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			cancel()
+			go cmd.Wait()
+			return err
+		}
 	}
+	if err := pm.startNodeInterfaceCaptures(key, outputFile, capture, cfg); err != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cancel()
+		go cmd.Wait()
+		return err
+	}
+	pm.captures[key] = capture
 
-	klog.InfoS("tcpdump process started", "pod", key, "pid", cmd.Process.Pid)
+	klog.InfoS("tcpdump process started", "pod", key, "pid", cmd.Process.Pid, "interface", target.iface, "flightRecorder", recorder != nil)
 
 	// Monitor stderr in background
 	go func() {
@@ -151,15 +289,130 @@ func (pm *ProcessManager) doStartCapture(ctx context.Context, key, podName, cont
 		}
 	}()
 
-	// Monitor process in background
-	go pm.monitorProcess(key, cmd, cancel)
+	// Monitor process in background. The recorder must drain stdout before
+	// Wait closes it.
+	wait := cmd.Wait
+	if recorder != nil {
+		drained := make(chan struct{})
+		go func() {
+			recorder.run(stdout)
+			close(drained)
+		}()
+		wait = func() error {
+			<-drained
+			return cmd.Wait()
+		}
+	}
+	go pm.monitorProcess(key, capture, wait)
+
+	return nil
+}
+
+// AdoptCapture tracks a tcpdump process left behind by a previous controller
+// instance, capturing iface. The process is not our child, so its exit is
+// detected by polling. A capture with a duration is finished after the
+// remaining time.
+func (pm *ProcessManager) AdoptCapture(ctx context.Context, key string, pid int, iface, filePattern string, cfg *CaptureConfig, remaining time.Duration) error {
+	if err := pm.tryAcquire(ctx); err != nil {
+		return err
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if _, exists := pm.captures[key]; exists {
+		pm.releaseSlot()
+		return fmt.Errorf("capture already running for %s", key)
+	}
+
+	// tcpdump already runs in the Pod's network namespace, unless it
+	// captures a host veth
+	target := captureTarget{netnsPID: pid, iface: iface}
+	if iface != podInterface {
+		target.netnsPID = 0
+	}
+	captureCtx, cancel := context.WithCancel(ctx)
+	capture := &CaptureProcess{
+		pid:         pid,
+		ctx:         captureCtx,
+		cancel:      cancel,
+		target:      target,
+		release:     pm.releaseSlot,
+		filePattern: filePattern,
+		filter:      cfg.Filter,
+		priority:    cfg.Priority,
+		started:     time.Now(),
+		packetCount: cfg.PacketCount,
+	}
+	if cfg.Duration > 0 {
+		capture.timer = time.AfterFunc(max(remaining, 0), func() {
+			pm.finishCapture(key, capture, StopReasonDurationElapsed)
+		})
+	}
+	pm.captures[key] = capture
+
+	klog.InfoS("Adopted tcpdump process", "pod", key, "pid", pid)
+	if cfg.StopCondition() {
+		if err := pm.startStopWatcher(key, capture, cfg); err != nil {
+			klog.ErrorS(err, "Adopted capture runs without its stop condition", "pod", key)
+		}
+	}
+	if cfg.NodeInterfaces != "" {
+		// Their leftover processes were terminated with the previous instance
+		klog.InfoS("Adopted capture runs without its node interface captures", "pod", key)
+	}
 
+	go pm.monitorProcess(key, capture, func() error {
+		return waitForExit(captureCtx, pid)
+	})
 	return nil
 }
 
+// waitForExit polls until a process that is not our child has exited, or ctx
+// is cancelled.
+func waitForExit(ctx context.Context, pid int) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// terminateProcess asks a tcpdump process (and its group, if it leads one) to
+// exit, letting it flush its current file.
+func terminateProcess(pid int) {
+	if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+		syscall.Kill(-pid, syscall.SIGTERM)
+		return
+	}
+	syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// nsenterCommand builds a tcpdump command that runs inside the network
+// namespace of the given PID.
+func nsenterCommand(ctx context.Context, pid int, tcpdumpArgs ...string) *exec.Cmd {
+	args := append([]string{
+		"--net=" + fmt.Sprintf("/proc/%d/ns/net", pid),
+		"--",
+		"tcpdump",
+	}, tcpdumpArgs...)
+	cmd := exec.CommandContext(ctx, "nsenter", args...)
+
+	// Set process group to ensure we can kill children (tcpdump)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
 // monitorProcess waits for tcpdump to exit
-func (pm *ProcessManager) monitorProcess(key string, cmd *exec.Cmd, cancel context.CancelFunc) {
-	err := cmd.Wait()
+func (pm *ProcessManager) monitorProcess(key string, capture *CaptureProcess, wait func() error) {
+	err := wait()
 	if err != nil {
 		klog.V(2).InfoS("tcpdump process exited", "pod", key, "error", err)
 	} else {
@@ -167,26 +420,70 @@ func (pm *ProcessManager) monitorProcess(key string, cmd *exec.Cmd, cancel conte
 	}
 
 	pm.mu.Lock()
-	capture, exists := pm.captures[key]
+	// The key may already belong to a newer capture if this one was stopped.
+	exists := pm.captures[key] == capture
 	if exists {
 		delete(pm.captures, key)
 	}
+	reason := ""
+	if exists {
+		reason = capture.stopReason
+		if reason == "" && err == nil && capture.packetCount > 0 {
+			// tcpdump -c exits cleanly once it has the packets
+			reason = StopReasonPacketCountReached
+		}
+	}
 	pm.mu.Unlock()
 
 	if exists {
+		if capture.timer != nil {
+			capture.timer.Stop()
+		}
 		capture.releaseOnce.Do(capture.release)
 	}
 
-	cancel()
+	capture.cancel()
+	// Their files are complete once the session closes
+	capture.nodeCaptures.Wait()
 
 	pm.mu.Lock()
 	onExit := pm.onExit
 	pm.mu.Unlock()
 	if onExit != nil {
-		onExit(key)
+		onExit(key, capture.filePattern, reason)
 	}
 }
 
+// FinishCapture ends the running capture for key as completed, keeping its
+// files. The reason is reported to the exit callback.
+func (pm *ProcessManager) FinishCapture(key, reason string) {
+	pm.mu.Lock()
+	capture := pm.captures[key]
+	pm.mu.Unlock()
+	if capture != nil {
+		pm.finishCapture(key, capture, reason)
+	}
+}
+
+// finishCapture ends a capture that has run to completion. The process stays
+// tracked until monitorProcess sees it exit, so the reason reaches onExit and
+// tcpdump gets a chance to flush its last file.
+func (pm *ProcessManager) finishCapture(key string, capture *CaptureProcess, reason string) {
+	pm.mu.Lock()
+	current := pm.captures[key] == capture
+	if current {
+		capture.stopReason = reason
+	}
+	pm.mu.Unlock()
+
+	if !current {
+		return
+	}
+
+	klog.InfoS("Finishing capture", "pod", key, "reason", reason)
+	syscall.Kill(-capture.pid, syscall.SIGTERM)
+}
+
 // StopCapture stops a running capture and cleans up files
 func (pm *ProcessManager) StopCapture(key string) {
 	pm.mu.Lock()
@@ -202,13 +499,15 @@ func (pm *ProcessManager) StopCapture(key string) {
 
 	klog.InfoS("Stopping capture", "pod", key)
 
-	// Signal tcpdump/nsenter to stop by killing the process group
-	if capture.cmd.Process != nil {
-		// Kill the entire process group
-		syscall.Kill(-capture.cmd.Process.Pid, syscall.SIGKILL)
+	if capture.timer != nil {
+		capture.timer.Stop()
 	}
+
+	// Signal tcpdump/nsenter to stop by killing the entire process group
+	syscall.Kill(-capture.pid, syscall.SIGKILL)
 	capture.cancel()
 	capture.releaseOnce.Do(capture.release)
+	capture.nodeCaptures.Wait()
 }
 
 // CleanupCaptureFilesForPod removes pcap files for a Pod.
@@ -227,11 +526,14 @@ func (pm *ProcessManager) tryAcquire(ctx context.Context) error {
 	}
 }
 
+// releaseSlot frees a slot and starts the next pending capture. It may be
+// called with pm.mu held, so dispatching happens asynchronously.
 func (pm *ProcessManager) releaseSlot() {
 	select {
 	case <-pm.semaphore:
 	default:
 	}
+	go pm.dispatchPending()
 }
 
 // cleanupFiles removes all pcap files for a Pod
@@ -0,0 +1,227 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+// captureFileSize is the size at which tcpdump -C 1 rotates files.
+const captureFileSize = 1000000
+
+// StopReasonDiskBudgetExceeded finishes captures that would grow the capture
+// directory past its byte budget or a namespace quota.
+const StopReasonDiskBudgetExceeded = "DiskBudgetExceeded"
+
+// QuotaConfig limits the disk space and number of captures.
+type QuotaConfig struct {
+	// Budget is the total bytes capture files may occupy in the capture
+	// directory; 0 means unlimited.
+	Budget int64
+	// Namespaces holds per-namespace quotas. The "*" entry applies to
+	// namespaces without their own.
+	Namespaces map[string]NamespaceQuota
+	// CheckInterval is how often actual usage is compared to the limits.
+	CheckInterval time.Duration
+}
+
+// NamespaceQuota limits the captures of one namespace. Zero values are
+// unlimited.
+type NamespaceQuota struct {
+	MaxBytes    int64
+	MaxCaptures int
+}
+
+func (q QuotaConfig) enabled() bool {
+	return q.Budget > 0 || len(q.Namespaces) > 0
+}
+
+func (q QuotaConfig) forNamespace(namespace string) (NamespaceQuota, bool) {
+	if nq, ok := q.Namespaces[namespace]; ok {
+		return nq, true
+	}
+	nq, ok := q.Namespaces["*"]
+	return nq, ok
+}
+
+// ParseNamespaceQuota parses "<namespace>=<bytes>[/<captures>]", e.g.
+// "team-a=2Gi/3". Use "*" as the namespace for a default quota.
+func ParseNamespaceQuota(value string) (string, NamespaceQuota, error) {
+	var nq NamespaceQuota
+	namespace, limits, ok := strings.Cut(value, "=")
+	if !ok || namespace == "" {
+		return "", nq, fmt.Errorf("invalid namespace quota %q, expected <namespace>=<bytes>[/<captures>]", value)
+	}
+
+	bytesValue, countValue, hasCount := strings.Cut(limits, "/")
+	q, err := resource.ParseQuantity(bytesValue)
+	if err != nil {
+		return "", nq, fmt.Errorf("invalid byte limit in namespace quota %q: %w", value, err)
+	}
+	nq.MaxBytes = q.Value()
+	if hasCount {
+		if nq.MaxCaptures, err = strconv.Atoi(countValue); err != nil || nq.MaxCaptures < 0 {
+			return "", nq, fmt.Errorf("invalid capture limit in namespace quota %q", value)
+		}
+	}
+	return namespace, nq, nil
+}
+
+// SetQuota configures disk budgets and namespace quotas. It must be called
+// before Run.
+func (c *Controller) SetQuota(quota QuotaConfig) {
+	c.quota = quota
+}
+
+// captureReservation is the most disk space a capture can occupy. Each node
+// interface capture rotates through as many files as the Pod's.
+func captureReservation(cfg *CaptureConfig) int64 {
+	captures := 1
+	if cfg.NodeInterfaces != "" {
+		captures += len(strings.Split(cfg.NodeInterfaces, ","))
+	}
+	return int64(captures*cfg.MaxFiles) * captureFileSize
+}
+
+// filesSize sums the sizes of files matching pattern.
+func filesSize(pattern string) int64 {
+	matches, _ := filepath.Glob(pattern)
+	var total int64
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// admitCapture refuses a new capture that could push the capture directory
+// past its budget or its namespace past its quota. Space is counted as what
+// is already on disk plus what running captures may still write.
+func (c *Controller) admitCapture(key, namespace string, cfg *CaptureConfig) error {
+	if !c.quota.enabled() {
+		return nil
+	}
+
+	reservation := captureReservation(cfg)
+	nq, hasNamespaceQuota := c.quota.forNamespace(namespace)
+
+	var headroom, namespaceBytes int64
+	namespaceCaptures := 0
+	for otherKey, state := range c.captureStates() {
+		if otherKey == key {
+			continue
+		}
+		used := filesSize(state.filePattern)
+		running := state.stopReason == ""
+		if running {
+			headroom += max(captureReservation(state.config)-used, 0)
+		}
+		if keyNamespace(otherKey) == namespace {
+			namespaceBytes += max(captureReservation(state.config), used)
+			if running {
+				namespaceCaptures++
+			}
+		}
+	}
+
+	if c.quota.Budget > 0 {
+		usage := c.captureDirUsage()
+		if projected := usage + headroom + reservation; projected > c.quota.Budget {
+			return newRefusedError("capture needs up to %s but only %s of the %s capture budget is left",
+				formatBytes(reservation), formatBytes(max(c.quota.Budget-usage-headroom, 0)), formatBytes(c.quota.Budget))
+		}
+	}
+	if hasNamespaceQuota {
+		if nq.MaxCaptures > 0 && namespaceCaptures+1 > nq.MaxCaptures {
+			return newRefusedError("namespace %s already has %d of %d allowed captures", namespace, namespaceCaptures, nq.MaxCaptures)
+		}
+		if nq.MaxBytes > 0 && namespaceBytes+reservation > nq.MaxBytes {
+			return newRefusedError("capture needs up to %s but namespace %s has %s of its %s quota left",
+				formatBytes(reservation), namespace, formatBytes(max(nq.MaxBytes-namespaceBytes, 0)), formatBytes(nq.MaxBytes))
+		}
+	}
+	return nil
+}
+
+// enforceQuota finishes captures that can still grow once actual usage has
+// crossed the budget or a namespace quota. Captures that have filled their
+// rotation no longer take more space and keep running. Files are kept.
+func (c *Controller) enforceQuota(ctx context.Context) {
+	type growing struct {
+		key  string
+		used int64
+	}
+	var candidates []growing
+	namespaceUsage := make(map[string]int64)
+
+	for key, state := range c.captureStates() {
+		used := filesSize(state.filePattern)
+		namespaceUsage[keyNamespace(key)] += used
+		if state.stopReason == "" && used < captureReservation(state.config) {
+			candidates = append(candidates, growing{key: key, used: used})
+		}
+	}
+	// Stop the largest first so the log shows the biggest consumers.
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].used > candidates[j].used })
+
+	overBudget := false
+	if c.quota.Budget > 0 {
+		usage := c.captureDirUsage()
+		overBudget = usage > c.quota.Budget
+		if overBudget {
+			klog.InfoS("Capture directory is over budget", "usage", usage, "budget", c.quota.Budget)
+		}
+	}
+
+	for _, g := range candidates {
+		namespace := keyNamespace(g.key)
+		nq, ok := c.quota.forNamespace(namespace)
+		overNamespace := ok && nq.MaxBytes > 0 && namespaceUsage[namespace] > nq.MaxBytes
+		if !overBudget && !overNamespace {
+			continue
+		}
+		klog.InfoS("Stopping capture to stay within disk limits", "pod", g.key, "usedBytes", g.used,
+			"overBudget", overBudget, "overNamespaceQuota", overNamespace)
+		c.processManager.FinishCapture(g.key, StopReasonDiskBudgetExceeded)
+	}
+}
+
+// captureStates returns a snapshot of the tracked captures.
+func (c *Controller) captureStates() map[string]*CaptureState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := make(map[string]*CaptureState, len(c.activeCaptures))
+	for key, state := range c.activeCaptures {
+		copied := *state
+		states[key] = &copied
+	}
+	return states
+}
+
+func keyNamespace(key string) string {
+	namespace, _, _ := strings.Cut(key, "/")
+	return namespace
+}
+
+// formatBytes renders n with a binary unit, e.g. "4.8Mi".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ci", float64(n)/float64(div), "KMGTPE"[exp])
+}
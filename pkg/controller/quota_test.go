@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdmitCapture(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "capture-web.pcap0"), make([]byte, captureFileSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Controller{
+		naming:     defaultFileNaming,
+		captureDir: dir,
+		activeCaptures: map[string]*CaptureState{
+			"team-a/web": {
+				filePattern: filepath.Join(dir, "capture-web.pcap*"),
+				config:      &CaptureConfig{MaxFiles: 3},
+			},
+		},
+		quota: QuotaConfig{
+			Budget: 5 * captureFileSize,
+			Namespaces: map[string]NamespaceQuota{
+				"team-a": {MaxCaptures: 1},
+				"*":      {MaxBytes: 2 * captureFileSize},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		key         string
+		maxFiles    int
+		wantRefused bool
+	}{
+		// 1MB on disk + 2MB the running capture may still write + 2MB.
+		{name: "fits budget", key: "team-b/db", maxFiles: 2},
+		{name: "exceeds budget", key: "team-c/db", maxFiles: 3, wantRefused: true},
+		{name: "exceeds namespace count", key: "team-a/db", maxFiles: 1, wantRefused: true},
+		{name: "restart of same capture", key: "team-a/web", maxFiles: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.admitCapture(tt.key, keyNamespace(tt.key), &CaptureConfig{MaxFiles: tt.maxFiles})
+			var te *terminalError
+			refused := errors.As(err, &te) && te.phase == CaptureRefused
+			if refused != tt.wantRefused {
+				t.Errorf("admitCapture() = %v, wantRefused %v", err, tt.wantRefused)
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package controller
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/packet"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+// ErrNotFlightRecorder indicates a trigger for a capture that is not a flight
+// recorder.
+var ErrNotFlightRecorder = errors.New("capture is not a flight recorder")
+
+// DefaultFlightRecorderBudget bounds the buffers of all flight recorders of
+// the controller together. It leaves 128Mi of the 192Mi memory limit of the
+// DaemonSet in deploy/ to the controller itself.
+const DefaultFlightRecorderBudget = 64 << 20
+
+// recordOverhead approximates the memory a buffered packet takes besides its
+// data: the pcap.Record, its slot in the buffer and allocation rounding.
+// Buffer bounds count it, so many small packets cannot exceed them.
+const recordOverhead = 96
+
+// flightRecorderArgs are the tcpdump arguments of a flight recorder, which
+// writes unbuffered pcap to stdout for the controller to buffer.
+var flightRecorderArgs = []string{"-U", "-w", "-", "-Z", "root"}
+
+// flightRecorder keeps the last packets of a capture in memory. A trigger
+// writes them to the next capture file, followed by the packets of the
+// post-trigger window, and then buffering starts over. Nothing is written
+// to disk until a trigger.
+type flightRecorder struct {
+	key         string
+	outputFile  string
+	maxFiles    int
+	window      time.Duration
+	maxBytes    int64
+	postTrigger time.Duration
+	match       *packet.Predicate
+	// onChange is called after a trigger or when a dump completes.
+	onChange func()
+	now      func() time.Time
+
+	mu       sync.Mutex
+	header   *pcap.FileHeader // set once tcpdump wrote it
+	buffer   []*pcap.Record
+	bufBytes int64
+	dump     *recorderDump
+	dumps    int
+	trigger  string // what triggered the last dump
+	closed   bool
+}
+
+// recorderDump is a capture file being written after a trigger.
+type recorderDump struct {
+	path   string
+	file   *os.File
+	buf    *bufio.Writer
+	writer *pcap.Writer
+	timer  *time.Timer
+	until  time.Time
+}
+
+// RecorderStatus describes a flight recorder.
+type RecorderStatus struct {
+	// Dumps is the number of triggers written to files.
+	Dumps int
+	// Recording is set during a post-trigger window.
+	Recording bool
+	// Trigger describes what triggered the last dump.
+	Trigger string
+}
+
+func newFlightRecorder(key, outputFile string, cfg *CaptureConfig, onChange func()) (*flightRecorder, error) {
+	r := &flightRecorder{
+		key:         key,
+		outputFile:  outputFile,
+		maxFiles:    cfg.MaxFiles,
+		window:      cfg.BufferDuration,
+		maxBytes:    cfg.BufferBytes,
+		postTrigger: cfg.PostTrigger,
+		onChange:    onChange,
+		now:         time.Now,
+	}
+	if cfg.TriggerMatch != "" {
+		match, err := packet.ParsePredicate(cfg.TriggerMatch)
+		if err != nil {
+			return nil, err
+		}
+		r.match = match
+	}
+	return r, nil
+}
+
+// run buffers the pcap stream from r until it ends, then finishes any dump in
+// progress.
+func (r *flightRecorder) run(in io.Reader) {
+	defer r.close()
+	reader, err := pcap.NewReader(in)
+	if err != nil {
+		klog.ErrorS(err, "Flight recorder got no capture", "pod", r.key)
+		return
+	}
+	hdr := reader.Header()
+	r.mu.Lock()
+	r.header = &hdr
+	r.mu.Unlock()
+
+	for {
+		rec, err := reader.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				klog.V(2).InfoS("Flight recorder stream ended", "pod", r.key, "error", err)
+			}
+			return
+		}
+		r.add(rec)
+	}
+}
+
+// add buffers a packet, or writes it to the dump in progress.
+func (r *flightRecorder) add(rec *pcap.Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dump != nil {
+		if err := r.dump.writer.WriteRecord(rec); err != nil {
+			klog.ErrorS(err, "Failed to write flight recorder dump", "pod", r.key, "file", r.dump.path)
+			r.finishDumpLocked()
+		}
+		return
+	}
+
+	r.buffer = append(r.buffer, rec)
+	r.bufBytes += recordSize(rec)
+	r.evictLocked()
+
+	if r.match != nil {
+		if p, err := packet.Decode(r.header.LinkType, rec.Data); err == nil && r.match.Match(p) {
+			r.startDumpLocked("packet " + p.String())
+		}
+	}
+}
+
+// evictLocked drops the oldest packets beyond the buffer's bounds.
+func (r *flightRecorder) evictLocked() {
+	n := 0
+	for n < len(r.buffer)-1 {
+		oldest := r.buffer[n]
+		tooOld := r.window > 0 && r.now().Sub(oldest.Timestamp) > r.window
+		if !tooOld && r.bufBytes <= r.maxBytes {
+			break
+		}
+		r.bufBytes -= recordSize(oldest)
+		n++
+	}
+	if n > 0 {
+		clear(r.buffer[:n])
+		r.buffer = r.buffer[n:]
+	}
+}
+
+// recordSize is the memory a buffered packet takes.
+func recordSize(rec *pcap.Record) int64 {
+	return int64(len(rec.Data)) + recordOverhead
+}
+
+// Trigger dumps the buffer, or extends the post-trigger window of a dump in
+// progress.
+func (r *flightRecorder) Trigger(reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrNoCapture
+	}
+	if r.header == nil {
+		return fmt.Errorf("flight recorder has not started yet")
+	}
+	if r.dump != nil {
+		r.dump.until = r.now().Add(r.postTrigger)
+		r.dump.timer.Reset(r.postTrigger)
+		r.trigger = reason
+		return nil
+	}
+	return r.startDumpLocked(reason)
+}
+
+// startDumpLocked writes the buffer to the next capture file, reusing the
+// oldest once maxFiles were written, and keeps the file open for the
+// post-trigger window.
+func (r *flightRecorder) startDumpLocked(reason string) error {
+	path := r.outputFile + strconv.Itoa(r.dumps%r.maxFiles)
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create flight recorder dump: %w", err)
+	}
+	d := &recorderDump{path: path, file: f, buf: bufio.NewWriter(f)}
+	d.writer, err = pcap.NewWriter(d.buf, *r.header)
+	for _, rec := range r.buffer {
+		if err != nil {
+			break
+		}
+		err = d.writer.WriteRecord(rec)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write flight recorder dump: %w", err)
+	}
+
+	klog.InfoS("Flight recorder triggered", "pod", r.key, "trigger", reason, "file", path, "packets", len(r.buffer), "postTrigger", r.postTrigger)
+	clear(r.buffer)
+	r.buffer = r.buffer[:0]
+	r.bufBytes = 0
+	r.dumps++
+	r.trigger = reason
+	d.until = r.now().Add(r.postTrigger)
+	d.timer = time.AfterFunc(r.postTrigger, r.finishDump)
+	r.dump = d
+	go r.onChange()
+	return nil
+}
+
+// finishDump closes the dump once its post-trigger window is over.
+func (r *flightRecorder) finishDump() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dump != nil && !r.now().Before(r.dump.until) {
+		r.finishDumpLocked()
+	}
+}
+
+func (r *flightRecorder) finishDumpLocked() {
+	d := r.dump
+	r.dump = nil
+	d.timer.Stop()
+	err := d.buf.Flush()
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		klog.ErrorS(err, "Failed to finish flight recorder dump", "pod", r.key, "file", d.path)
+	} else {
+		klog.InfoS("Flight recorder dump complete", "pod", r.key, "file", d.path)
+	}
+	go r.onChange()
+}
+
+// close finishes the dump in progress and drops the buffer.
+func (r *flightRecorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.dump != nil {
+		r.finishDumpLocked()
+	}
+	r.buffer = nil
+	r.bufBytes = 0
+}
+
+// Status reports the recorder's dumps.
+func (r *flightRecorder) Status() RecorderStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return RecorderStatus{Dumps: r.dumps, Recording: r.dump != nil, Trigger: r.trigger}
+}
+
+// SetFlightRecorderBudget bounds the buffers of all flight recorders
+// together, DefaultFlightRecorderBudget if not called; 0 is unlimited. It must
+// be called before Run.
+func (c *Controller) SetFlightRecorderBudget(budget int64) {
+	c.recorderBudget = budget
+}
+
+// admitFlightRecorder refuses a flight recorder whose buffer does not fit
+// in the budget beside those of the flight recorders running or queued.
+func (c *Controller) admitFlightRecorder(key string, cfg *CaptureConfig) error {
+	if !cfg.FlightRecorder() || c.recorderBudget <= 0 {
+		return nil
+	}
+	used := c.processManager.recorderBytes(key)
+	if used+cfg.BufferBytes > c.recorderBudget {
+		return newRefusedError("flight recorder needs up to %s of memory but only %s of the %s flight recorder budget is left",
+			formatBytes(cfg.BufferBytes), formatBytes(max(c.recorderBudget-used, 0)), formatBytes(c.recorderBudget))
+	}
+	return nil
+}
+
+// recorderBytes sums the buffer bounds of the flight recorders running or
+// queued, other than key's.
+func (pm *ProcessManager) recorderBytes(except string) int64 {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	var total int64
+	for key, capture := range pm.captures {
+		if key != except && capture.recorder != nil {
+			total += capture.recorder.maxBytes
+		}
+	}
+	for _, key := range pm.pending.order() {
+		if item := pm.pending.find(key); key != except && item.config.FlightRecorder() {
+			total += item.config.BufferBytes
+		}
+	}
+	return total
+}
+
+// TriggerRecorder triggers the flight recorder of the running capture key.
+func (pm *ProcessManager) TriggerRecorder(key, reason string) error {
+	pm.mu.Lock()
+	capture := pm.captures[key]
+	pm.mu.Unlock()
+	if capture == nil {
+		return ErrNoCapture
+	}
+	if capture.recorder == nil {
+		return ErrNotFlightRecorder
+	}
+	return capture.recorder.Trigger(reason)
+}
+
+// RecorderStatus returns the status of the flight recorder of the running
+// capture key, if it is one.
+func (pm *ProcessManager) RecorderStatus(key string) (RecorderStatus, bool) {
+	pm.mu.Lock()
+	capture := pm.captures[key]
+	pm.mu.Unlock()
+	if capture == nil || capture.recorder == nil {
+		return RecorderStatus{}, false
+	}
+	return capture.recorder.Status(), true
+}
+
+// checkRecorderTrigger triggers the flight recorder of the Pod key when the
+// Pod's TriggerAnnotationKey changed since the last sync. The value at the
+// first sync after the recorder started only becomes the baseline.
+func (c *Controller) checkRecorderTrigger(key string, pod *corev1.Pod) {
+	value := pod.Annotations[TriggerAnnotationKey]
+	c.mu.Lock()
+	state := c.activeCaptures[key]
+	if state == nil || !state.config.FlightRecorder() || state.stopReason != "" {
+		c.mu.Unlock()
+		return
+	}
+	last := state.trigger
+	state.trigger = &value
+	c.mu.Unlock()
+	if last == nil || *last == value {
+		return
+	}
+
+	if err := c.processManager.TriggerRecorder(key, "annotation "+value); err != nil {
+		klog.ErrorS(err, "Failed to trigger flight recorder", "pod", key)
+		c.recorder.Eventf(pod, corev1.EventTypeWarning, EventReasonCaptureNotStarted, "Flight recorder was not triggered: %v", err)
+	}
+}
+
+// recorderMessage describes a running flight recorder in the capture status.
+func recorderMessage(rs RecorderStatus) string {
+	switch {
+	case rs.Recording:
+		return fmt.Sprintf("flight recorder writing after trigger %d (%s)", rs.Dumps, rs.Trigger)
+	case rs.Dumps > 0:
+		return fmt.Sprintf("flight recorder buffering, %d triggers written, last %s", rs.Dumps, rs.Trigger)
+	default:
+		return "flight recorder buffering"
+	}
+}
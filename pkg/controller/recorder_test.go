@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+// rstFrame is an Ethernet/IPv4/TCP RST from 10.0.0.5:5432 to 10.0.0.6:40000.
+var rstFrame = []byte{
+	0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 1, 0x08, 0x00,
+	0x45, 0, 0, 40, 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 5, 10, 0, 0, 6,
+	0x15, 0x38, 0x9c, 0x40, 0, 0, 0, 0, 0, 0, 0, 0, 0x50, 0x04, 0, 0, 0, 0, 0, 0,
+}
+
+func TestFlightRecorder(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	outputFile := filepath.Join(t.TempDir(), "capture.pcap")
+	cfg := &CaptureConfig{MaxFiles: 2, BufferDuration: 10 * time.Second, BufferBytes: 1 << 20, PostTrigger: time.Hour, TriggerMatch: "tcp.flags=rst"}
+	r, err := newFlightRecorder("default/db", outputFile, cfg, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.now = func() time.Time { return now }
+
+	var stream bytes.Buffer
+	w, _ := pcap.NewWriter(&stream, pcap.DefaultHeader())
+	for _, rec := range []*pcap.Record{
+		{Timestamp: now.Add(-time.Minute), Data: []byte{1}}, // older than the window
+		{Timestamp: now.Add(-5 * time.Second), Data: []byte{2}},
+		{Timestamp: now.Add(-time.Second), Data: []byte{3}},
+		{Timestamp: now, Data: rstFrame}, // triggers
+		{Timestamp: now.Add(time.Second), Data: []byte{4}},
+	} {
+		w.WriteRecord(rec)
+	}
+	r.run(&stream)
+
+	status := r.Status()
+	if status.Dumps != 1 || status.Recording || status.Trigger != "packet tcp 10.0.0.5:5432 > 10.0.0.6:40000 [RST]" {
+		t.Errorf("status = %+v", status)
+	}
+	f, err := os.Open(outputFile + "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pr, err := pcap.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for {
+		rec, err := pr.Next()
+		if err != nil {
+			break
+		}
+		got = append(got, rec.Data[0])
+	}
+	if want := []byte{2, 3, 0, 4}; !bytes.Equal(got, want) {
+		t.Errorf("dumped packets starting with %v, want %v", got, want)
+	}
+
+	if err := r.Trigger("API"); err != ErrNoCapture {
+		t.Errorf("Trigger after the capture ended = %v", err)
+	}
+}
+
+func TestParseFlightRecorder(t *testing.T) {
+	for value, want := range map[string]CaptureConfig{
+		"30s":      {BufferDuration: 30 * time.Second, BufferBytes: DefaultFlightRecorderBytes},
+		"8Mi":      {BufferBytes: 8 << 20},
+		"1m, 64Mi": {BufferDuration: time.Minute, BufferBytes: 64 << 20},
+	} {
+		cfg, err := ParseCaptureConfig(map[string]string{AnnotationKey: "1", FlightRecorderAnnotationKey: value})
+		if err != nil {
+			t.Errorf("%q: %v", value, err)
+			continue
+		}
+		if cfg.BufferDuration != want.BufferDuration || cfg.BufferBytes != want.BufferBytes || cfg.PostTrigger != DefaultPostTrigger {
+			t.Errorf("%q: got %+v", value, cfg)
+		}
+	}
+	for _, annotations := range []map[string]string{
+		{AnnotationKey: "1", FlightRecorderAnnotationKey: "soon"},
+		{AnnotationKey: "1", FlightRecorderAnnotationKey: "1Gi"},
+		{AnnotationKey: "1", TriggerMatchAnnotationKey: "tcp.flags=rst"},
+		{AnnotationKey: "1", FlightRecorderAnnotationKey: "30s", TriggerMatchAnnotationKey: "tcp.flags=bogus"},
+	} {
+		if _, err := ParseCaptureConfig(annotations); err == nil {
+			t.Errorf("%v: want error", annotations)
+		}
+	}
+}
+
+func TestFlightRecorderBudget(t *testing.T) {
+	pm := NewProcessManager(2, t.TempDir(), "")
+	pm.captures["default/a"] = &CaptureProcess{recorder: &flightRecorder{maxBytes: 48 << 20}}
+	pm.captures["default/b"] = &CaptureProcess{}
+	c := &Controller{processManager: pm, recorderBudget: DefaultFlightRecorderBudget}
+
+	recorder := &CaptureConfig{MaxFiles: 1, BufferBytes: DefaultFlightRecorderBytes}
+	if err := c.admitFlightRecorder("default/c", recorder); err != nil {
+		t.Errorf("recorder that fits refused: %v", err)
+	}
+	recorder.BufferBytes++
+	var te *terminalError
+	if err := c.admitFlightRecorder("default/c", recorder); !errors.As(err, &te) || te.phase != CaptureRefused {
+		t.Errorf("recorder over the budget admitted: %v", err)
+	}
+	// Restarting a recorder does not count its own buffer
+	if err := c.admitFlightRecorder("default/a", &CaptureConfig{MaxFiles: 1, BufferBytes: MaxFlightRecorderBytes}); err != nil {
+		t.Errorf("restarted recorder refused: %v", err)
+	}
+
+	// Per-packet overhead counts toward the buffer bound
+	r := &flightRecorder{maxBytes: 10 * (1 + recordOverhead), now: time.Now, header: &pcap.FileHeader{}}
+	for i := 0; i < 100; i++ {
+		r.add(&pcap.Record{Timestamp: time.Now(), Data: []byte{byte(i)}})
+	}
+	if len(r.buffer) != 10 {
+		t.Errorf("buffered %d one-byte packets, want 10", len(r.buffer))
+	}
+}
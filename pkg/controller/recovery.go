@@ -0,0 +1,324 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// procRoot is where process information is read from. The DaemonSet mounts
+// the host's /proc there and runs with hostPID.
+var procRoot = "/proc"
+
+// captureMarkerEnv is set in the environment of every tcpdump the controller
+// starts, to the capture directory: those writing capture files and those
+// feeding live streams and stop conditions. Recovery only adopts or terminates
+// processes that carry it, so an operator's own tcpdump writing next to the
+// captures is never touched.
+const captureMarkerEnv = "PACKET_CAPTURE_DIR"
+
+// markCapture sets the recovery marker on a tcpdump command.
+func markCapture(cmd *exec.Cmd, captureDir string) {
+	cmd.Env = append(os.Environ(), captureMarkerEnv+"="+filepath.Clean(captureDir))
+}
+
+// hasCaptureMarker reports whether the process pid was started by a
+// controller writing into captureDir. Processes started before the marker
+// existed do not carry it and are left alone.
+func hasCaptureMarker(pid, captureDir string) bool {
+	raw, err := os.ReadFile(filepath.Join(procRoot, pid, "environ"))
+	if err != nil {
+		return false
+	}
+	want := captureMarkerEnv + "=" + filepath.Clean(captureDir)
+	for _, env := range strings.Split(string(raw), "\x00") {
+		if env == want {
+			return true
+		}
+	}
+	return false
+}
+
+// leftoverCapture is a tcpdump process writing into the capture directory that
+// this controller instance did not start.
+type leftoverCapture struct {
+	pid        int
+	outputFile string
+	maxFiles   int
+	filter     string
+	iface      string
+	count      int
+}
+
+// findLeftoverCaptures scans procRoot for tcpdump processes writing capture
+// files into captureDir or one of its session directories, or to a stream,
+// that a controller started, as their marker shows.
+func findLeftoverCaptures(captureDir string) []leftoverCapture {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		klog.ErrorS(err, "Failed to list processes", "dir", procRoot)
+		return nil
+	}
+
+	self := os.Getpid()
+	var found []leftoverCapture
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(procRoot, e.Name(), "cmdline"))
+		if err != nil || len(raw) == 0 {
+			continue
+		}
+		args := strings.Split(string(bytes.TrimRight(raw, "\x00")), "\x00")
+		if lc, ok := parseTcpdumpArgs(args, captureDir); ok && hasCaptureMarker(e.Name(), captureDir) {
+			lc.pid = pid
+			found = append(found, lc)
+		}
+	}
+	return found
+}
+
+// parseTcpdumpArgs recognises the command line doStartCapture runs and
+// extracts the capture it belongs to.
+func parseTcpdumpArgs(args []string, captureDir string) (leftoverCapture, bool) {
+	var lc leftoverCapture
+	if len(args) == 0 || filepath.Base(args[0]) != "tcpdump" {
+		return lc, false
+	}
+
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "-w":
+			if i+1 < len(args) {
+				lc.outputFile = args[i+1]
+				i++
+			}
+		case "-i":
+			if i+1 < len(args) {
+				lc.iface = args[i+1]
+				i++
+			}
+		case "-W":
+			if i+1 < len(args) {
+				lc.maxFiles, _ = strconv.Atoi(args[i+1])
+				i++
+			}
+		case "-c":
+			if i+1 < len(args) {
+				lc.count, _ = strconv.Atoi(args[i+1])
+				i++
+			}
+		case "--":
+			lc.filter = strings.Join(args[i+1:], " ")
+			i = len(args)
+		}
+	}
+
+	if lc.outputFile == "" {
+		return lc, false
+	}
+	// A live stream or stop condition; its reader went with the controller
+	if lc.outputFile == "-" {
+		return lc, true
+	}
+	if lc.iface == "" {
+		lc.iface = podInterface
+	}
+	// Sessions write into a directory of their own; earlier versions wrote
+	// into the capture directory itself.
+	dir := filepath.Clean(filepath.Dir(lc.outputFile))
+	if dir != filepath.Clean(captureDir) && filepath.Dir(dir) != filepath.Clean(captureDir) {
+		return lc, false
+	}
+	return lc, true
+}
+
+// recoverCaptures reconciles what a previous controller instance left on the
+// node. It runs after the caches sync and before the workers start.
+//
+// Leftover tcpdump processes that carry captureMarkerEnv are adopted when their Pod still requests the
+// same capture and terminated otherwise; the manifests of sessions that were
+// not adopted are marked as interrupted. Files written directly into the
+// capture directory by earlier versions are moved into session directories.
+// Captures whose status says they completed are remembered so they are not
+// started again. Every new session writes a new directory, so other sessions
+// are left for their Pod's cleanup or the garbage collector.
+func (c *Controller) recoverCaptures(ctx context.Context) {
+	localPods, err := c.localPodsByName()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list Pods for capture recovery")
+		return
+	}
+
+	// Keyed by session directory, or by base name for flat files
+	adopted := make(map[string]bool)
+	for _, lc := range findLeftoverCaptures(c.captureDir) {
+		if f, ok := c.parseCaptureFile(lc.outputFile); ok && c.adoptCapture(ctx, lc, fileOwner(f, localPods)) {
+			adopted[f.base] = true
+			adopted[filepath.Dir(lc.outputFile)] = true
+			continue
+		}
+		klog.InfoS("Terminating leftover capture process", "pid", lc.pid, "file", lc.outputFile)
+		terminateProcess(lc.pid)
+	}
+
+	files, err := c.listCaptureFiles()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list capture files for recovery")
+		return
+	}
+	var unowned []captureFile
+	for _, f := range files {
+		if !adopted[f.base] {
+			unowned = append(unowned, f)
+		}
+	}
+	migrated := c.migrateFlatFiles(unowned, localPods)
+
+	sessions, err := c.listSessions()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list capture sessions for recovery")
+		return
+	}
+	for _, s := range sessions {
+		if s.metadata == nil || s.metadata.StopTime != nil || adopted[s.path] {
+			continue
+		}
+		if _, err := c.updateSession(s.path, StopReasonInterrupted); err != nil {
+			klog.ErrorS(err, "Failed to update session metadata", "dir", s.path)
+		}
+	}
+
+	for _, pods := range localPods {
+		for _, pod := range pods {
+			c.recoverCompleted(pod, migrated)
+		}
+	}
+}
+
+// adoptCapture takes over a leftover tcpdump if its Pod still requests the
+// same capture.
+func (c *Controller) adoptCapture(ctx context.Context, lc leftoverCapture, pod *corev1.Pod) bool {
+	if pod == nil {
+		return false
+	}
+	key := podKey(pod)
+
+	cfg, _, err := c.podCaptureConfig(pod)
+	if err != nil || cfg == nil || cfg.MaxFiles != lc.maxFiles || cfg.Filter != lc.filter || cfg.PacketCount != lc.count {
+		return false
+	}
+
+	startTime := metav1.Now()
+	if status, err := ParseCaptureStatus(pod.Annotations); err == nil && status != nil && status.StartTime != nil {
+		startTime = *status.StartTime
+	}
+	remaining := time.Until(startTime.Add(cfg.Duration))
+
+	filePattern := lc.outputFile + "*"
+	if err := c.processManager.AdoptCapture(ctx, key, lc.pid, lc.iface, filePattern, cfg, remaining); err != nil {
+		klog.ErrorS(err, "Failed to adopt capture", "pod", key, "pid", lc.pid)
+		return false
+	}
+
+	state := &CaptureState{
+		fileLocation: lc.outputFile,
+		filePattern:  filePattern,
+		sessionDir:   c.sessionDirOf(lc.outputFile),
+		config:       cfg,
+		containerID:  firstContainerID(pod),
+		uid:          string(pod.UID),
+		startTime:    startTime,
+	}
+	c.mu.Lock()
+	c.activeCaptures[key] = state
+	c.mu.Unlock()
+
+	klog.InfoS("Adopted running capture", "pod", key, "pid", lc.pid)
+	return true
+}
+
+// recoverCompleted remembers a capture that finished before the restart, so
+// it is not started again. migrated maps the base names of files moved into
+// session directories to their new paths.
+func (c *Controller) recoverCompleted(pod *corev1.Pod, migrated map[string]string) {
+	key := podKey(pod)
+	if c.getCaptureState(key) != nil {
+		return
+	}
+	cfg, _, err := c.podCaptureConfig(pod)
+	if err != nil || cfg == nil {
+		return
+	}
+	status, _ := ParseCaptureStatus(pod.Annotations)
+	if status == nil || status.Phase != CaptureCompleted || status.Files == "" {
+		return
+	}
+
+	fileLocation := strings.TrimSuffix(status.Files, "*")
+	if newLocation, ok := migrated[filepath.Base(fileLocation)]; ok {
+		fileLocation = newLocation
+	}
+	if matches, _ := filepath.Glob(fileLocation + "*"); len(matches) == 0 {
+		return
+	}
+
+	state := &CaptureState{
+		fileLocation: fileLocation,
+		filePattern:  fileLocation + "*",
+		sessionDir:   c.sessionDirOf(fileLocation),
+		config:       cfg,
+		containerID:  firstContainerID(pod),
+		uid:          string(pod.UID),
+		stopReason:   status.Message,
+	}
+	if status.StartTime != nil {
+		state.startTime = *status.StartTime
+	}
+	c.mu.Lock()
+	c.activeCaptures[key] = state
+	c.mu.Unlock()
+	klog.InfoS("Recovered completed capture", "pod", key)
+}
+
+// localPodsByName indexes the Pods on this node by name. Legacy capture files
+// are named after the Pod only, so a name may match Pods in several
+// namespaces.
+func (c *Controller) localPodsByName() (map[string][]*corev1.Pod, error) {
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string][]*corev1.Pod)
+	for _, pod := range pods {
+		if pod.Spec.NodeName == c.nodeName {
+			byName[pod.Name] = append(byName[pod.Name], pod)
+		}
+	}
+	return byName, nil
+}
+
+// firstContainerID returns the ID of the container captures are taken from.
+func firstContainerID(pod *corev1.Pod) string {
+	if len(pod.Spec.Containers) == 0 {
+		return ""
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name == pod.Spec.Containers[0].Name {
+			return cs.ContainerID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFindLeftoverCaptures(t *testing.T) {
+	originalProcRoot := procRoot
+	defer func() { procRoot = originalProcRoot }()
+	procRoot = t.TempDir()
+
+	writeCmdline := func(pid string, args ...string) {
+		dir := filepath.Join(procRoot, pid)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := strings.Join(args, "\x00") + "\x00"
+		if err := os.WriteFile(filepath.Join(dir, "cmdline"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMarker := func(pid, dir string) {
+		data := "PATH=/usr/bin\x00" + captureMarkerEnv + "=" + dir + "\x00"
+		if err := os.WriteFile(filepath.Join(procRoot, pid, "environ"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeCmdline("100", "tcpdump", "-C", "1", "-W", "3", "-w", "/captures/capture-web.pcap", "-i", "eth0", "-Z", "root", "--", "tcp port 80")
+	writeCmdline("101", "tcpdump", "-U", "-w", "-", "-i", "eth0")                               // live stream
+	writeCmdline("102", "tcpdump", "-W", "2", "-w", "/elsewhere/capture-db.pcap", "-i", "eth0") // other directory
+	writeCmdline("103", "/usr/bin/sleep", "100")
+	writeCmdline("104", "tcpdump", "-W", "2", "-w", "/captures/capture-a_b_1_20260301T123000Z/capture-a_b_1_20260301T123000Z.pcap", "-i", "b-9f86d0") // session directory, host veth
+	// An operator's, without the marker
+	writeCmdline("105", "tcpdump", "-w", "/captures/debug.pcap", "-i", "eth0")
+	writeCmdline("106", "tcpdump", "-W", "2", "-w", "/captures/capture-other.pcap", "-i", "eth0")
+	for _, pid := range []string{"100", "101", "102", "104"} {
+		writeMarker(pid, "/captures")
+	}
+	writeMarker("106", "/other-captures") // another controller's
+	os.MkdirAll(filepath.Join(procRoot, "self"), 0755)
+
+	found := findLeftoverCaptures("/captures")
+	if len(found) != 3 {
+		t.Fatalf("expected 3 leftover captures, got %+v", found)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].pid < found[j].pid })
+	want := leftoverCapture{pid: 100, outputFile: "/captures/capture-web.pcap", maxFiles: 3, filter: "tcp port 80", iface: "eth0"}
+	if found[0] != want {
+		t.Errorf("got %+v, want %+v", found[0], want)
+	}
+	if found[1].pid != 101 || found[1].outputFile != "-" {
+		t.Errorf("expected the live stream, got %+v", found[1])
+	}
+	if found[2].pid != 104 || found[2].iface != "b-9f86d0" {
+		t.Errorf("expected the host veth capture writing into a session directory, got %+v", found[2])
+	}
+}
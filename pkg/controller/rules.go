@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// CaptureRulesKey is the ConfigMap key holding the capture rules.
+const CaptureRulesKey = "rules.yaml"
+
+// CaptureRule requests a capture of every Pod it selects, including Pods
+// created after the rule, so a Deployment can be captured without annotating
+// each replica.
+type CaptureRule struct {
+	Name string
+	// Namespaces, if not empty, lists the only namespaces the rule applies
+	// to.
+	Namespaces []string
+	Selector   labels.Selector
+	Config     CaptureConfig
+}
+
+// Matches reports whether the rule selects pod.
+func (r *CaptureRule) Matches(pod *corev1.Pod) bool {
+	if len(r.Namespaces) > 0 && !slices.Contains(r.Namespaces, pod.Namespace) {
+		return false
+	}
+	return r.Selector.Matches(labels.Set(pod.Labels))
+}
+
+// captureRulesFile is the format of the rules ConfigMap key, e.g.
+//
+//	rules:
+//	- name: web-incident
+//	  namespaces: [shop]
+//	  selector: app=web
+//	  files: 5
+//	  filter: tcp port 443
+//	  duration: 10m
+//
+// Trigger rules, described with triggerRuleSpec, may follow under triggers.
+type captureRulesFile struct {
+	Rules    []captureRuleSpec `json:"rules"`
+	Triggers []triggerRuleSpec `json:"triggers,omitempty"`
+}
+
+type captureRuleSpec struct {
+	Name         string   `json:"name"`
+	Namespaces   []string `json:"namespaces,omitempty"`
+	Selector     string   `json:"selector"`
+	Files        int      `json:"files"`
+	Filter       string   `json:"filter,omitempty"`
+	Duration     string   `json:"duration,omitempty"`
+	Priority     int      `json:"priority,omitempty"`
+	Schedule     string   `json:"schedule,omitempty"`
+	KeepSessions int      `json:"keepSessions,omitempty"`
+	// FlightRecorder, PostTrigger and TriggerMatch are like their
+	// annotations.
+	FlightRecorder string `json:"flightRecorder,omitempty"`
+	PostTrigger    string `json:"postTrigger,omitempty"`
+	TriggerMatch   string `json:"triggerMatch,omitempty"`
+	// StopOn, StopOnFilter and StopTail are like their annotations.
+	StopOn       string `json:"stopOn,omitempty"`
+	StopOnFilter string `json:"stopOnFilter,omitempty"`
+	StopTail     string `json:"stopTail,omitempty"`
+	// NodeInterfaces is like its annotation, e.g. [gateway, tunnel].
+	NodeInterfaces []string `json:"nodeInterfaces,omitempty"`
+	PacketCount    int      `json:"packetCount,omitempty"`
+}
+
+// ParseCaptureRules decodes capture rules. Rule captures are validated like
+// annotations. A rule must have a name and a non-empty label selector, so a
+// typo cannot select every Pod.
+func ParseCaptureRules(data []byte) ([]CaptureRule, error) {
+	var file captureRulesFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid capture rules: %w", err)
+	}
+
+	rules := make([]CaptureRule, 0, len(file.Rules))
+	names := make(map[string]bool)
+	for i, spec := range file.Rules {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("capture rule %d has no name", i)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("duplicate capture rule %q", spec.Name)
+		}
+		names[spec.Name] = true
+
+		selector, cfg, err := spec.parse()
+		if err != nil {
+			return nil, fmt.Errorf("capture rule %q: %w", spec.Name, err)
+		}
+		rules = append(rules, CaptureRule{
+			Name:       spec.Name,
+			Namespaces: spec.Namespaces,
+			Selector:   selector,
+			Config:     *cfg,
+		})
+	}
+	return rules, nil
+}
+
+// parse returns the rule's selector and capture.
+func (spec *captureRuleSpec) parse() (labels.Selector, *CaptureConfig, error) {
+	selector, err := labels.Parse(spec.Selector)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid selector: %w", err)
+	}
+	if selector.Empty() {
+		return nil, nil, fmt.Errorf("selector must not be empty")
+	}
+
+	annotations := map[string]string{AnnotationKey: strconv.Itoa(spec.Files)}
+	if spec.Filter != "" {
+		annotations[FilterAnnotationKey] = spec.Filter
+	}
+	if spec.Duration != "" {
+		annotations[DurationAnnotationKey] = spec.Duration
+	}
+	if spec.Priority != 0 {
+		annotations[PriorityAnnotationKey] = strconv.Itoa(spec.Priority)
+	}
+	if spec.Schedule != "" {
+		annotations[ScheduleAnnotationKey] = spec.Schedule
+	}
+	if spec.KeepSessions != 0 {
+		annotations[KeepSessionsAnnotationKey] = strconv.Itoa(spec.KeepSessions)
+	}
+	if spec.FlightRecorder != "" {
+		annotations[FlightRecorderAnnotationKey] = spec.FlightRecorder
+	}
+	if spec.PostTrigger != "" {
+		annotations[PostTriggerAnnotationKey] = spec.PostTrigger
+	}
+	if spec.TriggerMatch != "" {
+		annotations[TriggerMatchAnnotationKey] = spec.TriggerMatch
+	}
+	if spec.StopOn != "" {
+		annotations[StopOnAnnotationKey] = spec.StopOn
+	}
+	if spec.StopOnFilter != "" {
+		annotations[StopOnFilterAnnotationKey] = spec.StopOnFilter
+	}
+	if spec.StopTail != "" {
+		annotations[StopTailAnnotationKey] = spec.StopTail
+	}
+	if len(spec.NodeInterfaces) > 0 {
+		annotations[NodeInterfacesAnnotationKey] = strings.Join(spec.NodeInterfaces, ",")
+	}
+	if spec.PacketCount != 0 {
+		annotations[PacketCountAnnotationKey] = strconv.Itoa(spec.PacketCount)
+	}
+	cfg, err := ParseCaptureConfig(annotations)
+	if err != nil {
+		return nil, nil, err
+	}
+	return selector, cfg, nil
+}
+
+// SetCaptureRules watches the ConfigMap name for capture rules. The informer
+// should only watch that ConfigMap's namespace. It must be called before Run.
+func (c *Controller) SetCaptureRules(configMapInformer coreinformers.ConfigMapInformer, name string) {
+	c.rulesSynced = configMapInformer.Informer().HasSynced
+	onChange := func(obj interface{}) {
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok || cm.Name != name {
+			return
+		}
+		c.loadCaptureRules(cm)
+	}
+	configMapInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    onChange,
+		UpdateFunc: func(oldObj, newObj interface{}) { onChange(newObj) },
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if cm, ok := obj.(*corev1.ConfigMap); ok && cm.Name == name {
+				klog.InfoS("Capture rules ConfigMap deleted", "configMap", klog.KObj(cm))
+				c.setTriggerRules(nil)
+				c.setCaptureRules(nil)
+			}
+		},
+	})
+}
+
+// loadCaptureRules applies the rules in cm. Invalid rules are logged and the
+// previous rules stay in effect.
+func (c *Controller) loadCaptureRules(cm *corev1.ConfigMap) {
+	data := []byte(cm.Data[CaptureRulesKey])
+	rules, err := ParseCaptureRules(data)
+	if err != nil {
+		klog.ErrorS(err, "Ignoring invalid capture rules", "configMap", klog.KObj(cm))
+		return
+	}
+	triggers, err := ParseTriggerRules(data)
+	if err != nil {
+		klog.ErrorS(err, "Ignoring invalid capture rules", "configMap", klog.KObj(cm))
+		return
+	}
+	klog.InfoS("Loaded capture rules", "configMap", klog.KObj(cm), "rules", len(rules), "triggers", len(triggers))
+	c.setTriggerRules(triggers)
+	c.setCaptureRules(rules)
+}
+
+// setCaptureRules replaces the rules and resyncs every local Pod, as any of
+// them may start or stop matching.
+func (c *Controller) setCaptureRules(rules []CaptureRule) {
+	c.rulesMu.Lock()
+	c.rules = rules
+	c.rulesMu.Unlock()
+	c.enqueueAllPods()
+}
+
+// enqueueAllPods resyncs every local Pod.
+func (c *Controller) enqueueAllPods() {
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		klog.ErrorS(err, "Failed to list Pods")
+		return
+	}
+	for _, pod := range pods {
+		c.enqueuePod(pod)
+	}
+}
+
+// matchRule returns the first rule that selects pod, or nil.
+func (c *Controller) matchRule(pod *corev1.Pod) *CaptureRule {
+	c.rulesMu.RLock()
+	defer c.rulesMu.RUnlock()
+	for i := range c.rules {
+		if c.rules[i].Matches(pod) {
+			rule := c.rules[i]
+			return &rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestCaptureRules(t *testing.T) {
+	for _, data := range []string{
+		"rules:\n- selector: app=web\n  files: 1\n",                                                  // no name
+		"rules:\n- name: a\n  files: 1\n",                                                            // empty selector
+		"rules:\n- name: a\n  selector: app=web\n  files: 0\n",                                       // invalid capture
+		"rules:\n- name: a\n  selector: app=web\n  files: 1\n  bogus: true\n",                        // unknown field
+		"rules:\n- name: a\n  selector: app=web\n  files: 1\n- name: a\n  selector: x\n  files: 1\n", // duplicate
+	} {
+		if _, err := ParseCaptureRules([]byte(data)); err == nil {
+			t.Errorf("ParseCaptureRules(%q) succeeded, want error", data)
+		}
+	}
+
+	rules, err := ParseCaptureRules([]byte(`
+rules:
+- name: web
+  namespaces: [shop]
+  selector: app=web
+  files: 3
+  filter: tcp port 80
+  duration: 5m
+- name: any-db
+  selector: tier=db
+  files: 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	pod := func(namespace, name string, labels, annotations map[string]string) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels, Annotations: annotations},
+			Spec:       corev1.PodSpec{NodeName: "node-1"},
+		}
+		indexer.Add(p)
+		return p
+	}
+	web := pod("shop", "web-1", map[string]string{"app": "web"}, nil)
+	otherWeb := pod("other", "web-1", map[string]string{"app": "web"}, nil)
+	db := pod("other", "db-0", map[string]string{"tier": "db"}, nil)
+	annotated := pod("shop", "web-2", map[string]string{"app": "web"}, map[string]string{AnnotationKey: "7"})
+
+	c := &Controller{
+		podLister: corelisters.NewPodLister(indexer),
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		nodeName:  "node-1",
+	}
+	defer c.queue.ShutDown()
+	c.setCaptureRules(rules)
+	if c.queue.Len() != 4 {
+		t.Errorf("expected every local Pod to be resynced, queue has %d", c.queue.Len())
+	}
+
+	for _, tc := range []struct {
+		pod      *corev1.Pod
+		rule     string
+		maxFiles int
+	}{
+		{web, "web", 3},
+		{otherWeb, "", 0}, // namespace not selected
+		{db, "any-db", 1},
+		{annotated, "", 7}, // annotations take precedence
+	} {
+		cfg, source, err := c.podCaptureConfig(tc.pod)
+		if err != nil {
+			t.Fatalf("%s: %v", podKey(tc.pod), err)
+		}
+		maxFiles := 0
+		if cfg != nil {
+			maxFiles = cfg.MaxFiles
+		}
+		if source.rule != tc.rule || maxFiles != tc.maxFiles {
+			t.Errorf("%s: got rule %q maxFiles %d, want %q %d", podKey(tc.pod), source.rule, maxFiles, tc.rule, tc.maxFiles)
+		}
+	}
+	if cfg, _, _ := c.podCaptureConfig(web); cfg.Filter != "tcp port 80" || cfg.Duration != 5*time.Minute {
+		t.Errorf("rule config = %+v", cfg)
+	}
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/cron"
+)
+
+// scheduleCheckInterval is how often the scheduler looks for scheduled
+// captures that are due. Schedules have a one-minute resolution.
+const scheduleCheckInterval = 10 * time.Second
+
+// scheduledCapture tracks the next run of a Pod's scheduled capture.
+type scheduledCapture struct {
+	expr     string
+	schedule *cron.Schedule
+	next     time.Time
+}
+
+// scheduleDue reports whether the scheduled capture cfg of the Pod key should
+// start a new session now, and if so advances it to its next run. A schedule
+// seen for the first time, or changed, first runs at its next tick.
+func (c *Controller) scheduleDue(key string, cfg *CaptureConfig) bool {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.schedules[key]
+	if s == nil || s.expr != cfg.Schedule {
+		schedule, err := cron.Parse(cfg.Schedule)
+		if err != nil {
+			// Validated with the rest of the request
+			return false
+		}
+		c.schedules[key] = &scheduledCapture{expr: cfg.Schedule, schedule: schedule, next: schedule.Next(now)}
+		return false
+	}
+	if s.next.IsZero() || now.Before(s.next) {
+		return false
+	}
+	s.next = s.schedule.Next(now)
+	return true
+}
+
+// nextCapture returns when the scheduled capture of key runs next, or nil.
+func (c *Controller) nextCapture(key string) *metav1.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.schedules[key]
+	if s == nil || s.next.IsZero() {
+		return nil
+	}
+	next := metav1.NewTime(s.next)
+	return &next
+}
+
+// runScheduler resyncs Pods whose scheduled capture is due until ctx is done.
+func (c *Controller) runScheduler(ctx context.Context) {
+	ticker := c.clock.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			c.enqueueDueSchedules()
+		}
+	}
+}
+
+func (c *Controller) enqueueDueSchedules() {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, s := range c.schedules {
+		if !s.next.IsZero() && !now.Before(s.next) {
+			c.queue.Add(key)
+		}
+	}
+}
+
+// pruneSessions deletes the oldest sessions that the schedule or trigger rule
+// of state started for its Pod key so that at most keep remain. Sessions
+// started otherwise, e.g. by hand or for a two-ended capture, or for an
+// earlier Pod of the same name are kept.
+func (c *Controller) pruneSessions(key string, state *CaptureState, keep int) {
+	namespace, name, _ := strings.Cut(key, "/")
+	if state.uid == "" {
+		return
+	}
+	sessions, err := c.listSessions()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list capture sessions", "dir", c.captureDir)
+		return
+	}
+	var own []captureSession
+	for _, s := range sessions {
+		md := s.metadata
+		if md != nil && md.Namespace == namespace && md.Pod == name && md.UID == state.uid &&
+			md.Config.Schedule == state.config.Schedule && md.Config.Trigger == state.triggerRule {
+			own = append(own, s)
+		}
+	}
+	if len(own) <= keep {
+		return
+	}
+	// Session start times sort lexically
+	sort.Slice(own, func(i, j int) bool {
+		return own[i].fields.Start < own[j].fields.Start
+	})
+	for _, s := range own[:len(own)-keep] {
+		if err := os.RemoveAll(s.path); err != nil {
+			klog.ErrorS(err, "Failed to remove capture session", "dir", s.path)
+		} else {
+			klog.InfoS("Removed old capture session", "pod", key, "dir", s.path, "schedule", state.config.Schedule, "trigger", state.triggerRule)
+		}
+	}
+}
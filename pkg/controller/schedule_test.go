@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func TestScheduledCaptures(t *testing.T) {
+	fakeClock := testingclock.NewFakeClock(time.Date(2026, 3, 1, 1, 59, 30, 0, time.UTC))
+	c := &Controller{
+		clock:     fakeClock,
+		schedules: map[string]*scheduledCapture{},
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	defer c.queue.ShutDown()
+	cfg := &CaptureConfig{MaxFiles: 1, Duration: time.Minute, Schedule: "0 2 * * *", KeepSessions: 2}
+
+	if c.scheduleDue("default/web", cfg) {
+		t.Fatal("a new schedule must wait for its first run")
+	}
+	if next := c.nextCapture("default/web"); next == nil || !next.Time.Equal(time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)) {
+		t.Fatalf("next capture = %v", next)
+	}
+	c.enqueueDueSchedules()
+	if c.queue.Len() != 0 {
+		t.Fatal("enqueued a schedule that is not due")
+	}
+
+	fakeClock.Step(30 * time.Second)
+	c.enqueueDueSchedules()
+	if c.queue.Len() != 1 {
+		t.Fatal("did not enqueue the due schedule")
+	}
+	if !c.scheduleDue("default/web", cfg) {
+		t.Fatal("schedule is due")
+	}
+	if c.scheduleDue("default/web", cfg) {
+		t.Fatal("schedule ran twice in one tick")
+	}
+	if next := c.nextCapture("default/web"); !next.Time.Equal(time.Date(2026, 3, 2, 2, 0, 0, 0, time.UTC)) {
+		t.Errorf("next capture = %v", next)
+	}
+
+	// Changing the schedule restarts it from the current time.
+	changed := *cfg
+	changed.Schedule = "*/5 * * * *"
+	if c.scheduleDue("default/web", &changed) {
+		t.Error("a changed schedule must wait for its next run")
+	}
+}
+
+func TestPruneSessions(t *testing.T) {
+	dir := t.TempDir()
+	c := &Controller{captureDir: dir, naming: defaultFileNaming}
+	start := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+	nightly := SessionConfig{Schedule: "0 2 * * *"}
+	sessions := []struct {
+		pod, uid string
+		config   SessionConfig
+		keep     bool
+	}{
+		{"web", "1", nightly, true},
+		{"web", "1", nightly, true},
+		{"db", "3", nightly, true},
+		{"web", "1", SessionConfig{}, true},                      // started by hand
+		{"web", "1", SessionConfig{Trigger: "crash"}, true},      // by a trigger rule
+		{"web", "1", SessionConfig{Schedule: "0 * * * *"}, true}, // by an earlier schedule
+		{"web", "2", nightly, true},                              // of an earlier Pod
+		{"web", "1", nightly, false},
+	}
+	var dirs []string
+	for i, s := range sessions {
+		sessionDir := filepath.Join(dir, "session-"+string(rune('a'+i)))
+		if err := os.Mkdir(sessionDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		// Directory order differs from start order
+		md := &SessionMetadata{Namespace: "default", Pod: s.pod, UID: s.uid, Config: s.config,
+			StartTime: metav1.NewTime(start.Add(time.Duration(len(sessions)-i) * time.Hour))}
+		if err := writeSessionMetadata(sessionDir, md); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, sessionDir)
+	}
+
+	c.pruneSessions("default/web", &CaptureState{uid: "1", config: &CaptureConfig{Schedule: nightly.Schedule}}, 2)
+	for i, s := range sessions {
+		if _, err := os.Stat(dirs[i]); (err == nil) != s.keep {
+			t.Errorf("session %d exists = %v, want %v", i, err == nil, s.keep)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+// CaptureFile describes one rotated pcap file of a capture.
+type CaptureFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// FirstPacket and LastPacket bound the packets in the file. They are
+	// unset while the file holds no complete packet.
+	FirstPacket *time.Time `json:"firstPacket,omitempty"`
+	LastPacket  *time.Time `json:"lastPacket,omitempty"`
+	// Interface is the node interface the file was captured on, or empty
+	// for the Pod's own capture.
+	Interface string `json:"interface,omitempty"`
+	// Decapsulated marks the pcapng copy of a tunnel interface capture
+	// with the overlay headers removed.
+	Decapsulated bool `json:"decapsulated,omitempty"`
+	// Summary marks the JSON or CSV connection summary of the capture,
+	// written when it stops.
+	Summary bool `json:"summary,omitempty"`
+}
+
+// Handler returns the HTTP handler for the controller's capture API.
+//
+//	GET /captures/{namespace}/{name}/stream        live pcap stream of a running capture
+//	GET /captures/{namespace}/{name}/metadata      the session's metadata.json manifest
+//	GET /captures/{namespace}/{name}/files         JSON list of the capture's files
+//	GET /captures/{namespace}/{name}/files/{file}  download one file
+//	POST /captures/{namespace}/{name}/trigger      trigger a flight recorder
+//	GET /metrics                                   Prometheus metrics
+//
+// With SetAPIAuth, every request is authorized as the client's bearer token.
+func (c *Controller) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", c.authorized(legacyregistry.Handler().ServeHTTP))
+	mux.HandleFunc("GET /captures/{namespace}/{name}/stream", c.authorized(c.serveStream))
+	mux.HandleFunc("GET /captures/{namespace}/{name}/metadata", c.authorized(c.serveMetadata))
+	mux.HandleFunc("GET /captures/{namespace}/{name}/files", c.authorized(c.serveFileList))
+	mux.HandleFunc("GET /captures/{namespace}/{name}/files/{file}", c.authorized(c.serveFile))
+	mux.HandleFunc("POST /captures/{namespace}/{name}/trigger", c.authorized(c.serveTrigger))
+	return mux
+}
+
+// Serve runs the HTTP server on addr until ctx is cancelled.
+func (c *Controller) Serve(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           c.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	klog.InfoS("Starting capture API server", "address", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serveStream writes a running capture's packets as a chunked pcap stream,
+// suitable for piping into `wireshark -k -i -`.
+func (c *Controller) serveStream(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("namespace") + "/" + r.PathValue("name")
+
+	sub, err := c.processManager.Subscribe(key)
+	if err != nil {
+		if errors.Is(err, ErrNoCapture) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		klog.ErrorS(err, "Failed to start live stream", "pod", key)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	hdr, err := sub.Header(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	flusher, _ := w.(http.Flusher)
+	pw, err := pcap.NewWriter(w, hdr)
+	if err != nil {
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	klog.InfoS("Live stream viewer connected", "pod", key, "remote", r.RemoteAddr)
+	defer klog.InfoS("Live stream viewer disconnected", "pod", key, "remote", r.RemoteAddr)
+
+	packets := sub.Packets()
+	for {
+		select {
+		case rec, ok := <-packets:
+			if !ok {
+				if sub.Dropped() {
+					klog.InfoS("Viewer fell behind and was dropped", "pod", key, "remote", r.RemoteAddr)
+				}
+				return
+			}
+			if err := pw.WriteRecord(rec); err != nil {
+				return
+			}
+			// Batch flushes while the viewer is keeping up.
+			if flusher != nil && len(packets) == 0 {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// captureSessionMetadata returns the up-to-date manifest of the current
+// session of the capture for key.
+func (c *Controller) captureSessionMetadata(key string) (*SessionMetadata, error) {
+	state := c.getCaptureState(key)
+	if state == nil || state.sessionDir == "" {
+		return nil, ErrNoCapture
+	}
+	return c.updateSession(state.sessionDir, "")
+}
+
+// captureFiles lists the files written by the capture for key, oldest first.
+func (c *Controller) captureFiles(key string) ([]CaptureFile, error) {
+	state := c.getCaptureState(key)
+	if state == nil {
+		return nil, ErrNoCapture
+	}
+	if state.sessionDir != "" {
+		md, err := c.updateSession(state.sessionDir, "")
+		if err != nil {
+			return nil, err
+		}
+		return md.Files, nil
+	}
+
+	// Adopted from a version without session directories
+	matches, err := filepath.Glob(state.filePattern)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]CaptureFile, 0, len(matches))
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, CaptureFile{
+			Name:    filepath.Base(m),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.Before(files[j].ModTime)
+	})
+	return files, nil
+}
+
+func (c *Controller) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("namespace") + "/" + r.PathValue("name")
+
+	md, err := c.captureSessionMetadata(key)
+	if err != nil {
+		if errors.Is(err, ErrNoCapture) || os.IsNotExist(err) {
+			http.Error(w, ErrNoCapture.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(md)
+}
+
+func (c *Controller) serveFileList(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("namespace") + "/" + r.PathValue("name")
+
+	files, err := c.captureFiles(key)
+	if err != nil {
+		if errors.Is(err, ErrNoCapture) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+func (c *Controller) serveFile(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("namespace") + "/" + r.PathValue("name")
+	name := r.PathValue("file")
+
+	files, err := c.captureFiles(key)
+	if err != nil {
+		if errors.Is(err, ErrNoCapture) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dir := c.captureDir
+	if state := c.getCaptureState(key); state != nil && state.sessionDir != "" {
+		dir = state.sessionDir
+	}
+
+	// Only serve files that belong to this capture.
+	for _, f := range files {
+		if f.Name == name {
+			switch {
+			case strings.HasSuffix(name, summaryJSONSuffix):
+				w.Header().Set("Content-Type", "application/json")
+			case strings.HasSuffix(name, summaryCSVSuffix):
+				w.Header().Set("Content-Type", "text/csv")
+			default:
+				w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+			}
+			http.ServeFile(w, r, filepath.Join(dir, name))
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// serveTrigger triggers a flight recorder. An optional reason query parameter
+// is logged and reported in the capture status.
+func (c *Controller) serveTrigger(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("namespace") + "/" + r.PathValue("name")
+	reason := "API"
+	if q := r.URL.Query().Get("reason"); q != "" {
+		reason = "API: " + q
+	}
+
+	err := c.processManager.TriggerRecorder(key, reason)
+	switch {
+	case errors.Is(err, ErrNoCapture):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNotFlightRecorder):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		klog.InfoS("Flight recorder triggered through the API", "pod", key, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,429 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+// metadataFileName is the manifest kept in every session directory.
+const metadataFileName = "metadata.json"
+
+// sessionRefreshInterval is how often the manifests of running captures are
+// brought up to date with their files.
+const sessionRefreshInterval = 30 * time.Second
+
+// Stop reasons recorded only in session manifests.
+const (
+	// StopReasonRestarted means the capture was replaced by a new session
+	// because its request or container changed.
+	StopReasonRestarted = "Restarted"
+	// StopReasonExited means tcpdump exited on its own.
+	StopReasonExited = "Exited"
+	// StopReasonInterrupted means the controller restarted while the
+	// capture was running and could not adopt it.
+	StopReasonInterrupted = "Interrupted"
+)
+
+// SessionMetadata is the metadata.json manifest of one capture session.
+type SessionMetadata struct {
+	Namespace   string            `json:"namespace"`
+	Pod         string            `json:"pod"`
+	UID         string            `json:"uid,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	PodIPs      []string          `json:"podIPs,omitempty"`
+	Node        string            `json:"node,omitempty"`
+	Container   string            `json:"container,omitempty"`
+	ContainerID string            `json:"containerID,omitempty"`
+	// FlowID and Peer link the two ends of a two-ended capture.
+	FlowID     string        `json:"flowID,omitempty"`
+	Peer       string        `json:"peer,omitempty"`
+	Config     SessionConfig `json:"config"`
+	StartTime  metav1.Time   `json:"startTime"`
+	StopTime   *metav1.Time  `json:"stopTime,omitempty"`
+	StopReason string        `json:"stopReason,omitempty"`
+	// Interfaces are the node interfaces captured along with the Pod.
+	Interfaces []SessionInterface `json:"interfaces,omitempty"`
+	// Files are the session's pcap files, oldest first.
+	Files []CaptureFile `json:"files"`
+}
+
+// SessionInterface is a node interface captured in a session, filtered to the
+// Pod's traffic.
+type SessionInterface struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Filter string `json:"filter"`
+}
+
+// SessionConfig is the capture request a session was started with.
+type SessionConfig struct {
+	MaxFiles int    `json:"maxFiles"`
+	Filter   string `json:"filter,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Schedule string `json:"schedule,omitempty"`
+	// FlightRecorder holds the buffer bounds of a flight recorder.
+	FlightRecorder string `json:"flightRecorder,omitempty"`
+	TriggerMatch   string `json:"triggerMatch,omitempty"`
+	StopOn         string `json:"stopOn,omitempty"`
+	StopOnFilter   string `json:"stopOnFilter,omitempty"`
+	StopTail       string `json:"stopTail,omitempty"`
+	NodeInterfaces string `json:"nodeInterfaces,omitempty"`
+	PacketCount    int    `json:"packetCount,omitempty"`
+	// Trigger names the trigger rule that started the session.
+	Trigger string `json:"trigger,omitempty"`
+}
+
+func newSessionConfig(cfg *CaptureConfig) SessionConfig {
+	sc := SessionConfig{MaxFiles: cfg.MaxFiles, Filter: cfg.Filter, Priority: cfg.Priority, Schedule: cfg.Schedule, NodeInterfaces: cfg.NodeInterfaces,
+		PacketCount: cfg.PacketCount}
+	if cfg.Duration > 0 {
+		sc.Duration = cfg.Duration.String()
+	}
+	if cfg.FlightRecorder() {
+		sc.FlightRecorder = cfg.flightRecorderValue()
+		sc.TriggerMatch = cfg.TriggerMatch
+	}
+	if cfg.StopCondition() {
+		sc.StopOn = cfg.StopOn
+		sc.StopOnFilter = cfg.StopOnFilter
+		sc.StopTail = cfg.StopTail.String()
+	}
+	return sc
+}
+
+// captureSession is a session directory in the capture directory. Its fields
+// come from the manifest, or from the directory name if there is none.
+type captureSession struct {
+	captureFile
+	metadata *SessionMetadata
+}
+
+// newSession returns the directory of a new session of pod and the path
+// tcpdump writes to inside it. The directory is named like the session's
+// files, without the extension.
+func (c *Controller) newSession(pod *corev1.Pod, start time.Time) (dir, outputFile string) {
+	name := c.naming.Name(sessionFields(pod, start))
+	dir = filepath.Join(c.captureDir, strings.TrimSuffix(name, ".pcap"))
+	return dir, filepath.Join(dir, name)
+}
+
+// sessionDirOf returns the session directory a capture file is in, or ""
+// for files directly in the capture directory.
+func (c *Controller) sessionDirOf(file string) string {
+	dir := filepath.Dir(file)
+	if filepath.Clean(dir) == filepath.Clean(c.captureDir) {
+		return ""
+	}
+	return dir
+}
+
+func sessionFields(pod *corev1.Pod, start time.Time) FileNameFields {
+	fields := FileNameFields{
+		Namespace: pod.Namespace,
+		Pod:       pod.Name,
+		UID:       string(pod.UID),
+		Start:     start.UTC().Format(sessionTimeFormat),
+	}
+	if len(pod.Spec.Containers) > 0 {
+		fields.Container = pod.Spec.Containers[0].Name
+	}
+	return fields
+}
+
+// listSessions returns the session directories in the capture directory.
+func (c *Controller) listSessions() ([]captureSession, error) {
+	entries, err := os.ReadDir(c.captureDir)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []captureSession
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(c.captureDir, e.Name())
+		s := captureSession{captureFile: captureFile{path: dir, base: e.Name()}}
+		if md, err := readSessionMetadata(dir); err == nil {
+			s.metadata = md
+			s.fields = FileNameFields{Namespace: md.Namespace, Pod: md.Pod, UID: md.UID, Container: md.Container,
+				Start: md.StartTime.UTC().Format(sessionTimeFormat)}
+		} else if fields, _, ok := c.naming.Parse(e.Name() + ".pcap"); ok {
+			// The manifest is written right after tcpdump starts
+			s.fields = fields
+		} else {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// openSession writes the first manifest of a session that has just started.
+func (c *Controller) openSession(key string, state *CaptureState) {
+	if state.sessionDir == "" {
+		return
+	}
+	md := &SessionMetadata{
+		Node:        c.nodeName,
+		ContainerID: state.containerID,
+		FlowID:      state.config.FlowID,
+		Peer:        state.config.Peer,
+		Config:      newSessionConfig(state.config),
+		StartTime:   state.startTime,
+	}
+	md.Config.Trigger = state.triggerRule
+	namespace, name, _ := strings.Cut(key, "/")
+	md.Namespace, md.Pod = namespace, name
+	if pod, err := c.podLister.Pods(namespace).Get(name); err == nil {
+		md.UID = string(pod.UID)
+		md.Labels = pod.Labels
+		for _, ip := range pod.Status.PodIPs {
+			md.PodIPs = append(md.PodIPs, ip.IP)
+		}
+		if len(pod.Spec.Containers) > 0 {
+			md.Container = pod.Spec.Containers[0].Name
+		}
+	}
+	md.Interfaces = c.processManager.sessionInterfaces(state.config, md.PodIPs)
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	md.Files = sessionFiles(state.sessionDir, nil)
+	if err := writeSessionMetadata(state.sessionDir, md); err != nil {
+		klog.ErrorS(err, "Failed to write session metadata", "pod", key, "dir", state.sessionDir)
+	}
+}
+
+// updateSession refreshes the file list of a session's manifest and, if
+// reason is set, records that the session stopped. It returns the updated
+// manifest.
+func (c *Controller) updateSession(dir, reason string) (*SessionMetadata, error) {
+	md, _, err := c.stopSession(dir, reason)
+	return md, err
+}
+
+// stopSession is updateSession that also reports whether this call recorded
+// the stop, rather than an earlier one.
+func (c *Controller) stopSession(dir, reason string) (*SessionMetadata, bool, error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	md, err := readSessionMetadata(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	md.Files = sessionFiles(dir, md.Files)
+	stopped := false
+	if reason != "" && md.StopTime == nil {
+		now := metav1.Now()
+		md.StopTime = &now
+		md.StopReason = reason
+		stopped = true
+	}
+	return md, stopped, writeSessionMetadata(dir, md)
+}
+
+// closeSession records in the manifest that the session of state stopped.
+// When that is new, the session is finished in the background.
+func (c *Controller) closeSession(key string, state *CaptureState, reason string) {
+	if state == nil || state.sessionDir == "" {
+		return
+	}
+	md, stopped, err := c.stopSession(state.sessionDir, reason)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.ErrorS(err, "Failed to update session metadata", "pod", key, "dir", state.sessionDir)
+		}
+		return
+	}
+	if stopped {
+		c.finishing.Add(1)
+		go func() {
+			defer c.finishing.Done()
+			c.finishSession(key, state.sessionDir, md)
+		}()
+	}
+}
+
+// finishSession writes the decapsulated copies and connection summaries of
+// the captures of a stopped session, from the files in md. Both read every
+// capture file, so they run once per session and off the workers.
+func (c *Controller) finishSession(key, dir string, md *SessionMetadata) {
+	wrote := decapsulateTunnels(dir, md)
+	if summarizeSession(dir, md) {
+		wrote = true
+	}
+	if wrote {
+		if _, err := c.updateSession(dir, ""); err != nil && !os.IsNotExist(err) {
+			klog.ErrorS(err, "Failed to update session metadata", "pod", key, "dir", dir)
+		}
+	}
+}
+
+// refreshSessions brings the manifests of running captures up to date.
+func (c *Controller) refreshSessions(ctx context.Context) {
+	for key, state := range c.captureStates() {
+		if state.sessionDir == "" || state.stopReason != "" {
+			continue
+		}
+		if _, err := c.updateSession(state.sessionDir, ""); err != nil && !os.IsNotExist(err) {
+			klog.ErrorS(err, "Failed to update session metadata", "pod", key, "dir", state.sessionDir)
+		}
+	}
+}
+
+// removePodSessions deletes every session directory of the Pod key with uid.
+// Sessions of an earlier Pod of the same name, and legacy files, which carry
+// no namespace, are left to the garbage collector.
+func (c *Controller) removePodSessions(key, uid string) {
+	namespace, name, _ := strings.Cut(key, "/")
+	if uid == "" {
+		return
+	}
+	sessions, err := c.listSessions()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list capture sessions", "dir", c.captureDir)
+		return
+	}
+	for _, s := range sessions {
+		if s.fields.Namespace != namespace || s.fields.Pod != name || s.fields.UID != uid {
+			continue
+		}
+		if err := os.RemoveAll(s.path); err != nil {
+			klog.ErrorS(err, "Failed to remove capture session", "dir", s.path)
+		} else {
+			klog.InfoS("Removed capture session", "dir", s.path)
+		}
+	}
+}
+
+// sessionFiles lists the files in a session directory, oldest first.
+// Time ranges are only read again for files that changed since previous.
+func sessionFiles(dir string, previous []CaptureFile) []CaptureFile {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	known := make(map[string]CaptureFile, len(previous))
+	for _, f := range previous {
+		known[f.Name] = f
+	}
+
+	base := filepath.Base(dir)
+	files := make([]CaptureFile, 0, len(entries))
+	for _, e := range entries {
+		if !e.Type().IsRegular() || e.Name() == metadataFileName || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		f := CaptureFile{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()}
+		if iface, ok := strings.CutSuffix(f.Name, decapSuffix); ok {
+			f.Interface, f.Decapsulated = iface, true
+		} else if prefix, ok := cutSummarySuffix(f.Name); ok {
+			f.Summary = true
+			if prefix != base {
+				f.Interface = prefix
+			}
+		} else if iface, _, ok := strings.Cut(f.Name, ".pcap"); ok && !strings.HasPrefix(f.Name, base) {
+			// Written by a node interface capture
+			f.Interface = iface
+		}
+		if prev, ok := known[f.Name]; ok && prev.Size == f.Size && prev.ModTime.Equal(f.ModTime) {
+			f.FirstPacket, f.LastPacket = prev.FirstPacket, prev.LastPacket
+		} else if !f.Summary {
+			f.FirstPacket, f.LastPacket = pcapTimeRange(filepath.Join(dir, f.Name))
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.Before(files[j].ModTime)
+	})
+	return files
+}
+
+// pcapTimeRange returns the timestamps of the first and last complete packet
+// in a pcap file, or nil if it has none.
+func pcapTimeRange(path string) (first, last *time.Time) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		return nil, nil
+	}
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				klog.V(2).InfoS("Stopped reading capture file", "file", path, "err", err)
+			}
+			return first, last
+		}
+		ts := rec.Timestamp
+		if first == nil {
+			first = &ts
+		}
+		last = &ts
+	}
+}
+
+func readSessionMetadata(dir string) (*SessionMetadata, error) {
+	data, err := os.ReadFile(filepath.Join(dir, metadataFileName))
+	if err != nil {
+		return nil, err
+	}
+	md := &SessionMetadata{}
+	if err := json.Unmarshal(data, md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// writeSessionMetadata replaces the manifest atomically, so readers never
+// see a partial file. It fails if the directory was removed.
+func writeSessionMetadata(dir string, md *SessionMetadata) error {
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+metadataFileName+"-")
+	if err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, metadataFileName)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
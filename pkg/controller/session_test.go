@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+func TestSessionMetadata(t *testing.T) {
+	dir := t.TempDir()
+	c := &Controller{captureDir: dir, naming: defaultFileNaming}
+
+	sessionDir := filepath.Join(dir, "capture-default_web_1_20260301T123000Z")
+	if err := os.Mkdir(sessionDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	w, _ := pcap.NewWriter(&buf, pcap.DefaultHeader())
+	w.WriteRecord(&pcap.Record{Timestamp: ts, Data: []byte{1}})
+	w.WriteRecord(&pcap.Record{Timestamp: ts.Add(time.Second), Data: []byte{2}})
+	// A record tcpdump is still writing
+	data := append(buf.Bytes(), 0, 0, 0)
+	if err := os.WriteFile(filepath.Join(sessionDir, "capture-default_web_1_20260301T123000Z.pcap0"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A node interface capture of the session
+	if err := os.WriteFile(filepath.Join(sessionDir, "antrea-gw0.pcap0"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(sessionDir, "antrea-gw0.pcap0"), ts, ts); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSessionMetadata(sessionDir, &SessionMetadata{Namespace: "default", Pod: "web", UID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := c.updateSession(sessionDir, StopReasonDurationElapsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md.Files) != 2 {
+		t.Fatalf("files = %+v", md.Files)
+	}
+	if f := md.Files[0]; f.Name != "antrea-gw0.pcap0" || f.Interface != "antrea-gw0" {
+		t.Errorf("node interface file = %+v", f)
+	}
+	f := md.Files[1]
+	if f.Interface != "" || f.Size != int64(len(data)) || f.FirstPacket == nil || !f.FirstPacket.Equal(ts) || f.LastPacket == nil || !f.LastPacket.Equal(ts.Add(time.Second)) {
+		t.Errorf("file = %+v", f)
+	}
+	if md.StopTime == nil || md.StopReason != StopReasonDurationElapsed {
+		t.Errorf("stop = %v %q", md.StopTime, md.StopReason)
+	}
+	if md, _ := c.updateSession(sessionDir, StopReasonRestarted); md.StopReason != StopReasonDurationElapsed {
+		t.Errorf("stop reason overwritten with %q", md.StopReason)
+	}
+
+	sessions, err := c.listSessions()
+	if err != nil || len(sessions) != 1 || sessions[0].fields.Pod != "web" || sessions[0].metadata == nil {
+		t.Fatalf("listSessions() = %+v, %v", sessions, err)
+	}
+	c.removePodSessions("other/web", "1")
+	if _, err := os.Stat(sessionDir); err != nil {
+		t.Fatal("removed the session of another Pod")
+	}
+	c.removePodSessions("default/web", "2")
+	if _, err := os.Stat(sessionDir); err != nil {
+		t.Fatal("removed the session of an earlier Pod of the same name")
+	}
+	c.removePodSessions("default/web", "1")
+	if _, err := os.Stat(sessionDir); !os.IsNotExist(err) {
+		t.Errorf("session directory still exists: %v", err)
+	}
+}
+
+func TestLateExitOfRestartedCapture(t *testing.T) {
+	dir := t.TempDir()
+	c := &Controller{
+		captureDir:     dir,
+		naming:         defaultFileNaming,
+		queue:          workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		activeCaptures: map[string]*CaptureState{},
+	}
+	defer c.queue.ShutDown()
+
+	sessionDir := filepath.Join(dir, "capture-default_web_1_20260301T123500Z")
+	if err := os.Mkdir(sessionDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSessionMetadata(sessionDir, &SessionMetadata{Namespace: "default", Pod: "web", UID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(sessionDir, "capture-default_web_1_20260301T123500Z.pcap")
+	state := &CaptureState{fileLocation: file, filePattern: file + "*", sessionDir: sessionDir}
+	c.activeCaptures["default/web"] = state
+
+	// The capture the restart replaced exits only now
+	c.onCaptureExit("default/web", filepath.Join(dir, "capture-default_web_1_20260301T123000Z", "capture-default_web_1_20260301T123000Z.pcap*"), "")
+	md, err := readSessionMetadata(sessionDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.StopTime != nil || state.stopReason != "" {
+		t.Errorf("new session stopped by the old capture's exit: %q %q", md.StopReason, state.stopReason)
+	}
+
+	c.onCaptureExit("default/web", file+"*", "")
+	c.finishing.Wait()
+	if md, _ := readSessionMetadata(sessionDir); md.StopTime == nil || md.StopReason != StopReasonExited {
+		t.Errorf("session not closed by its own capture's exit: %+v", md)
+	}
+}
@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/packet"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+// StopReasonStopConditionMatched finishes a capture whose stop condition
+// matched. The stop reason names the packet, e.g.
+// "StopConditionMatched: tcp 10.0.0.5:5432 > 10.0.1.7:40000 [RST]".
+const StopReasonStopConditionMatched = "StopConditionMatched"
+
+// startStopWatcher evaluates the stop condition of a capture on the packets of
+// a second tcpdump process. tcpdump applies the capture filter and the stop
+// filter, and the controller the stop predicate. The watcher exits with the
+// capture. Caller holds pm.mu.
+func (pm *ProcessManager) startStopWatcher(key string, capture *CaptureProcess, cfg *CaptureConfig) error {
+	var match *packet.Predicate
+	if cfg.StopOn != "" {
+		var err error
+		if match, err = packet.ParsePredicate(cfg.StopOn); err != nil {
+			return err
+		}
+	}
+
+	cmd := streamCommand(capture.ctx, capture.target, joinFilters(cfg.Filter, cfg.StopOnFilter))
+	markCapture(cmd, pm.captureDir)
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stop condition pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start stop condition tcpdump: %w", err)
+	}
+	klog.V(2).InfoS("Watching stop condition", "pod", key, "pid", cmd.Process.Pid, "stopOn", cfg.StopOn, "stopOnFilter", cfg.StopOnFilter)
+
+	go func() {
+		matched, err := firstMatch(stdout, match)
+		// Only the first match counts
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+		if err != nil {
+			if capture.ctx.Err() == nil && !errors.Is(err, io.EOF) {
+				klog.ErrorS(err, "Stop condition watcher failed", "pod", key)
+			}
+			return
+		}
+		pm.stopConditionMatched(key, capture, matched, cfg.StopTail)
+	}()
+	return nil
+}
+
+// firstMatch reads the pcap stream in and describes its first packet that
+// matches match, or its first packet if match is nil.
+func firstMatch(in io.Reader, match *packet.Predicate) (string, error) {
+	reader, err := pcap.NewReader(in)
+	if err != nil {
+		return "", err
+	}
+	linkType := reader.Header().LinkType
+	for {
+		rec, err := reader.Next()
+		if err != nil {
+			return "", err
+		}
+		p, err := packet.Decode(linkType, rec.Data)
+		if err != nil {
+			if match == nil {
+				// Matched by the stop filter alone
+				return fmt.Sprintf("packet of %d bytes at %s", rec.OrigLen, rec.Timestamp.UTC().Format(time.RFC3339Nano)), nil
+			}
+			continue
+		}
+		if match == nil || match.Match(p) {
+			return p.String(), nil
+		}
+	}
+}
+
+// stopConditionMatched finishes a capture tail after its stop condition
+// matched.
+func (pm *ProcessManager) stopConditionMatched(key string, capture *CaptureProcess, matched string, tail time.Duration) {
+	pm.mu.Lock()
+	current := pm.captures[key] == capture && capture.stopReason == ""
+	if current {
+		capture.stopMatch = matched
+	}
+	onChange := pm.onCaptureChange
+	pm.mu.Unlock()
+	if !current {
+		return
+	}
+
+	klog.InfoS("Stop condition matched", "pod", key, "packet", matched, "tail", tail)
+	reason := StopReasonStopConditionMatched + ": " + matched
+	time.AfterFunc(tail, func() {
+		pm.finishCapture(key, capture, reason)
+	})
+	if onChange != nil {
+		onChange(key)
+	}
+}
+
+// StopMatch returns the packet that matched the stop condition of the running
+// capture key, or "" if none has yet.
+func (pm *ProcessManager) StopMatch(key string) string {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if capture := pm.captures[key]; capture != nil {
+		return capture.stopMatch
+	}
+	return ""
+}
+
+// joinFilters returns a filter matching packets that match all of filters.
+func joinFilters(filters ...string) string {
+	joined := ""
+	for _, f := range filters {
+		switch {
+		case f == "":
+		case joined == "":
+			joined = f
+		default:
+			joined = "(" + joined + ") and (" + f + ")"
+		}
+	}
+	return joined
+}
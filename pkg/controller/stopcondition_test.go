@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/packet"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+func TestFirstMatch(t *testing.T) {
+	stream := func() *bytes.Buffer {
+		var b bytes.Buffer
+		w, _ := pcap.NewWriter(&b, pcap.DefaultHeader())
+		now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+		w.WriteRecord(&pcap.Record{Timestamp: now, OrigLen: 3, Data: []byte{1, 2, 3}})
+		w.WriteRecord(&pcap.Record{Timestamp: now, OrigLen: uint32(len(rstFrame)), Data: rstFrame})
+		return &b
+	}
+
+	match, err := packet.ParsePredicate("tcp.flags=rst src.port=5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := firstMatch(stream(), match); err != nil || got != "tcp 10.0.0.5:5432 > 10.0.0.6:40000 [RST]" {
+		t.Errorf("firstMatch = %q, %v", got, err)
+	}
+	// Without a predicate, the stop filter already matched the first packet
+	if got, err := firstMatch(stream(), nil); err != nil || got != "packet of 3 bytes at 2026-03-01T12:00:00Z" {
+		t.Errorf("firstMatch without predicate = %q, %v", got, err)
+	}
+	match, _ = packet.ParsePredicate("http.status=503")
+	if _, err := firstMatch(stream(), match); err == nil {
+		t.Error("firstMatch matched no packet without an error")
+	}
+}
+
+func TestStopConditionMatchedCompletesCapture(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start sleep: %v", err)
+	}
+
+	pm := NewProcessManager(1, t.TempDir(), "")
+	exited := make(chan string, 1)
+	pm.SetOnExit(func(key, filePattern, reason string) { exited <- reason })
+	changed := make(chan string, 1)
+	pm.SetOnCaptureChange(func(key string) { changed <- key })
+
+	if err := pm.tryAcquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	capture := &CaptureProcess{pid: cmd.Process.Pid, ctx: ctx, cancel: cancel, release: pm.releaseSlot}
+	pm.captures["default/db"] = capture
+	go pm.monitorProcess("default/db", capture, cmd.Wait)
+
+	pm.stopConditionMatched("default/db", capture, "tcp 10.0.0.5:5432 > 10.0.0.6:40000 [RST]", 50*time.Millisecond)
+	if got := <-changed; got != "default/db" {
+		t.Errorf("changed %q", got)
+	}
+	if got := pm.StopMatch("default/db"); got != "tcp 10.0.0.5:5432 > 10.0.0.6:40000 [RST]" {
+		t.Errorf("StopMatch = %q", got)
+	}
+
+	select {
+	case reason := <-exited:
+		if want := StopReasonStopConditionMatched + ": tcp 10.0.0.5:5432 > 10.0.0.6:40000 [RST]"; reason != want {
+			t.Errorf("exit reason = %q, want %q", reason, want)
+		}
+	case <-time.After(5 * time.Second):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		t.Fatal("capture was not finished after the tail")
+	}
+}
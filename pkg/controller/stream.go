@@ -0,0 +1,245 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"k8s.io/klog/v2"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+// streamBufferPackets is how many packets a viewer may fall behind before it
+// is dropped. The writer never blocks on a viewer.
+const streamBufferPackets = 1024
+
+// ErrNoCapture indicates there is no running capture for the key.
+var ErrNoCapture = errors.New("no running capture")
+
+// streamCommand builds the tcpdump process feeding a live stream. It writes
+// unbuffered pcap to stdout so packets reach viewers as they arrive.
+var streamCommand = func(ctx context.Context, target captureTarget, filter string) *exec.Cmd {
+	args := []string{
+		"-U",
+		"-w", "-",
+		"-Z", "root",
+	}
+	if filter != "" {
+		args = append(args, "--", filter)
+	}
+	return target.command(ctx, args...)
+}
+
+// liveStream shares one tcpdump process between all viewers of a capture.
+type liveStream struct {
+	key    string
+	cancel context.CancelFunc
+
+	// ready is closed once header (or err) is set.
+	ready  chan struct{}
+	header pcap.FileHeader
+	err    error
+
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+	stopping    bool
+}
+
+// Subscription is one viewer of a live stream.
+type Subscription struct {
+	stream  *liveStream
+	packets chan *pcap.Record
+	dropped atomic.Bool
+}
+
+func newLiveStream(key string, cancel context.CancelFunc) *liveStream {
+	return &liveStream{
+		key:         key,
+		cancel:      cancel,
+		ready:       make(chan struct{}),
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// subscribe adds a viewer. It returns nil if the stream is shutting down.
+func (s *liveStream) subscribe() *Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return nil
+	}
+	sub := &Subscription{
+		stream:  s,
+		packets: make(chan *pcap.Record, streamBufferPackets),
+	}
+	s.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// unsubscribe removes a viewer and stops the stream when none are left.
+func (s *liveStream) unsubscribe(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscribers[sub]; !ok {
+		return
+	}
+	delete(s.subscribers, sub)
+	close(sub.packets)
+	if len(s.subscribers) == 0 && !s.stopping {
+		klog.V(2).InfoS("Last viewer left, stopping live stream", "pod", s.key)
+		s.stopping = true
+		s.cancel()
+	}
+}
+
+// pump reads pcap data from r and fans records out to all viewers until r is
+// exhausted, then closes every subscription.
+func (s *liveStream) pump(r io.Reader) {
+	reader, err := pcap.NewReader(r)
+	if err != nil {
+		s.err = err
+		close(s.ready)
+		s.closeAll()
+		return
+	}
+	s.header = reader.Header()
+	close(s.ready)
+
+	for {
+		rec, err := reader.Next()
+		if err != nil {
+			if err != io.EOF {
+				klog.V(2).InfoS("Live stream ended", "pod", s.key, "error", err)
+			}
+			break
+		}
+		s.broadcast(rec)
+	}
+	s.closeAll()
+}
+
+// broadcast delivers rec to every viewer, dropping any whose buffer is full.
+func (s *liveStream) broadcast(rec *pcap.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subscribers {
+		select {
+		case sub.packets <- rec:
+		default:
+			klog.InfoS("Dropping slow live stream viewer", "pod", s.key)
+			sub.dropped.Store(true)
+			delete(s.subscribers, sub)
+			close(sub.packets)
+		}
+	}
+	if len(s.subscribers) == 0 && !s.stopping {
+		s.stopping = true
+		s.cancel()
+	}
+}
+
+func (s *liveStream) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subscribers {
+		delete(s.subscribers, sub)
+		close(sub.packets)
+	}
+	s.stopping = true
+	s.cancel()
+}
+
+// Header waits for the stream's pcap header, which viewers must send before
+// any packets.
+func (sub *Subscription) Header(ctx context.Context) (pcap.FileHeader, error) {
+	select {
+	case <-sub.stream.ready:
+		return sub.stream.header, sub.stream.err
+	case <-ctx.Done():
+		return pcap.FileHeader{}, ctx.Err()
+	}
+}
+
+// Packets returns the channel of captured packets. It is closed when the
+// capture stops, the viewer is dropped, or Close is called.
+func (sub *Subscription) Packets() <-chan *pcap.Record {
+	return sub.packets
+}
+
+// Dropped reports whether the viewer was disconnected for falling behind.
+func (sub *Subscription) Dropped() bool {
+	return sub.dropped.Load()
+}
+
+// Close detaches the viewer from the stream.
+func (sub *Subscription) Close() {
+	sub.stream.unsubscribe(sub)
+}
+
+// Subscribe attaches a viewer to the live packet stream of a running capture,
+// starting the shared stream process if this is the first viewer.
+func (pm *ProcessManager) Subscribe(key string) (*Subscription, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	capture, exists := pm.captures[key]
+	if !exists {
+		return nil, ErrNoCapture
+	}
+
+	if s := pm.streams[key]; s != nil {
+		if sub := s.subscribe(); sub != nil {
+			return sub, nil
+		}
+	}
+
+	s, err := pm.startStream(key, capture)
+	if err != nil {
+		return nil, err
+	}
+	return s.subscribe(), nil
+}
+
+// startStream launches the stream process for a capture. Caller holds pm.mu.
+func (pm *ProcessManager) startStream(key string, capture *CaptureProcess) (*liveStream, error) {
+	ctx, cancel := context.WithCancel(capture.ctx)
+
+	cmd := streamCommand(ctx, capture.target, capture.filter)
+	markCapture(cmd, pm.captureDir)
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create stream pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start stream tcpdump: %w", err)
+	}
+
+	s := newLiveStream(key, cancel)
+	pm.streams[key] = s
+	klog.InfoS("Live stream started", "pod", key, "pid", cmd.Process.Pid)
+
+	go func() {
+		s.pump(stdout)
+		if err := cmd.Wait(); err != nil {
+			klog.V(2).InfoS("Stream tcpdump exited", "pod", key, "error", err)
+		}
+		pm.mu.Lock()
+		if pm.streams[key] == s {
+			delete(pm.streams, key)
+		}
+		pm.mu.Unlock()
+	}()
+
+	return s, nil
+}
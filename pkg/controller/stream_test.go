@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+func TestLiveStream_DropsSlowViewer(t *testing.T) {
+	cancelled := false
+	s := newLiveStream("ns/pod", func() { cancelled = true })
+	slow := s.subscribe()
+	fast := s.subscribe()
+
+	received := 0
+	for i := 0; i < streamBufferPackets+10; i++ {
+		s.broadcast(&pcap.Record{Timestamp: time.Unix(int64(i), 0), Data: []byte{byte(i)}})
+		// The fast viewer keeps up; the slow one never reads.
+		<-fast.Packets()
+		received++
+	}
+
+	if !slow.Dropped() {
+		t.Error("slow viewer should have been dropped")
+	}
+	if fast.Dropped() {
+		t.Error("fast viewer should not have been dropped")
+	}
+	if received != streamBufferPackets+10 {
+		t.Errorf("fast viewer received %d packets, want %d", received, streamBufferPackets+10)
+	}
+	if cancelled {
+		t.Error("stream should keep running while a viewer remains")
+	}
+
+	fast.Close()
+	if !cancelled {
+		t.Error("stream should stop when the last viewer leaves")
+	}
+	if _, ok := <-fast.Packets(); ok {
+		t.Error("closed viewer channel should be closed")
+	}
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/summary"
+)
+
+// Suffixes of the connection summary of a capture, after the file prefix of
+// the Pod's capture or the node interface name.
+const (
+	summaryJSONSuffix = ".summary.json"
+	summaryCSVSuffix  = ".summary.csv"
+)
+
+// cutSummarySuffix returns the capture a summary file name belongs to.
+func cutSummarySuffix(name string) (string, bool) {
+	if prefix, ok := strings.CutSuffix(name, summaryJSONSuffix); ok {
+		return prefix, true
+	}
+	return strings.CutSuffix(name, summaryCSVSuffix)
+}
+
+// summarizeSession writes the connection summary of each capture of a
+// stopped session, from the files in md, into the session directory: the
+// Pod's and each node interface's. Tunnel captures are summarised by their
+// inner packets. Summaries already written are kept. It reports whether it
+// wrote any.
+func summarizeSession(dir string, md *SessionMetadata) bool {
+	captures := map[string]string{"": filepath.Base(dir)}
+	tunnels := map[string]bool{}
+	for _, iface := range md.Interfaces {
+		captures[iface.Name] = iface.Name
+		tunnels[iface.Name] = iface.Role == NodeInterfaceTunnel
+	}
+
+	wrote := false
+	for iface, prefix := range captures {
+		if summaryExists(filepath.Join(dir, prefix)) {
+			continue
+		}
+		var paths []string
+		for _, f := range md.Files {
+			if f.Interface == iface && !f.Decapsulated && !f.Summary {
+				paths = append(paths, filepath.Join(dir, f.Name))
+			}
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		report, err := summarizeFiles(paths, tunnels[iface])
+		if err == nil {
+			err = writeSummary(filepath.Join(dir, prefix), report)
+		}
+		if err != nil {
+			klog.ErrorS(err, "Failed to summarize capture", "dir", dir, "interface", iface)
+			continue
+		}
+		klog.InfoS("Summarized capture", "dir", dir, "interface", iface, "flows", len(report.Flows), "packets", report.Packets)
+		wrote = true
+	}
+	return wrote
+}
+
+// summaryExists reports whether both summaries of the capture with prefix
+// were written.
+func summaryExists(prefix string) bool {
+	for _, suffix := range []string{summaryJSONSuffix, summaryCSVSuffix} {
+		if _, err := os.Stat(prefix + suffix); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// summarizeFiles summarises the pcap files at paths, oldest first. Files
+// without a header yet are skipped.
+func summarizeFiles(paths []string, decapsulate bool) (*summary.Report, error) {
+	t := summary.NewTable()
+	t.Decapsulate = decapsulate
+	read := 0
+	for _, path := range paths {
+		ok, err := readSummaryFile(t, path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		if ok {
+			read++
+		}
+	}
+	if read == 0 {
+		return nil, fmt.Errorf("no readable capture files")
+	}
+	return t.Report(), nil
+}
+
+// readSummaryFile adds the packets of the pcap file at path to t. It reports
+// false for a file without a header yet.
+func readSummaryFile(t *summary.Table, path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		return false, nil
+	}
+	return true, t.Read(r)
+}
+
+// writeSummary writes report as JSON and CSV next to the capture files with
+// prefix.
+func writeSummary(prefix string, report *summary.Report) error {
+	if err := writeFileAtomic(prefix+summaryJSONSuffix, report.WriteJSON); err != nil {
+		return err
+	}
+	return writeFileAtomic(prefix+summaryCSVSuffix, report.WriteCSV)
+}
+
+// writeFileAtomic writes path with write, under a hidden name that session
+// file lists skip until it is complete.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = write(out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
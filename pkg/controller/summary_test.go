@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/summary"
+)
+
+func TestSummarizeSession(t *testing.T) {
+	base := "capture-default_web_1_20260301T123000Z"
+	dir := filepath.Join(t.TempDir(), base)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A TCP SYN from 10.0.0.1:40000 to 10.0.0.2:80
+	frame := make([]byte, 14+20+20)
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	frame[14] = 0x45
+	binary.BigEndian.PutUint16(frame[16:18], 40)
+	frame[14+9] = 6
+	copy(frame[14+12:], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+	binary.BigEndian.PutUint16(frame[34:36], 40000)
+	binary.BigEndian.PutUint16(frame[36:38], 80)
+	frame[34+12] = 5 << 4
+	frame[34+13] = 0x02
+
+	var buf bytes.Buffer
+	w, _ := pcap.NewWriter(&buf, pcap.DefaultHeader())
+	w.WriteRecord(&pcap.Record{Timestamp: time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC), Data: frame})
+	for _, name := range []string{base + ".pcap0", "antrea-gw0.pcap0"} {
+		if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	md := &SessionMetadata{
+		Interfaces: []SessionInterface{{Name: "antrea-gw0", Role: NodeInterfaceGateway}},
+		Files:      sessionFiles(dir, nil),
+	}
+	if !summarizeSession(dir, md) {
+		t.Fatal("summarizeSession wrote nothing")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, base+summaryJSONSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report summary.Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Flows) != 1 || report.Flows[0].DstPort != 80 || report.Flows[0].Handshake != summary.HandshakeIncomplete {
+		t.Errorf("summary = %s", data)
+	}
+
+	if summarizeSession(dir, md) {
+		t.Error("summaries written again")
+	}
+
+	summaries := map[string]string{}
+	for _, f := range sessionFiles(dir, md.Files) {
+		if f.Summary {
+			summaries[f.Name] = f.Interface
+		}
+	}
+	want := map[string]string{
+		base + summaryJSONSuffix:         "",
+		base + summaryCSVSuffix:          "",
+		"antrea-gw0" + summaryJSONSuffix: "antrea-gw0",
+		"antrea-gw0" + summaryCSVSuffix:  "antrea-gw0",
+	}
+	if len(summaries) != len(want) {
+		t.Fatalf("summary files = %v, want %v", summaries, want)
+	}
+	for name, iface := range want {
+		if got, ok := summaries[name]; !ok || got != iface {
+			t.Errorf("summary file %s of interface %q, want %q", name, got, iface)
+		}
+	}
+}
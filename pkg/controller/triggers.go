@@ -0,0 +1,359 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// TriggerCondition is a Pod Event that can trigger a capture.
+type TriggerCondition string
+
+const (
+	// TriggerRestart is a container being restarted after it failed.
+	TriggerRestart TriggerCondition = "Restart"
+	// TriggerOOMKilled is a container being restarted after it was
+	// OOMKilled. It is also a restart.
+	TriggerOOMKilled TriggerCondition = "OOMKilled"
+	// TriggerReadinessProbeFailed is a failed readiness probe.
+	TriggerReadinessProbeFailed TriggerCondition = "ReadinessProbeFailed"
+)
+
+// DefaultTriggerCooldown is how long a Pod is not captured again after a
+// trigger when its rule sets no cooldown.
+const DefaultTriggerCooldown = 10 * time.Minute
+
+// EventReasonCaptureTriggered is the reason of the Event recorded on a Pod when
+// a trigger starts a capture.
+const EventReasonCaptureTriggered = "CaptureTriggered"
+
+// TriggerRule starts a bounded capture of a Pod it selects when the Pod gets
+// one of its Conditions, so the capture nobody started in time is there.
+type TriggerRule struct {
+	Name       string
+	Namespaces []string
+	Selector   labels.Selector
+	Conditions []TriggerCondition
+	// Cooldown is the minimum time between two captures of a Pod, so a
+	// crash-looping Pod does not hold on to the capture slots.
+	Cooldown time.Duration
+	// KeepSessions is how many triggered sessions of a Pod are kept.
+	KeepSessions int
+	Config       CaptureConfig
+}
+
+// Matches reports whether the rule selects pod for any of conditions, and
+// returns the first condition it triggers on.
+func (r *TriggerRule) Matches(pod *corev1.Pod, conditions []TriggerCondition) (TriggerCondition, bool) {
+	if len(r.Namespaces) > 0 && !slices.Contains(r.Namespaces, pod.Namespace) {
+		return "", false
+	}
+	if !r.Selector.Matches(labels.Set(pod.Labels)) {
+		return "", false
+	}
+	for _, cond := range conditions {
+		if slices.Contains(r.Conditions, cond) {
+			return cond, true
+		}
+	}
+	return "", false
+}
+
+// triggerRuleSpec is a trigger rule in the rules ConfigMap, e.g.
+//
+//	triggers:
+//	- name: web-crash
+//	  selector: app=web
+//	  conditions: [Restart, OOMKilled]
+//	  files: 2
+//	  duration: 2m
+//	  cooldown: 30m
+type triggerRuleSpec struct {
+	captureRuleSpec
+	Conditions []TriggerCondition `json:"conditions"`
+	Cooldown   string             `json:"cooldown,omitempty"`
+}
+
+// ParseTriggerRules decodes the trigger rules of a rules ConfigMap. Besides
+// what capture rules require, a trigger rule needs at least one condition and
+// a duration, and cannot have a schedule.
+func ParseTriggerRules(data []byte) ([]TriggerRule, error) {
+	var file captureRulesFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid capture rules: %w", err)
+	}
+
+	triggers := make([]TriggerRule, 0, len(file.Triggers))
+	names := make(map[string]bool)
+	for i, spec := range file.Triggers {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("trigger rule %d has no name", i)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("duplicate trigger rule %q", spec.Name)
+		}
+		names[spec.Name] = true
+
+		rule, err := spec.parse()
+		if err != nil {
+			return nil, fmt.Errorf("trigger rule %q: %w", spec.Name, err)
+		}
+		triggers = append(triggers, *rule)
+	}
+	return triggers, nil
+}
+
+func (spec *triggerRuleSpec) parse() (*TriggerRule, error) {
+	if len(spec.Conditions) == 0 {
+		return nil, fmt.Errorf("no trigger conditions")
+	}
+	for _, cond := range spec.Conditions {
+		switch cond {
+		case TriggerRestart, TriggerOOMKilled, TriggerReadinessProbeFailed:
+		default:
+			return nil, fmt.Errorf("unknown trigger condition %q", cond)
+		}
+	}
+	if spec.Schedule != "" {
+		return nil, fmt.Errorf("a trigger rule cannot have a schedule")
+	}
+	if spec.Duration == "" {
+		return nil, fmt.Errorf("a trigger rule requires a duration")
+	}
+
+	rule := &TriggerRule{
+		Name:         spec.Name,
+		Namespaces:   spec.Namespaces,
+		Conditions:   spec.Conditions,
+		Cooldown:     DefaultTriggerCooldown,
+		KeepSessions: DefaultKeepSessions,
+	}
+	if spec.Cooldown != "" {
+		var err error
+		rule.Cooldown, err = time.ParseDuration(spec.Cooldown)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cooldown %q: %w", spec.Cooldown, err)
+		}
+		if rule.Cooldown < 0 {
+			return nil, fmt.Errorf("cooldown must not be negative, got %s", rule.Cooldown)
+		}
+	}
+	if spec.KeepSessions < 0 {
+		return nil, fmt.Errorf("keepSessions must be > 0, got %d", spec.KeepSessions)
+	}
+	if spec.KeepSessions > 0 {
+		rule.KeepSessions = spec.KeepSessions
+	}
+
+	// Sessions are kept per trigger rule, not per schedule
+	capture := spec.captureRuleSpec
+	capture.KeepSessions = 0
+	selector, cfg, err := capture.parse()
+	if err != nil {
+		return nil, err
+	}
+	rule.Selector = selector
+	rule.Config = *cfg
+	return rule, nil
+}
+
+// triggeredCapture is the last capture a trigger rule started on a Pod.
+type triggeredCapture struct {
+	rule         string
+	condition    TriggerCondition
+	config       CaptureConfig
+	keepSessions int
+	cooldown     time.Duration
+	fired        time.Time
+	// pending is set until the triggered capture has been started.
+	pending bool
+}
+
+// SetEventTriggers watches Pod Events for the trigger rules of the rules
+// ConfigMap. Events from before the call are ignored. It must be called
+// before Run.
+func (c *Controller) SetEventTriggers(eventInformer coreinformers.EventInformer) {
+	c.eventsSynced = eventInformer.Informer().HasSynced
+	c.triggersSince = c.clock.Now()
+	eventInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.onPodEvent(obj.(*corev1.Event))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Repeated Events are updated with a new count and time
+			oldEvent, newEvent := oldObj.(*corev1.Event), newObj.(*corev1.Event)
+			if !eventTime(newEvent).Equal(eventTime(oldEvent)) {
+				c.onPodEvent(newEvent)
+			}
+		},
+	})
+}
+
+// setTriggerRules replaces the trigger rules. Captures already triggered are
+// kept.
+func (c *Controller) setTriggerRules(triggers []TriggerRule) {
+	if len(triggers) > 0 && c.eventsSynced == nil {
+		klog.InfoS("Trigger rules are ignored without --event-triggers", "rules", len(triggers))
+	}
+	c.rulesMu.Lock()
+	c.triggerRules = triggers
+	c.rulesMu.Unlock()
+}
+
+// onPodEvent triggers a capture of a local Pod when an Event about it
+// matches a trigger rule.
+func (c *Controller) onPodEvent(event *corev1.Event) {
+	if event.InvolvedObject.Kind != "Pod" || eventTime(event).Before(c.triggersSince) {
+		return
+	}
+	pod, err := c.podLister.Pods(event.InvolvedObject.Namespace).Get(event.InvolvedObject.Name)
+	if err != nil || pod.Spec.NodeName != c.nodeName {
+		return
+	}
+	if event.InvolvedObject.UID != "" && event.InvolvedObject.UID != pod.UID {
+		return
+	}
+	conditions := triggerConditions(event, pod)
+	if len(conditions) == 0 {
+		return
+	}
+
+	c.rulesMu.RLock()
+	var (
+		rule *TriggerRule
+		cond TriggerCondition
+	)
+	for i := range c.triggerRules {
+		if matched, ok := c.triggerRules[i].Matches(pod, conditions); ok {
+			r := c.triggerRules[i]
+			rule, cond = &r, matched
+			break
+		}
+	}
+	c.rulesMu.RUnlock()
+	if rule != nil {
+		c.fireTrigger(pod, rule, cond)
+	}
+}
+
+// fireTrigger starts the capture of rule on pod unless the Pod is still in the
+// cooldown of its last triggered capture.
+func (c *Controller) fireTrigger(pod *corev1.Pod, rule *TriggerRule, cond TriggerCondition) {
+	key := podKey(pod)
+	now := c.clock.Now()
+	c.mu.Lock()
+	if last := c.triggers[key]; last != nil && now.Sub(last.fired) < last.cooldown {
+		c.mu.Unlock()
+		klog.V(2).InfoS("Ignoring capture trigger during cooldown", "pod", key, "rule", rule.Name, "condition", cond)
+		return
+	}
+	c.triggers[key] = &triggeredCapture{
+		rule:         rule.Name,
+		condition:    cond,
+		config:       rule.Config,
+		keepSessions: rule.KeepSessions,
+		cooldown:     rule.Cooldown,
+		fired:        now,
+		pending:      true,
+	}
+	c.mu.Unlock()
+
+	klog.InfoS("Capture triggered", "pod", key, "rule", rule.Name, "condition", cond)
+	c.recorder.Eventf(pod, corev1.EventTypeNormal, EventReasonCaptureTriggered,
+		"Capture triggered by %s (rule %s) on node %s", cond, rule.Name, c.nodeName)
+	c.queue.Add(key)
+}
+
+// triggeredCaptureConfig returns the capture last triggered on the Pod key,
+// and the trigger as rule/condition.
+func (c *Controller) triggeredCaptureConfig(key string) (*CaptureConfig, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.triggers[key]
+	if t == nil {
+		return nil, ""
+	}
+	cfg := t.config
+	return &cfg, t.rule + "/" + string(t.condition)
+}
+
+// takeTrigger reports whether a trigger fired on the Pod key since its
+// triggered capture was last started, and clears it.
+func (c *Controller) takeTrigger(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.triggers[key]
+	if t == nil || !t.pending {
+		return false
+	}
+	t.pending = false
+	return true
+}
+
+// sessionsToKeep returns how many sessions its schedule or trigger rule keeps
+// of the Pod key after cfg started, or 0 to keep them all, and the name of
+// the trigger rule that started cfg, if any.
+func (c *Controller) sessionsToKeep(key string, cfg *CaptureConfig) (keep int, triggerRule string) {
+	if cfg.Schedule != "" {
+		return cfg.KeepSessions, ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t := c.triggers[key]; t != nil && t.config.Equal(cfg) {
+		return t.keepSessions, t.rule
+	}
+	return 0, ""
+}
+
+// triggerConditions classifies a kubelet Event about pod, most specific
+// first. An OOM kill is only seen as the last termination reason of a
+// restarted container: the kernel's OOMKilling Event is recorded against the
+// Node, which the Pod Event informer does not watch.
+func triggerConditions(event *corev1.Event, pod *corev1.Pod) []TriggerCondition {
+	switch {
+	case event.Reason == "Unhealthy" && strings.HasPrefix(event.Message, "Readiness probe"):
+		return []TriggerCondition{TriggerReadinessProbeFailed}
+	case event.Reason == "BackOff" && strings.Contains(event.Message, "restarting failed container"),
+		event.Reason == "Killing" && strings.Contains(event.Message, "will be restarted"):
+		if lastTerminationReason(pod) == "OOMKilled" {
+			return []TriggerCondition{TriggerOOMKilled, TriggerRestart}
+		}
+		return []TriggerCondition{TriggerRestart}
+	}
+	return nil
+}
+
+// lastTerminationReason returns why a container of pod last terminated, for
+// the most recently terminated container.
+func lastTerminationReason(pod *corev1.Pod) string {
+	var (
+		reason string
+		latest time.Time
+	)
+	for _, cs := range pod.Status.ContainerStatuses {
+		if t := cs.LastTerminationState.Terminated; t != nil && !t.FinishedAt.Time.Before(latest) {
+			reason, latest = t.Reason, t.FinishedAt.Time
+		}
+	}
+	return reason
+}
+
+// eventTime returns when an Event was last observed.
+func eventTime(event *corev1.Event) time.Time {
+	switch {
+	case event.Series != nil:
+		return event.Series.LastObservedTime.Time
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	default:
+		return event.EventTime.Time
+	}
+}
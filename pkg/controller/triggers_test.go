@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func TestTriggerRules(t *testing.T) {
+	for _, data := range []string{
+		"triggers:\n- name: a\n  selector: app=web\n  files: 1\n  duration: 1m\n",                                         // no conditions
+		"triggers:\n- name: a\n  selector: app=web\n  conditions: [Evicted]\n  files: 1\n  duration: 1m\n",                // unknown condition
+		"triggers:\n- name: a\n  selector: app=web\n  conditions: [Restart]\n  files: 1\n",                                // unbounded
+		"triggers:\n- name: a\n  selector: app=web\n  conditions: [Restart]\n  files: 1\n  duration: 1m\n  cooldown: x\n", // bad cooldown
+	} {
+		if _, err := ParseTriggerRules([]byte(data)); err == nil {
+			t.Errorf("ParseTriggerRules(%q) succeeded, want error", data)
+		}
+	}
+
+	triggers, err := ParseTriggerRules([]byte(`
+triggers:
+- name: crash
+  selector: app=web
+  conditions: [OOMKilled, ReadinessProbeFailed]
+  files: 2
+  duration: 2m
+  cooldown: 30m
+  keepSessions: 5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock := testingclock.NewFakeClock(start)
+	pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web-1", UID: "u1", Labels: map[string]string{"app": "web"}},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled"}},
+		}}},
+	}
+	pods.Add(pod)
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{
+		podLister:     corelisters.NewPodLister(pods),
+		queue:         workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		nodeName:      "node-1",
+		recorder:      recorder,
+		clock:         fakeClock,
+		triggers:      map[string]*triggeredCapture{},
+		triggerRules:  triggers,
+		triggersSince: start,
+	}
+	defer c.queue.ShutDown()
+
+	event := func(reason, message string, at time.Time) *corev1.Event {
+		return &corev1.Event{
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "shop", Name: "web-1", UID: "u1"},
+			Reason:         reason,
+			Message:        message,
+			LastTimestamp:  metav1.NewTime(at),
+		}
+	}
+
+	// Events from before the controller started and unmatched conditions
+	// are ignored.
+	c.onPodEvent(event("BackOff", "Back-off restarting failed container web", start.Add(-time.Minute)))
+	c.onPodEvent(event("Pulled", "Successfully pulled image", start))
+	if cfg, _, _ := c.podCaptureConfig(pod); cfg != nil {
+		t.Fatalf("unexpected capture %+v", cfg)
+	}
+
+	c.onPodEvent(event("BackOff", "Back-off restarting failed container web", start))
+	cfg, source, err := c.podCaptureConfig(pod)
+	if err != nil || cfg == nil || cfg.MaxFiles != 2 || cfg.Duration != 2*time.Minute || source.trigger != "crash/OOMKilled" {
+		t.Fatalf("triggered capture: cfg %+v source %+v err %v", cfg, source, err)
+	}
+	if !c.takeTrigger("shop/web-1") || c.takeTrigger("shop/web-1") {
+		t.Error("a trigger must start one session")
+	}
+	if keep, rule := c.sessionsToKeep("shop/web-1", cfg); keep != 5 || rule != "crash" {
+		t.Errorf("sessions to keep = %d of rule %q", keep, rule)
+	}
+
+	// Within the cooldown further Events are ignored.
+	fakeClock.Step(10 * time.Minute)
+	c.onPodEvent(event("Unhealthy", "Readiness probe failed: connection refused", fakeClock.Now()))
+	if c.takeTrigger("shop/web-1") {
+		t.Error("trigger fired during its cooldown")
+	}
+	fakeClock.Step(30 * time.Minute)
+	c.onPodEvent(event("Unhealthy", "Readiness probe failed: connection refused", fakeClock.Now()))
+	if !c.takeTrigger("shop/web-1") {
+		t.Error("trigger did not fire after its cooldown")
+	}
+	if _, trigger := c.triggeredCaptureConfig("shop/web-1"); trigger != "crash/ReadinessProbeFailed" {
+		t.Errorf("trigger = %q", trigger)
+	}
+	if n := len(recorder.Events); n != 2 {
+		t.Errorf("expected 2 events, got %d", n)
+	}
+}
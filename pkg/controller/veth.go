@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// CaptureMode selects where tcpdump captures a Pod's traffic.
+type CaptureMode string
+
+const (
+	// CaptureModeNetns captures eth0 inside the Pod's network namespace,
+	// which nsenter enters. It needs SYS_ADMIN, SYS_PTRACE and hostPID.
+	CaptureModeNetns CaptureMode = "netns"
+	// CaptureModeVeth captures the host side of the Pod's veth pair from the
+	// host network namespace. It needs hostNetwork but no namespace entry,
+	// and keeps capturing while the Pod's containers restart.
+	CaptureModeVeth CaptureMode = "veth"
+)
+
+// ParseCaptureMode parses a --capture-mode value.
+func ParseCaptureMode(value string) (CaptureMode, error) {
+	switch mode := CaptureMode(value); mode {
+	case CaptureModeNetns, CaptureModeVeth:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown capture mode %q: want %s or %s", value, CaptureModeNetns, CaptureModeVeth)
+}
+
+// SetCaptureMode selects where captures run, CaptureModeNetns by default. It
+// must be called before Run.
+func (c *Controller) SetCaptureMode(mode CaptureMode) {
+	c.captureMode = mode
+	c.processManager.mu.Lock()
+	c.processManager.captureMode = mode
+	c.processManager.mu.Unlock()
+}
+
+// podInterface is the interface captured inside a Pod's network namespace.
+const podInterface = "eth0"
+
+// sysRoot is where interfaces are looked up in veth mode. The DaemonSet then
+// runs with hostNetwork, so its sysfs shows the host's interfaces.
+var sysRoot = "/sys"
+
+// captureTarget is where the tcpdump processes of a capture run.
+type captureTarget struct {
+	// netnsPID is the PID whose network namespace is captured, or 0 to
+	// capture from the host network namespace.
+	netnsPID int
+	iface    string
+}
+
+// command builds a tcpdump command that captures the target's interface.
+func (t captureTarget) command(ctx context.Context, tcpdumpArgs ...string) *exec.Cmd {
+	args := append([]string{"-i", t.iface}, tcpdumpArgs...)
+	if t.netnsPID != 0 {
+		return nsenterCommand(ctx, t.netnsPID, args...)
+	}
+	cmd := exec.CommandContext(ctx, "tcpdump", args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// captureTarget returns where to capture the Pod key whose first container is
+// containerID. Caller holds pm.mu.
+func (pm *ProcessManager) captureTarget(key, containerID string) (captureTarget, error) {
+	if pm.captureMode == CaptureModeVeth {
+		iface, err := pm.findHostVeth(key, containerID)
+		if err != nil {
+			return captureTarget{}, err
+		}
+		return captureTarget{iface: iface}, nil
+	}
+	pid, err := getContainerPID(containerID, pm.criSocket)
+	if err != nil {
+		return captureTarget{}, fmt.Errorf("failed to get container PID: %w", err)
+	}
+	return captureTarget{netnsPID: pid, iface: podInterface}, nil
+}
+
+// findHostVeth returns the host side of the veth pair of the Pod key. The peer
+// of the Pod's eth0 is exact, but reading it needs the container's /proc entry
+// and so hostPID. Otherwise the names the CNI gives host interfaces are
+// tried, which needs the Pod sandbox ID from the runtime.
+func (pm *ProcessManager) findHostVeth(key, containerID string) (string, error) {
+	if pid, err := getContainerPID(containerID, pm.criSocket); err == nil {
+		iface, err := peerInterface(pid)
+		if err == nil {
+			return iface, nil
+		}
+		klog.V(2).InfoS("Could not read the peer of the Pod's eth0, trying CNI interface names", "pod", key, "error", err)
+	}
+
+	sandboxID, err := getSandboxID(containerID, pm.criSocket)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the host veth of %s: %w", key, err)
+	}
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	candidates := cniInterfaceNames(namespace, name, sandboxID)
+	for _, iface := range candidates {
+		if _, err := os.Stat(filepath.Join(sysRoot, "class", "net", iface)); err == nil {
+			return iface, nil
+		}
+	}
+	return "", fmt.Errorf("no host veth of %s found, tried %s", key, strings.Join(candidates, ", "))
+}
+
+// peerInterface returns the host interface whose index is the peer index of
+// eth0 in the network namespace of pid, as seen through the container's sysfs.
+func peerInterface(pid int) (string, error) {
+	podNet := filepath.Join(procRoot, strconv.Itoa(pid), "root", "sys", "class", "net", podInterface)
+	peer, err := readIndex(filepath.Join(podNet, "iflink"))
+	if err != nil {
+		return "", err
+	}
+	if own, err := readIndex(filepath.Join(podNet, "ifindex")); err == nil && own == peer {
+		return "", fmt.Errorf("%s of process %d is not a veth", podInterface, pid)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(sysRoot, "class", "net"))
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if index, err := readIndex(filepath.Join(sysRoot, "class", "net", e.Name(), "ifindex")); err == nil && index == peer {
+			return e.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("no host interface with index %d", peer)
+}
+
+func readIndex(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// cniInterfaceNames returns the names CNIs give the host side of a Pod's
+// veth: Antrea's, from the Pod name and a hash of the sandbox ID, and
+// Calico's, from a hash of namespace.name.
+func cniInterfaceNames(namespace, name, sandboxID string) []string {
+	const (
+		antreaPrefixLength = 8
+		antreaKeyLength    = 6
+		calicoKeyLength    = 11
+	)
+	prefix := name
+	if len(prefix) > antreaPrefixLength {
+		prefix = strings.TrimLeft(prefix[:antreaPrefixLength], "-")
+	}
+	antreaKey := sha1.Sum([]byte(sandboxID))
+	calicoKey := sha1.Sum([]byte(namespace + "." + name))
+	return []string{
+		prefix + "-" + hex.EncodeToString(antreaKey[:])[:antreaKeyLength],
+		"cali" + hex.EncodeToString(calicoKey[:])[:calicoKeyLength],
+	}
+}
+
+// getSandboxID returns the ID of the Pod sandbox a container runs in, which
+// CNIs know the Pod's network by.
+var getSandboxID = func(containerID, criSocket string) (string, error) {
+	parts := strings.SplitN(containerID, "://", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid container ID format: %s", containerID)
+	}
+
+	var cmd *exec.Cmd
+	switch parts[0] {
+	case "containerd", "cri-o", "crio":
+		args := []string{"inspect", "--output", "go-template", "--template", "{{.info.sandboxID}}", parts[1]}
+		if criSocket != "" {
+			args = append([]string{"--runtime-endpoint", criSocket}, args...)
+		}
+		cmd = exec.Command("crictl", args...)
+	case "docker":
+		cmd = exec.Command("docker", "inspect", "--format", `{{index .Config.Labels "io.kubernetes.sandbox.id"}}`, parts[1])
+	default:
+		return "", fmt.Errorf("unsupported container runtime: %s", parts[0])
+	}
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get sandbox ID: %w", err)
+	}
+	id := strings.TrimSpace(string(output))
+	if id == "" || id == "<no value>" {
+		return "", fmt.Errorf("runtime reported no sandbox ID for %s", containerID)
+	}
+	return id, nil
+}
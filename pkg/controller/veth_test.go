@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCNIInterfaceNames(t *testing.T) {
+	got := cniInterfaceNames("default", "web-7d4b9c8f6-x2x9k", "4b3a8e1f0c2d")
+	if want := []string{"web-7d4b-f0c011", "calidb3a7b647df"}; !slices.Equal(got, want) {
+		t.Errorf("cniInterfaceNames = %v, want %v", got, want)
+	}
+}
+
+func TestFindHostVeth(t *testing.T) {
+	origProc, origSys, origPID, origSandbox := procRoot, sysRoot, getContainerPID, getSandboxID
+	defer func() {
+		procRoot, sysRoot, getContainerPID, getSandboxID = origProc, origSys, origPID, origSandbox
+	}()
+	procRoot, sysRoot = t.TempDir(), t.TempDir()
+	write := func(path, data string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(sysRoot, "class/net/eth0/ifindex"), "2\n")
+	write(filepath.Join(sysRoot, "class/net/web-7d4b-f0c011/ifindex"), "17\n")
+	write(filepath.Join(procRoot, "4242/root/sys/class/net/eth0/ifindex"), "3\n")
+	write(filepath.Join(procRoot, "4242/root/sys/class/net/eth0/iflink"), "17\n")
+	getSandboxID = func(containerID, criSocket string) (string, error) { return "4b3a8e1f0c2d", nil }
+	pm := NewProcessManager(1, t.TempDir(), "")
+
+	// The peer of eth0
+	getContainerPID = func(containerID, criSocket string) (int, error) { return 4242, nil }
+	if iface, err := pm.findHostVeth("default/web-7d4b9c8f6-x2x9k", "containerd://abc"); err != nil || iface != "web-7d4b-f0c011" {
+		t.Errorf("findHostVeth by peer index = %q, %v", iface, err)
+	}
+
+	// The CNI's name, for a container that is not running
+	getContainerPID = func(containerID, criSocket string) (int, error) { return 0, errors.New("not running") }
+	if iface, err := pm.findHostVeth("default/web-7d4b9c8f6-x2x9k", "containerd://abc"); err != nil || iface != "web-7d4b-f0c011" {
+		t.Errorf("findHostVeth by CNI name = %q, %v", iface, err)
+	}
+
+	if _, err := pm.findHostVeth("default/db-0", "containerd://def"); err == nil {
+		t.Error("findHostVeth found a veth for a Pod without one")
+	}
+}
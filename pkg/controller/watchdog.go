@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// StopReasonDiskPressure finishes captures when the capture filesystem runs
+// below the hard free-space threshold.
+const StopReasonDiskPressure = "DiskPressure"
+
+// ErrLowDiskSpace indicates free space or inodes on the capture filesystem are
+// below the soft threshold, so no new captures are started.
+var ErrLowDiskSpace = errors.New("capture filesystem is low on free space")
+
+// DiskWatchdogConfig sets the free-space thresholds of the capture filesystem,
+// as percentages of its size that must stay free. They apply to both bytes
+// and inodes.
+type DiskWatchdogConfig struct {
+	// SoftFreePercent: below it new captures are refused.
+	SoftFreePercent float64
+	// HardFreePercent: below it the largest running captures are stopped.
+	HardFreePercent float64
+	Interval        time.Duration
+}
+
+func (cfg DiskWatchdogConfig) enabled() bool {
+	return cfg.Interval > 0 && (cfg.SoftFreePercent > 0 || cfg.HardFreePercent > 0)
+}
+
+// diskPressure levels, ordered by severity.
+const (
+	diskPressureNone int32 = iota
+	diskPressureSoft
+	diskPressureHard
+)
+
+// diskUsage is the free share of a filesystem.
+type diskUsage struct {
+	freeBytesPercent  float64
+	freeInodesPercent float64 // 100 when the filesystem does not report inodes
+}
+
+// statDisk reports free space on the filesystem holding path.
+var statDisk = func(path string) (diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskUsage{}, err
+	}
+	usage := diskUsage{freeBytesPercent: 100, freeInodesPercent: 100}
+	if st.Blocks > 0 {
+		usage.freeBytesPercent = 100 * float64(st.Bavail) / float64(st.Blocks)
+	}
+	if st.Files > 0 {
+		usage.freeInodesPercent = 100 * float64(st.Ffree) / float64(st.Files)
+	}
+	return usage, nil
+}
+
+// SetDiskWatchdog configures the free-space watchdog. It must be called
+// before Run.
+func (c *Controller) SetDiskWatchdog(cfg DiskWatchdogConfig) {
+	c.diskWatchdog = cfg
+}
+
+// runDiskWatchdog checks the capture filesystem every interval until ctx is
+// cancelled.
+func (pm *ProcessManager) runDiskWatchdog(ctx context.Context, cfg DiskWatchdogConfig) {
+	klog.InfoS("Starting disk watchdog", "dir", pm.captureDir,
+		"softFreePercent", cfg.SoftFreePercent, "hardFreePercent", cfg.HardFreePercent, "interval", cfg.Interval)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		pm.checkDisk(cfg)
+	}, cfg.Interval)
+}
+
+// checkDisk updates the pressure level. Under hard pressure it finishes the
+// largest running capture, one per check, so captures stop growing until the
+// node recovers. Files are kept.
+func (pm *ProcessManager) checkDisk(cfg DiskWatchdogConfig) {
+	usage, err := statDisk(pm.captureDir)
+	if err != nil {
+		klog.ErrorS(err, "Failed to check capture filesystem", "dir", pm.captureDir)
+		return
+	}
+	free := min(usage.freeBytesPercent, usage.freeInodesPercent)
+
+	level := diskPressureNone
+	switch {
+	case cfg.HardFreePercent > 0 && free < cfg.HardFreePercent:
+		level = diskPressureHard
+	case cfg.SoftFreePercent > 0 && free < cfg.SoftFreePercent:
+		level = diskPressureSoft
+	}
+	if previous := pm.diskPressure.Swap(level); previous != level {
+		klog.InfoS("Capture filesystem pressure changed", "dir", pm.captureDir, "level", level,
+			"freeBytesPercent", usage.freeBytesPercent, "freeInodesPercent", usage.freeInodesPercent)
+		if level == diskPressureNone {
+			// Captures queued while under pressure can start now.
+			go pm.dispatchPending()
+		}
+	}
+	diskPressureLevel.Set(float64(level))
+
+	if level != diskPressureHard {
+		return
+	}
+
+	pm.mu.Lock()
+	var (
+		largestKey  string
+		largest     *CaptureProcess
+		largestSize int64 = -1
+	)
+	for key, capture := range pm.captures {
+		if capture.stopReason != "" {
+			continue
+		}
+		if size := filesSize(capture.filePattern); size > largestSize {
+			largestKey, largest, largestSize = key, capture, size
+		}
+	}
+	pm.mu.Unlock()
+
+	if largest != nil {
+		klog.InfoS("Stopping largest capture under disk pressure", "pod", largestKey, "bytes", largestSize,
+			"freeBytesPercent", usage.freeBytesPercent, "freeInodesPercent", usage.freeInodesPercent)
+		pm.finishCapture(largestKey, largest, StopReasonDiskPressure)
+	}
+}
+
+// checkDiskPressure refuses new captures while the filesystem is under soft
+// or hard pressure.
+func (pm *ProcessManager) checkDiskPressure() error {
+	if pm.diskPressure.Load() != diskPressureNone {
+		return fmt.Errorf("%w, not starting new captures", ErrLowDiskSpace)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDiskWatchdog_SoftThresholdRefusesCaptures(t *testing.T) {
+	originalStatDisk := statDisk
+	defer func() { statDisk = originalStatDisk }()
+
+	free := diskUsage{freeBytesPercent: 50, freeInodesPercent: 8}
+	statDisk = func(string) (diskUsage, error) { return free, nil }
+
+	pm := NewProcessManager(1, t.TempDir(), "")
+	cfg := DiskWatchdogConfig{SoftFreePercent: 10, HardFreePercent: 2}
+
+	// Inodes are below the soft threshold even though bytes are not.
+	pm.checkDisk(cfg)
+	err := pm.StartCapture(context.Background(), "test/pod", "pod", "docker://123", &CaptureConfig{MaxFiles: 1})
+	if !errors.Is(err, ErrLowDiskSpace) {
+		t.Fatalf("expected ErrLowDiskSpace, got %v", err)
+	}
+
+	free.freeInodesPercent = 40
+	pm.checkDisk(cfg)
+	if err := pm.checkDiskPressure(); err != nil {
+		t.Errorf("expected captures to be allowed after recovery, got %v", err)
+	}
+}
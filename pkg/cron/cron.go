@@ -0,0 +1,183 @@
+// Package cron parses standard five-field cron expressions and computes when
+// they next fire.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// A restricted day of month and day of week match if either matches,
+	// as in Vixie cron.
+	domRestricted, dowRestricted bool
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// Sunday is 0 or 7.
+	dowField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses "minute hour day-of-month month day-of-week", where each
+// field is "*" or a list of values and ranges with optional steps, such as
+// "0 2 * * 1-5" or "*/15 * * * *". Months and days of week may be given by
+// their three-letter English names. The macros @hourly, @daily, @midnight,
+// @weekly, @monthly, @yearly and @annually are accepted too.
+func Parse(expr string) (*Schedule, error) {
+	spec := strings.TrimSpace(expr)
+	if m, ok := macros[strings.ToLower(spec)]; ok {
+		spec = m
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: want 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &Schedule{}
+	var err error
+	if s.minute, err = minuteField.parse(fields[0]); err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+	if s.hour, err = hourField.parse(fields[1]); err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+	if s.dom, err = domField.parse(fields[2]); err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+	if s.month, err = monthField.parse(fields[3]); err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+	if s.dow, err = dowField.parse(fields[4]); err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1 << 0
+	}
+	s.domRestricted = fields[2] != "*"
+	s.dowRestricted = fields[4] != "*"
+	return s, nil
+}
+
+// parse returns the bitset of values the field matches.
+func (f field) parse(spec string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(spec, ",") {
+		rangeSpec, stepSpec, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepSpec); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s", stepSpec, f.name)
+			}
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case rangeSpec == "*":
+		case strings.Contains(rangeSpec, "-"):
+			from, to, _ := strings.Cut(rangeSpec, "-")
+			var err error
+			if lo, err = f.value(from); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(to); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q in %s", rangeSpec, f.name)
+			}
+		default:
+			v, err := f.value(rangeSpec)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if !hasStep {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f field) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q", f.name, s)
+	}
+	return v, nil
+}
+
+// maxSearch bounds Next for schedules that never fire, such as "0 0 30 2 *".
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+// Next returns the first time after t the schedule fires, in t's location,
+// or the zero time if it never does.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxSearch)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
@@ -0,0 +1,47 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2026, 3, 4, 10, 17, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 3, 4, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 3, 4, 10, 30, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2026, 3, 5, 2, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC)},
+		{"30 22 * * mon-fri", time.Date(2026, 3, 4, 22, 30, 0, 0, time.UTC)},
+		{"0 0 * * sun", time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1 * *", time.Date(2026, 4, 1, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Day of month or day of week
+		{"0 0 15 * fri", time.Date(2026, 3, 6, 0, 0, 0, 0, time.UTC)},
+		{"5,10-12 3 * * *", time.Date(2026, 3, 5, 3, 5, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("Next(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "5-1 * * * *", "*/0 * * * *", "* * * * funday"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", expr)
+		}
+	}
+}
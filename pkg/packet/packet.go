@@ -0,0 +1,210 @@
+// Package packet decodes the headers of captured Ethernet frames that capture
+// conditions are evaluated on.
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// IP protocol numbers.
+const (
+	ProtocolICMP   = 1
+	ProtocolTCP    = 6
+	ProtocolUDP    = 17
+	ProtocolICMPv6 = 58
+)
+
+// TCP flags.
+const (
+	TCPFlagFIN = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	linkTypeEthernet = 1
+)
+
+// ErrUnsupported indicates a frame that is not IP over Ethernet.
+var ErrUnsupported = errors.New("unsupported packet")
+
+// Packet is the decoded network and transport headers of a frame. Fields of
+// layers the frame does not have are zero.
+type Packet struct {
+	Src, Dst         netip.Addr
+	Protocol         uint8
+	SrcPort, DstPort uint16
+	// TCPFlags holds the TCPFlag bits of a TCP segment.
+	TCPFlags uint8
+	// Payload is the transport payload, possibly truncated by the snap
+	// length.
+	Payload []byte
+}
+
+// Decode decodes a frame of the given pcap link type. Only Ethernet, with
+// optional VLAN tags, carrying IPv4 or IPv6 is supported.
+func Decode(linkType uint32, data []byte) (*Packet, error) {
+	if linkType != linkTypeEthernet {
+		return nil, fmt.Errorf("%w: link type %d", ErrUnsupported, linkType)
+	}
+	if len(data) < 14 {
+		return nil, fmt.Errorf("truncated Ethernet header")
+	}
+	etherType := binary.BigEndian.Uint16(data[12:14])
+	data = data[14:]
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated VLAN tag")
+		}
+		etherType = binary.BigEndian.Uint16(data[2:4])
+		data = data[4:]
+	}
+
+	p := &Packet{}
+	var err error
+	switch etherType {
+	case etherTypeIPv4:
+		data, err = p.decodeIPv4(data)
+	case etherTypeIPv6:
+		data, err = p.decodeIPv6(data)
+	default:
+		return nil, fmt.Errorf("%w: EtherType %#04x", ErrUnsupported, etherType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, p.decodeTransport(data)
+}
+
+// DecodeIP decodes a packet that starts with its IPv4 or IPv6 header, such
+// as the inner packet of a tunnel without an Ethernet header.
+func DecodeIP(data []byte) (*Packet, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty IP packet")
+	}
+	p := &Packet{}
+	var err error
+	switch data[0] >> 4 {
+	case 4:
+		data, err = p.decodeIPv4(data)
+	case 6:
+		data, err = p.decodeIPv6(data)
+	default:
+		return nil, fmt.Errorf("%w: IP version %d", ErrUnsupported, data[0]>>4)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, p.decodeTransport(data)
+}
+
+// decodeIPv4 returns the IPv4 payload. Fragments after the first carry no
+// transport header and are returned without a payload.
+func (p *Packet) decodeIPv4(data []byte) ([]byte, error) {
+	if len(data) < 20 {
+		return nil, fmt.Errorf("truncated IPv4 header")
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if ihl < 20 || len(data) < ihl {
+		return nil, fmt.Errorf("invalid IPv4 header length %d", ihl)
+	}
+	p.Protocol = data[9]
+	p.Src = netip.AddrFrom4([4]byte(data[12:16]))
+	p.Dst = netip.AddrFrom4([4]byte(data[16:20]))
+	if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+		return nil, nil
+	}
+	end := int(binary.BigEndian.Uint16(data[2:4]))
+	if end < ihl || end > len(data) {
+		// Truncated by the snap length, or padded
+		end = len(data)
+	}
+	return data[ihl:end], nil
+}
+
+// decodeIPv6 returns the IPv6 payload after the extension headers the
+// transport header may follow.
+func (p *Packet) decodeIPv6(data []byte) ([]byte, error) {
+	if len(data) < 40 {
+		return nil, fmt.Errorf("truncated IPv6 header")
+	}
+	p.Src = netip.AddrFrom16([16]byte(data[8:24]))
+	p.Dst = netip.AddrFrom16([16]byte(data[24:40]))
+	next := data[6]
+	end := 40 + int(binary.BigEndian.Uint16(data[4:6]))
+	if end > len(data) {
+		end = len(data)
+	}
+	data = data[40:end]
+	for {
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(data) < 8 {
+				return nil, fmt.Errorf("truncated IPv6 extension header")
+			}
+			n := (int(data[1]) + 1) * 8
+			if len(data) < n {
+				return nil, fmt.Errorf("truncated IPv6 extension header")
+			}
+			next, data = data[0], data[n:]
+		case 44: // fragment
+			if len(data) < 8 {
+				return nil, fmt.Errorf("truncated IPv6 fragment header")
+			}
+			if binary.BigEndian.Uint16(data[2:4])&0xfff8 != 0 {
+				p.Protocol = data[0]
+				return nil, nil
+			}
+			next, data = data[0], data[8:]
+		default:
+			p.Protocol = next
+			return data, nil
+		}
+	}
+}
+
+func (p *Packet) decodeTransport(data []byte) error {
+	if data == nil {
+		return nil
+	}
+	switch p.Protocol {
+	case ProtocolTCP:
+		if len(data) < 20 {
+			return fmt.Errorf("truncated TCP header")
+		}
+		p.SrcPort = binary.BigEndian.Uint16(data[0:2])
+		p.DstPort = binary.BigEndian.Uint16(data[2:4])
+		p.TCPFlags = data[13] & 0x3f
+		off := int(data[12]>>4) * 4
+		if off < 20 || off > len(data) {
+			return fmt.Errorf("invalid TCP data offset %d", off)
+		}
+		p.Payload = data[off:]
+	case ProtocolUDP:
+		if len(data) < 8 {
+			return fmt.Errorf("truncated UDP header")
+		}
+		p.SrcPort = binary.BigEndian.Uint16(data[0:2])
+		p.DstPort = binary.BigEndian.Uint16(data[2:4])
+		p.Payload = data[8:]
+	default:
+		p.Payload = data
+	}
+	return nil
+}
+
+// HasFlags reports whether all the given TCP flags are set.
+func (p *Packet) HasFlags(flags uint8) bool {
+	return p.Protocol == ProtocolTCP && p.TCPFlags&flags == flags
+}
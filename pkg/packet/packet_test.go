@@ -0,0 +1,146 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+// tcpFrame builds an Ethernet/IPv4/TCP frame.
+func tcpFrame(src, dst string, srcPort, dstPort uint16, flags uint8, payload string) []byte {
+	frame := make([]byte, 14+20+20)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv4)
+	ip := frame[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(40+len(payload)))
+	ip[9] = ProtocolTCP
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(ip[12:16], s[:])
+	copy(ip[16:20], d[:])
+	tcp := ip[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:4], dstPort)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	return append(frame, payload...)
+}
+
+func TestDecode(t *testing.T) {
+	p, err := Decode(1, tcpFrame("10.0.0.1", "10.0.0.2", 5432, 40000, TCPFlagRST|TCPFlagACK, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Src != netip.MustParseAddr("10.0.0.1") || p.DstPort != 40000 || !p.HasFlags(TCPFlagRST) {
+		t.Errorf("decoded %+v", p)
+	}
+	if got, want := p.String(), "tcp 10.0.0.1:5432 > 10.0.0.2:40000 [RST,ACK]"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	// IPv6 UDP behind a VLAN tag
+	frame := make([]byte, 14+4+40+8)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeVLAN)
+	binary.BigEndian.PutUint16(frame[16:18], etherTypeIPv6)
+	ip := frame[18:]
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], 8)
+	ip[6] = ProtocolUDP
+	ip[23] = 1
+	ip[39] = 2
+	binary.BigEndian.PutUint16(ip[40:42], 53)
+	binary.BigEndian.PutUint16(ip[42:44], 5353)
+	p, err = Decode(1, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Src != netip.MustParseAddr("::1") || p.Protocol != ProtocolUDP || p.SrcPort != 53 {
+		t.Errorf("decoded %+v", p)
+	}
+
+	if _, err := Decode(1, []byte{1, 2, 3}); err == nil {
+		t.Error("decoded a truncated frame")
+	}
+}
+
+func TestPredicate(t *testing.T) {
+	rst := tcpFrame("10.0.0.5", "10.0.1.7", 5432, 40000, TCPFlagRST, "")
+	http503 := tcpFrame("10.0.1.7", "10.0.0.5", 80, 40001, TCPFlagPSH|TCPFlagACK, "HTTP/1.1 503 Service Unavailable\r\n")
+	get := tcpFrame("10.0.0.5", "10.0.1.7", 40001, 80, TCPFlagPSH|TCPFlagACK, "GET / HTTP/1.1\r\n")
+
+	tests := []struct {
+		expr  string
+		frame []byte
+		want  bool
+	}{
+		{"proto=tcp src=10.0.0.5 tcp.flags=rst", rst, true},
+		{"tcp.flags=rst", get, false},
+		{"src=10.0.0.0/24 port=5432", rst, true},
+		{"host=10.0.1.7 dst.port=40000", rst, true},
+		{"src.port!=5432", rst, false},
+		{"http.status=503", http503, true},
+		{"http.status=503", get, false},
+		{"http.method=get dst.port=80", get, true},
+		{"proto=udp", rst, false},
+	}
+	for _, tt := range tests {
+		pr, err := ParsePredicate(tt.expr)
+		if err != nil {
+			t.Fatalf("ParsePredicate(%q): %v", tt.expr, err)
+		}
+		p, err := Decode(1, tt.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pr.Match(p); got != tt.want {
+			t.Errorf("%q matched %s = %v, want %v", tt.expr, p, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"", "proto", "proto=sctpx", "port=http", "tcp.flags=nope", "src=10.0.0.300", "http.status=5", "ttl=3"} {
+		if _, err := ParsePredicate(expr); err == nil {
+			t.Errorf("ParsePredicate(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+// tunnelFrame encapsulates inner in an Ethernet/IPv4/UDP frame to dstPort
+// after the tunnel header hdr.
+func tunnelFrame(dstPort uint16, hdr, inner []byte) []byte {
+	frame := make([]byte, 14+20+8)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv4)
+	ip := frame[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(28+len(hdr)+len(inner)))
+	ip[9] = ProtocolUDP
+	copy(ip[12:16], []byte{192, 168, 77, 2})
+	copy(ip[16:20], []byte{192, 168, 77, 3})
+	binary.BigEndian.PutUint16(ip[20:22], 43210)
+	binary.BigEndian.PutUint16(ip[22:24], dstPort)
+	frame = append(frame, hdr...)
+	return append(frame, inner...)
+}
+
+func TestDecapsulate(t *testing.T) {
+	inner := tcpFrame("10.10.0.5", "10.10.1.7", 40000, 80, TCPFlagSYN, "")
+	geneveOptions := []byte{0x01, 0x02, 0x80, 0x01, 0, 0, 0, 0}
+	for _, tc := range []struct {
+		frame []byte
+		want  string
+	}{
+		{tunnelFrame(PortVXLAN, []byte{0x08, 0, 0, 0, 0, 0, 0x2a, 0}, inner), "vxlan vni=42 192.168.77.2:43210 > 192.168.77.3:4789"},
+		{tunnelFrame(PortGeneve, append([]byte{0x02, 0, 0x65, 0x58, 0, 0x13, 0xe8, 0}, geneveOptions...), inner), "geneve vni=5096 192.168.77.2:43210 > 192.168.77.3:6081"},
+	} {
+		tunnel, got, err := Decapsulate(1, tc.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tunnel.String() != tc.want || string(got) != string(inner) {
+			t.Errorf("Decapsulate = %q, %x; want %q, %x", tunnel, got, tc.want, inner)
+		}
+	}
+
+	if _, _, err := Decapsulate(1, inner); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Decapsulate of a TCP frame: %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Predicate is a condition on decoded packets, parsed by ParsePredicate.
+type Predicate struct {
+	expr  string
+	terms []term
+}
+
+type term struct {
+	negate bool
+	match  func(*Packet) bool
+}
+
+var tcpFlagNames = map[string]uint8{
+	"fin": TCPFlagFIN,
+	"syn": TCPFlagSYN,
+	"rst": TCPFlagRST,
+	"psh": TCPFlagPSH,
+	"ack": TCPFlagACK,
+	"urg": TCPFlagURG,
+}
+
+var protocolNames = map[string]uint8{
+	"icmp":  ProtocolICMP,
+	"tcp":   ProtocolTCP,
+	"udp":   ProtocolUDP,
+	"icmp6": ProtocolICMPv6,
+}
+
+// ParsePredicate parses space-separated terms that must all hold, each
+// field=value or field!=value. The fields are:
+//
+//	proto                   tcp, udp, icmp, icmp6 or a protocol number
+//	host, src, dst          an address or CIDR prefix; host matches either end
+//	port, src.port, dst.port
+//	tcp.flags               flags that must all be set, e.g. rst or syn,ack
+//	http.status             the status code of an HTTP/1.x response
+//	http.method             the method of an HTTP/1.x request
+//
+// For example "proto=tcp src=10.0.0.5 tcp.flags=rst" or "http.status=503".
+func ParsePredicate(expr string) (*Predicate, error) {
+	fields := strings.Fields(expr)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty packet predicate")
+	}
+	p := &Predicate{expr: strings.Join(fields, " ")}
+	for _, f := range fields {
+		t, err := parseTerm(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid packet predicate %q: %w", expr, err)
+		}
+		p.terms = append(p.terms, t)
+	}
+	return p, nil
+}
+
+func parseTerm(s string) (term, error) {
+	var t term
+	name, value, ok := strings.Cut(s, "!=")
+	if ok {
+		t.negate = true
+	} else if name, value, ok = strings.Cut(s, "="); !ok {
+		return t, fmt.Errorf("term %q is not field=value", s)
+	}
+	if value == "" {
+		return t, fmt.Errorf("term %q has no value", s)
+	}
+
+	switch name {
+	case "proto":
+		proto, ok := protocolNames[value]
+		if !ok {
+			n, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return t, fmt.Errorf("unknown protocol %q", value)
+			}
+			proto = uint8(n)
+		}
+		t.match = func(p *Packet) bool { return p.Protocol == proto }
+	case "host", "src", "dst":
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return t, err
+		}
+		switch name {
+		case "host":
+			t.match = func(p *Packet) bool { return prefix.Contains(p.Src) || prefix.Contains(p.Dst) }
+		case "src":
+			t.match = func(p *Packet) bool { return prefix.Contains(p.Src) }
+		default:
+			t.match = func(p *Packet) bool { return prefix.Contains(p.Dst) }
+		}
+	case "port", "src.port", "dst.port":
+		n, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return t, fmt.Errorf("invalid port %q", value)
+		}
+		port := uint16(n)
+		switch name {
+		case "port":
+			t.match = func(p *Packet) bool { return hasPorts(p) && (p.SrcPort == port || p.DstPort == port) }
+		case "src.port":
+			t.match = func(p *Packet) bool { return hasPorts(p) && p.SrcPort == port }
+		default:
+			t.match = func(p *Packet) bool { return hasPorts(p) && p.DstPort == port }
+		}
+	case "tcp.flags":
+		var flags uint8
+		for _, f := range strings.Split(value, ",") {
+			flag, ok := tcpFlagNames[f]
+			if !ok {
+				return t, fmt.Errorf("unknown TCP flag %q", f)
+			}
+			flags |= flag
+		}
+		t.match = func(p *Packet) bool { return p.HasFlags(flags) }
+	case "http.status":
+		if n, err := strconv.Atoi(value); err != nil || n < 100 || n > 999 {
+			return t, fmt.Errorf("invalid HTTP status %q", value)
+		}
+		t.match = func(p *Packet) bool { return httpStatus(p) == value }
+	case "http.method":
+		method := []byte(strings.ToUpper(value) + " ")
+		t.match = func(p *Packet) bool { return p.Protocol == ProtocolTCP && bytes.HasPrefix(p.Payload, method) }
+	default:
+		return t, fmt.Errorf("unknown field %q", name)
+	}
+	return t, nil
+}
+
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return prefix, fmt.Errorf("invalid prefix %q", value)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q", value)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func hasPorts(p *Packet) bool {
+	return p.Protocol == ProtocolTCP || p.Protocol == ProtocolUDP
+}
+
+// httpStatus returns the status code of a segment starting an HTTP/1.x
+// response, or "".
+func httpStatus(p *Packet) string {
+	const prefix = "HTTP/1."
+	payload := p.Payload
+	if p.Protocol != ProtocolTCP || len(payload) < len(prefix)+5 || !bytes.HasPrefix(payload, []byte(prefix)) {
+		return ""
+	}
+	// HTTP/1.1 503
+	rest := payload[len(prefix)+1:]
+	if rest[0] != ' ' {
+		return ""
+	}
+	return string(rest[1:4])
+}
+
+// Match reports whether the packet satisfies every term.
+func (pr *Predicate) Match(p *Packet) bool {
+	for _, t := range pr.terms {
+		if t.match(p) == t.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the predicate in normalized form.
+func (pr *Predicate) String() string {
+	return pr.expr
+}
+
+// String summarises the packet, e.g. "tcp 10.0.0.1:5432 > 10.0.0.2:40000 [RST,ACK]".
+func (p *Packet) String() string {
+	var b strings.Builder
+	b.WriteString(ProtocolName(p.Protocol))
+	b.WriteByte(' ')
+	if hasPorts(p) {
+		b.WriteString(netip.AddrPortFrom(p.Src, p.SrcPort).String())
+		b.WriteString(" > ")
+		b.WriteString(netip.AddrPortFrom(p.Dst, p.DstPort).String())
+	} else {
+		b.WriteString(p.Src.String())
+		b.WriteString(" > ")
+		b.WriteString(p.Dst.String())
+	}
+	if flags := TCPFlagString(p.TCPFlags); p.Protocol == ProtocolTCP && flags != "" {
+		b.WriteString(" [" + flags + "]")
+	}
+	if status := httpStatus(p); status != "" {
+		b.WriteString(" HTTP " + status)
+	}
+	return b.String()
+}
+
+// ProtocolName returns the name of an IP protocol, e.g. "tcp", or its number
+// if it has none.
+func ProtocolName(protocol uint8) string {
+	for name, n := range protocolNames {
+		if n == protocol {
+			return name
+		}
+	}
+	return strconv.Itoa(int(protocol))
+}
+
+// TCPFlagString returns the names of the TCPFlag bits set in flags, e.g.
+// "SYN,ACK".
+func TCPFlagString(flags uint8) string {
+	var names []string
+	for _, name := range []string{"syn", "fin", "rst", "psh", "ack", "urg"} {
+		if flags&tcpFlagNames[name] != 0 {
+			names = append(names, strings.ToUpper(name))
+		}
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,81 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// Tunnel UDP ports.
+const (
+	PortVXLAN  = 4789
+	PortGeneve = 6081
+)
+
+// etherTypeTransparentBridging is the Geneve protocol type of an inner
+// Ethernet frame.
+const etherTypeTransparentBridging = 0x6558
+
+// Tunnel is the encapsulation of an overlay packet.
+type Tunnel struct {
+	// Protocol is "vxlan" or "geneve".
+	Protocol string
+	VNI      uint32
+	// Src and Dst are the outer tunnel endpoints.
+	Src, Dst netip.AddrPort
+}
+
+// String describes the encapsulation, e.g.
+// "vxlan vni=1 192.168.77.2:43210 > 192.168.77.3:4789".
+func (t Tunnel) String() string {
+	return fmt.Sprintf("%s vni=%d %s > %s", t.Protocol, t.VNI, t.Src, t.Dst)
+}
+
+// Decapsulate returns the encapsulation of a VXLAN or Geneve frame of the
+// given pcap link type and the inner Ethernet frame it carries. Tunnels are
+// recognised by their standard UDP destination ports. It returns
+// ErrUnsupported for a frame that is not such a packet.
+func Decapsulate(linkType uint32, data []byte) (Tunnel, []byte, error) {
+	p, err := Decode(linkType, data)
+	if err != nil {
+		return Tunnel{}, nil, err
+	}
+	if p.Protocol != ProtocolUDP {
+		return Tunnel{}, nil, fmt.Errorf("%w: not a tunnel packet", ErrUnsupported)
+	}
+	t := Tunnel{
+		Src: netip.AddrPortFrom(p.Src, p.SrcPort),
+		Dst: netip.AddrPortFrom(p.Dst, p.DstPort),
+	}
+	payload := p.Payload
+	switch p.DstPort {
+	case PortVXLAN:
+		t.Protocol = "vxlan"
+		if len(payload) < 8 {
+			return Tunnel{}, nil, fmt.Errorf("truncated VXLAN header")
+		}
+		if payload[0]&0x08 == 0 {
+			return Tunnel{}, nil, fmt.Errorf("VXLAN header without a valid VNI")
+		}
+		t.VNI = binary.BigEndian.Uint32(payload[4:8]) >> 8
+		return t, payload[8:], nil
+	case PortGeneve:
+		t.Protocol = "geneve"
+		if len(payload) < 8 {
+			return Tunnel{}, nil, fmt.Errorf("truncated Geneve header")
+		}
+		if version := payload[0] >> 6; version != 0 {
+			return Tunnel{}, nil, fmt.Errorf("%w: Geneve version %d", ErrUnsupported, version)
+		}
+		if proto := binary.BigEndian.Uint16(payload[2:4]); proto != etherTypeTransparentBridging {
+			return Tunnel{}, nil, fmt.Errorf("%w: Geneve protocol type %#04x", ErrUnsupported, proto)
+		}
+		n := 8 + int(payload[0]&0x3f)*4
+		if len(payload) < n {
+			return Tunnel{}, nil, fmt.Errorf("truncated Geneve options")
+		}
+		t.VNI = binary.BigEndian.Uint32(payload[4:8]) >> 8
+		return t, payload[n:], nil
+	}
+	return Tunnel{}, nil, fmt.Errorf("%w: UDP port %d is not a tunnel port", ErrUnsupported, p.DstPort)
+}
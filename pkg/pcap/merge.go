@@ -0,0 +1,80 @@
+package pcap
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+)
+
+// Merge writes the records of all readers to w in timestamp order, as
+// mergecap does. All inputs must share a link type. A truncated final record
+// in an input, as left by a file tcpdump is still writing, ends that input
+// without an error.
+func Merge(w io.Writer, readers ...*Reader) error {
+	if len(readers) == 0 {
+		return fmt.Errorf("no pcap inputs to merge")
+	}
+
+	hdr := readers[0].Header()
+	for _, r := range readers[1:] {
+		if r.Header().LinkType != hdr.LinkType {
+			return fmt.Errorf("cannot merge link types %d and %d", hdr.LinkType, r.Header().LinkType)
+		}
+		if r.Header().SnapLen > hdr.SnapLen {
+			hdr.SnapLen = r.Header().SnapLen
+		}
+	}
+
+	out, err := NewWriter(w, hdr)
+	if err != nil {
+		return err
+	}
+
+	h := &mergeHeap{}
+	for _, r := range readers {
+		if err := h.pushNext(r); err != nil {
+			return err
+		}
+	}
+	for h.Len() > 0 {
+		item := heap.Pop(h).(mergeItem)
+		if err := out.WriteRecord(item.rec); err != nil {
+			return err
+		}
+		if err := h.pushNext(item.reader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type mergeItem struct {
+	rec    *Record
+	reader *Reader
+}
+
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int           { return len(h) }
+func (h mergeHeap) Less(i, j int) bool { return h[i].rec.Timestamp.Before(h[j].rec.Timestamp) }
+func (h mergeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)        { *h = append(*h, x.(mergeItem)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// pushNext reads the next record from r onto the heap, if there is one.
+func (h *mergeHeap) pushNext(r *Reader) error {
+	rec, err := r.Next()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	heap.Push(h, mergeItem{rec: rec, reader: r})
+	return nil
+}
@@ -0,0 +1,204 @@
+// Package pcap reads and writes the classic libpcap capture file format
+// produced by tcpdump -w, and writes pcapng where packets need comments.
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	magicMicroseconds = 0xa1b2c3d4
+	magicNanoseconds  = 0xa1b23c4d
+
+	fileHeaderLen   = 24
+	recordHeaderLen = 16
+
+	// LinkTypeEthernet is the DLT_EN10MB link type used by tcpdump on eth0.
+	LinkTypeEthernet = 1
+
+	// maxRecordLen guards against corrupt headers asking for huge buffers.
+	maxRecordLen = 1 << 20
+)
+
+// ErrBadMagic indicates the input is not a pcap file.
+var ErrBadMagic = errors.New("not a pcap file: bad magic number")
+
+// FileHeader is the global header at the start of a pcap file.
+type FileHeader struct {
+	VersionMajor uint16
+	VersionMinor uint16
+	ThisZone     int32
+	SigFigs      uint32
+	SnapLen      uint32
+	LinkType     uint32
+	// Nanosecond is set when record timestamps carry nanoseconds.
+	Nanosecond bool
+	// ByteOrder is the byte order the file was written in.
+	ByteOrder binary.ByteOrder
+}
+
+// DefaultHeader returns a header for Ethernet captures in host-independent
+// little-endian byte order.
+func DefaultHeader() FileHeader {
+	return FileHeader{
+		VersionMajor: 2,
+		VersionMinor: 4,
+		SnapLen:      262144,
+		LinkType:     LinkTypeEthernet,
+		ByteOrder:    binary.LittleEndian,
+	}
+}
+
+// Record is a single captured packet.
+type Record struct {
+	Timestamp time.Time
+	// OrigLen is the length of the packet on the wire, which may exceed
+	// len(Data) when the packet was truncated to the snap length.
+	OrigLen uint32
+	Data    []byte
+}
+
+// Reader decodes a pcap stream.
+type Reader struct {
+	r   io.Reader
+	hdr FileHeader
+	buf [recordHeaderLen]byte
+}
+
+// NewReader reads the file header from r and returns a Reader positioned at
+// the first record.
+func NewReader(r io.Reader) (*Reader, error) {
+	var raw [fileHeaderLen]byte
+	if _, err := io.ReadFull(r, raw[:]); err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %w", err)
+	}
+
+	var hdr FileHeader
+	switch {
+	case binary.LittleEndian.Uint32(raw[0:4]) == magicMicroseconds:
+		hdr.ByteOrder = binary.LittleEndian
+	case binary.BigEndian.Uint32(raw[0:4]) == magicMicroseconds:
+		hdr.ByteOrder = binary.BigEndian
+	case binary.LittleEndian.Uint32(raw[0:4]) == magicNanoseconds:
+		hdr.ByteOrder = binary.LittleEndian
+		hdr.Nanosecond = true
+	case binary.BigEndian.Uint32(raw[0:4]) == magicNanoseconds:
+		hdr.ByteOrder = binary.BigEndian
+		hdr.Nanosecond = true
+	default:
+		return nil, ErrBadMagic
+	}
+
+	bo := hdr.ByteOrder
+	hdr.VersionMajor = bo.Uint16(raw[4:6])
+	hdr.VersionMinor = bo.Uint16(raw[6:8])
+	hdr.ThisZone = int32(bo.Uint32(raw[8:12]))
+	hdr.SigFigs = bo.Uint32(raw[12:16])
+	hdr.SnapLen = bo.Uint32(raw[16:20])
+	hdr.LinkType = bo.Uint32(raw[20:24])
+
+	return &Reader{r: r, hdr: hdr}, nil
+}
+
+// Header returns the file header.
+func (r *Reader) Header() FileHeader {
+	return r.hdr
+}
+
+// Next returns the next record. It returns io.EOF at a clean end of input and
+// io.ErrUnexpectedEOF if the input ends inside a record, which is normal for
+// a file tcpdump is still writing.
+func (r *Reader) Next() (*Record, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:]); err != nil {
+		return nil, err
+	}
+
+	bo := r.hdr.ByteOrder
+	sec := bo.Uint32(r.buf[0:4])
+	frac := bo.Uint32(r.buf[4:8])
+	capLen := bo.Uint32(r.buf[8:12])
+	origLen := bo.Uint32(r.buf[12:16])
+	if capLen > maxRecordLen {
+		return nil, fmt.Errorf("pcap record length %d exceeds limit", capLen)
+	}
+
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	nsec := int64(frac) * 1000
+	if r.hdr.Nanosecond {
+		nsec = int64(frac)
+	}
+
+	return &Record{
+		Timestamp: time.Unix(int64(sec), nsec).UTC(),
+		OrigLen:   origLen,
+		Data:      data,
+	}, nil
+}
+
+// Writer encodes a pcap stream.
+type Writer struct {
+	w   io.Writer
+	hdr FileHeader
+	buf [recordHeaderLen]byte
+}
+
+// NewWriter writes the file header to w and returns a Writer for records.
+func NewWriter(w io.Writer, hdr FileHeader) (*Writer, error) {
+	if hdr.ByteOrder == nil {
+		hdr.ByteOrder = binary.LittleEndian
+	}
+
+	var raw [fileHeaderLen]byte
+	bo := hdr.ByteOrder
+	magic := uint32(magicMicroseconds)
+	if hdr.Nanosecond {
+		magic = magicNanoseconds
+	}
+	bo.PutUint32(raw[0:4], magic)
+	bo.PutUint16(raw[4:6], hdr.VersionMajor)
+	bo.PutUint16(raw[6:8], hdr.VersionMinor)
+	bo.PutUint32(raw[8:12], uint32(hdr.ThisZone))
+	bo.PutUint32(raw[12:16], hdr.SigFigs)
+	bo.PutUint32(raw[16:20], hdr.SnapLen)
+	bo.PutUint32(raw[20:24], hdr.LinkType)
+
+	if _, err := w.Write(raw[:]); err != nil {
+		return nil, fmt.Errorf("failed to write pcap header: %w", err)
+	}
+	return &Writer{w: w, hdr: hdr}, nil
+}
+
+// WriteRecord appends a record.
+func (w *Writer) WriteRecord(rec *Record) error {
+	bo := w.hdr.ByteOrder
+	frac := uint32(rec.Timestamp.Nanosecond() / 1000)
+	if w.hdr.Nanosecond {
+		frac = uint32(rec.Timestamp.Nanosecond())
+	}
+	origLen := rec.OrigLen
+	if origLen < uint32(len(rec.Data)) {
+		origLen = uint32(len(rec.Data))
+	}
+
+	bo.PutUint32(w.buf[0:4], uint32(rec.Timestamp.Unix()))
+	bo.PutUint32(w.buf[4:8], frac)
+	bo.PutUint32(w.buf[8:12], uint32(len(rec.Data)))
+	bo.PutUint32(w.buf[12:16], origLen)
+
+	if _, err := w.w.Write(w.buf[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(rec.Data)
+	return err
+}
@@ -0,0 +1,138 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWriterReaderRoundTrip(t *testing.T) {
+	for _, hdr := range []FileHeader{
+		DefaultHeader(),
+		{VersionMajor: 2, VersionMinor: 4, SnapLen: 65535, LinkType: LinkTypeEthernet, ByteOrder: binary.BigEndian, Nanosecond: true},
+	} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, hdr)
+		if err != nil {
+			t.Fatalf("NewWriter: %v", err)
+		}
+		ts := time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC)
+		in := []*Record{
+			{Timestamp: ts, OrigLen: 1500, Data: []byte{1, 2, 3, 4}},
+			{Timestamp: ts.Add(time.Second), Data: []byte{5, 6}},
+		}
+		for _, rec := range in {
+			if err := w.WriteRecord(rec); err != nil {
+				t.Fatalf("WriteRecord: %v", err)
+			}
+		}
+
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Fatalf("NewReader: %v", err)
+		}
+		if got := r.Header(); got.Nanosecond != hdr.Nanosecond || got.SnapLen != hdr.SnapLen || got.ByteOrder != hdr.ByteOrder {
+			t.Errorf("header mismatch: got %+v, want %+v", got, hdr)
+		}
+		for i, want := range in {
+			got, err := r.Next()
+			if err != nil {
+				t.Fatalf("Next %d: %v", i, err)
+			}
+			if !got.Timestamp.Equal(want.Timestamp) || !bytes.Equal(got.Data, want.Data) {
+				t.Errorf("record %d: got %v %x, want %v %x", i, got.Timestamp, got.Data, want.Timestamp, want.Data)
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Errorf("expected io.EOF, got %v", err)
+		}
+	}
+}
+
+func TestReaderBadMagic(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader(make([]byte, 24))); err != ErrBadMagic {
+		t.Errorf("expected ErrBadMagic, got %v", err)
+	}
+}
+
+func TestMergeOrdersByTimestamp(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	write := func(offsets ...int) *Reader {
+		var buf bytes.Buffer
+		w, _ := NewWriter(&buf, DefaultHeader())
+		for _, o := range offsets {
+			w.WriteRecord(&Record{Timestamp: base.Add(time.Duration(o) * time.Second), Data: []byte{byte(o)}})
+		}
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	var out bytes.Buffer
+	if err := Merge(&out, write(1, 4, 5), write(2, 3), write(0)); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+
+	r, err := NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := 0; want <= 5; want++ {
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if rec.Data[0] != byte(want) {
+			t.Errorf("record %d: got %d", want, rec.Data[0])
+		}
+	}
+}
+
+func TestNgWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewNgWriter(&buf, LinkTypeEthernet, 65535)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 123456789)
+	if err := w.WriteRecord(&Record{Timestamp: ts, OrigLen: 100, Data: []byte{1, 2, 3, 4, 5}}, "vxlan vni=1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteRecord(&Record{Timestamp: ts, Data: []byte{6}}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var blocks []uint32
+	data := buf.Bytes()
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %x", data)
+		}
+		blockType, length := binary.LittleEndian.Uint32(data[0:4]), binary.LittleEndian.Uint32(data[4:8])
+		if length%4 != 0 || int(length) > len(data) || binary.LittleEndian.Uint32(data[length-4:length]) != length {
+			t.Fatalf("block %#x has bad length %d", blockType, length)
+		}
+		blocks = append(blocks, blockType)
+		if blockType == blockEnhancedPacket && len(blocks) == 3 {
+			body := data[8 : length-4]
+			if got := uint64(binary.LittleEndian.Uint32(body[4:8]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:12])); got != uint64(ts.UnixNano()) {
+				t.Errorf("timestamp = %d, want %d", got, ts.UnixNano())
+			}
+			if capLen, origLen := binary.LittleEndian.Uint32(body[12:16]), binary.LittleEndian.Uint32(body[16:20]); capLen != 5 || origLen != 100 {
+				t.Errorf("lengths = %d, %d", capLen, origLen)
+			}
+			opts := body[20+8:]
+			if code, n := binary.LittleEndian.Uint16(opts[0:2]), binary.LittleEndian.Uint16(opts[2:4]); code != optComment || string(opts[4:4+n]) != "vxlan vni=1" {
+				t.Errorf("option %d = %q", code, opts[4:4+n])
+			}
+		}
+		data = data[length:]
+	}
+	if want := []uint32{blockSectionHeader, blockInterface, blockEnhancedPacket, blockEnhancedPacket}; len(blocks) != len(want) {
+		t.Errorf("blocks = %#x, want %#x", blocks, want)
+	}
+}
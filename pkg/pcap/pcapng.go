@@ -0,0 +1,118 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// pcapng block types and options, from the pcapng specification.
+const (
+	blockSectionHeader  = 0x0a0d0d0a
+	blockInterface      = 0x00000001
+	blockEnhancedPacket = 0x00000006
+
+	byteOrderMagic = 0x1a2b3c4d
+
+	optEndOfOpt = 0
+	optComment  = 1
+	optTSResol  = 9
+
+	// tsResolNanoseconds is the if_tsresol value for nanosecond
+	// timestamps.
+	tsResolNanoseconds = 9
+)
+
+// NgWriter encodes a pcapng stream with one section and one interface, so
+// that records can carry comments. It writes little-endian blocks with
+// nanosecond timestamps.
+type NgWriter struct {
+	w io.Writer
+}
+
+// NewNgWriter writes the section header and the interface description for
+// linkType and snapLen to w and returns a Writer for records.
+func NewNgWriter(w io.Writer, linkType, snapLen uint32) (*NgWriter, error) {
+	var shb [16]byte
+	binary.LittleEndian.PutUint32(shb[0:4], byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1) // version 1.0
+	// The section length is unknown (-1)
+	binary.LittleEndian.PutUint64(shb[8:16], ^uint64(0))
+	if err := writeBlock(w, blockSectionHeader, shb[:], nil); err != nil {
+		return nil, fmt.Errorf("failed to write pcapng section header: %w", err)
+	}
+
+	var idb [8]byte
+	binary.LittleEndian.PutUint16(idb[0:2], uint16(linkType))
+	binary.LittleEndian.PutUint32(idb[4:8], snapLen)
+	opts := []option{{code: optTSResol, value: []byte{tsResolNanoseconds}}}
+	if err := writeBlock(w, blockInterface, idb[:], opts); err != nil {
+		return nil, fmt.Errorf("failed to write pcapng interface description: %w", err)
+	}
+	return &NgWriter{w: w}, nil
+}
+
+// WriteRecord appends a record as an enhanced packet block, with comment as
+// its opt_comment unless it is empty.
+func (w *NgWriter) WriteRecord(rec *Record, comment string) error {
+	origLen := rec.OrigLen
+	if origLen < uint32(len(rec.Data)) {
+		origLen = uint32(len(rec.Data))
+	}
+	ts := uint64(rec.Timestamp.UnixNano())
+
+	body := make([]byte, 20, 20+pad4(len(rec.Data)))
+	binary.LittleEndian.PutUint32(body[0:4], 0) // interface 0
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(rec.Data)))
+	binary.LittleEndian.PutUint32(body[16:20], origLen)
+	body = append(body, rec.Data...)
+	body = append(body, make([]byte, pad4(len(rec.Data))-len(rec.Data))...)
+
+	var opts []option
+	if comment != "" {
+		opts = append(opts, option{code: optComment, value: []byte(comment)})
+	}
+	return writeBlock(w.w, blockEnhancedPacket, body, opts)
+}
+
+type option struct {
+	code  uint16
+	value []byte
+}
+
+// writeBlock writes a block of the given type with a body, already padded to
+// 32 bits, and options.
+func writeBlock(w io.Writer, blockType uint32, body []byte, opts []option) error {
+	optLen := 0
+	if len(opts) > 0 {
+		for _, o := range opts {
+			optLen += 4 + pad4(len(o.value))
+		}
+		optLen += 4 // opt_endofopt
+	}
+	total := 12 + len(body) + optLen
+
+	buf := make([]byte, 0, total)
+	buf = binary.LittleEndian.AppendUint32(buf, blockType)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(total))
+	buf = append(buf, body...)
+	if len(opts) > 0 {
+		for _, o := range opts {
+			buf = binary.LittleEndian.AppendUint16(buf, o.code)
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(len(o.value)))
+			buf = append(buf, o.value...)
+			buf = append(buf, make([]byte, pad4(len(o.value))-len(o.value))...)
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, optEndOfOpt)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(total))
+	_, err := w.Write(buf)
+	return err
+}
+
+// pad4 rounds n up to a multiple of 4.
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,311 @@
+// Package summary summarises the connections in packet captures, like the
+// conversation statistics of Wireshark: for each flow, its endpoints, when it
+// was seen, what it carried each way and, for TCP, how it opened and closed.
+package summary
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/packet"
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+// Handshake states of a TCP flow.
+const (
+	// HandshakeComplete means the SYN, SYN-ACK and ACK were all seen.
+	HandshakeComplete = "complete"
+	// HandshakeIncomplete means a SYN was seen without the rest, e.g. the
+	// connection was refused or the SYN dropped.
+	HandshakeIncomplete = "incomplete"
+	// HandshakeNotSeen means the flow started before the capture.
+	HandshakeNotSeen = "not-seen"
+)
+
+// Teardown states of a TCP flow.
+const (
+	TeardownClosed     = "closed"      // FIN both ways
+	TeardownHalfClosed = "half-closed" // FIN one way
+	TeardownReset      = "reset"       // RST either way
+	TeardownOpen       = "open"        // neither
+)
+
+// Counters counts the packets of a flow one way. Bytes are frame lengths on
+// the wire, however much of them the capture kept.
+type Counters struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Flow is one connection, or for protocols without connections, the packets
+// between two endpoints. Src is the endpoint that opened it: the sender of
+// the SYN, or else of the first packet seen.
+type Flow struct {
+	Protocol string     `json:"protocol"`
+	Src      netip.Addr `json:"src"`
+	SrcPort  uint16     `json:"srcPort,omitempty"`
+	Dst      netip.Addr `json:"dst"`
+	DstPort  uint16     `json:"dstPort,omitempty"`
+	First    time.Time  `json:"first"`
+	Last     time.Time  `json:"last"`
+	// Forward counts the packets from Src to Dst, Reverse those back.
+	Forward Counters `json:"forward"`
+	Reverse Counters `json:"reverse"`
+	// TCPFlags, Handshake and Teardown are only set for TCP. TCPFlags
+	// lists the flags seen either way, e.g. "SYN,FIN,ACK".
+	TCPFlags  string `json:"tcpFlags,omitempty"`
+	Handshake string `json:"handshake,omitempty"`
+	Teardown  string `json:"teardown,omitempty"`
+}
+
+// Report is the flows of a capture, ordered by their first packet.
+type Report struct {
+	// Packets counts the packets read. Skipped counts those that are not
+	// IP over Ethernet, or too truncated to decode, and are in no flow.
+	Packets uint64 `json:"packets"`
+	Skipped uint64 `json:"skipped"`
+	Flows   []Flow `json:"flows"`
+}
+
+// flowKey identifies the flows between two endpoints, whichever way a packet
+// goes: a is the lower endpoint.
+type flowKey struct {
+	protocol uint8
+	a, b     netip.AddrPort
+}
+
+func newFlowKey(p *packet.Packet) flowKey {
+	a, b := netip.AddrPortFrom(p.Src, p.SrcPort), netip.AddrPortFrom(p.Dst, p.DstPort)
+	if b.Compare(a) < 0 {
+		a, b = b, a
+	}
+	return flowKey{protocol: p.Protocol, a: a, b: b}
+}
+
+// flowState is a Flow being accumulated.
+type flowState struct {
+	Flow
+	protocol uint8
+	flags    uint8
+	// The TCP handshake and teardown seen so far
+	syn, synAck, established bool
+	finForward, finReverse   bool
+	reset                    bool
+}
+
+// Table accumulates the flows of packets.
+type Table struct {
+	// Decapsulate summarises the inner packets of VXLAN and Geneve packets,
+	// for captures of a tunnel interface, rather than the tunnels.
+	Decapsulate bool
+
+	flows   []*flowState
+	current map[flowKey]*flowState
+	packets uint64
+	skipped uint64
+}
+
+// NewTable returns an empty Table.
+func NewTable() *Table {
+	return &Table{current: make(map[flowKey]*flowState)}
+}
+
+// Read adds the packets of r. A truncated final record ends the input.
+// Inputs are read one after another, so the files of a capture are read
+// oldest first.
+func (t *Table) Read(r *pcap.Reader) error {
+	linkType := r.Header().LinkType
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		t.Add(linkType, rec)
+	}
+}
+
+// Add adds one packet of the given pcap link type.
+func (t *Table) Add(linkType uint32, rec *pcap.Record) {
+	t.packets++
+	data, length := rec.Data, uint64(max(rec.OrigLen, uint32(len(rec.Data))))
+	if t.Decapsulate {
+		if _, inner, err := packet.Decapsulate(linkType, data); err == nil {
+			length -= uint64(len(data) - len(inner))
+			data = inner
+		}
+	}
+	p, err := packet.Decode(linkType, data)
+	if err != nil {
+		t.skipped++
+		return
+	}
+
+	key := newFlowKey(p)
+	f := t.current[key]
+	// A SYN after a flow closed opens a new one on the same ports
+	if f != nil && p.Protocol == packet.ProtocolTCP && p.TCPFlags&(packet.TCPFlagSYN|packet.TCPFlagACK) == packet.TCPFlagSYN &&
+		f.teardown() != TeardownOpen && f.teardown() != TeardownHalfClosed {
+		f = nil
+	}
+	if f == nil {
+		f = &flowState{protocol: p.Protocol, Flow: Flow{
+			Protocol: packet.ProtocolName(p.Protocol),
+			Src:      p.Src, SrcPort: p.SrcPort,
+			Dst: p.Dst, DstPort: p.DstPort,
+			First: rec.Timestamp, Last: rec.Timestamp,
+		}}
+		// A SYN-ACK comes from the end that accepted the connection
+		if p.HasFlags(packet.TCPFlagSYN | packet.TCPFlagACK) {
+			f.Src, f.SrcPort, f.Dst, f.DstPort = p.Dst, p.DstPort, p.Src, p.SrcPort
+		}
+		t.flows = append(t.flows, f)
+		t.current[key] = f
+	}
+	f.add(p, rec.Timestamp, length)
+}
+
+func (f *flowState) add(p *packet.Packet, ts time.Time, length uint64) {
+	forward := p.Src == f.Src && p.SrcPort == f.SrcPort
+	counters := &f.Reverse
+	if forward {
+		counters = &f.Forward
+	}
+	counters.Packets++
+	counters.Bytes += length
+	if ts.Before(f.First) {
+		f.First = ts
+	}
+	if ts.After(f.Last) {
+		f.Last = ts
+	}
+	if p.Protocol != packet.ProtocolTCP {
+		return
+	}
+
+	f.flags |= p.TCPFlags
+	switch p.TCPFlags & (packet.TCPFlagSYN | packet.TCPFlagACK) {
+	case packet.TCPFlagSYN:
+		f.syn = true
+	case packet.TCPFlagSYN | packet.TCPFlagACK:
+		f.synAck = true
+	case packet.TCPFlagACK:
+		if forward && f.synAck {
+			f.established = true
+		}
+	}
+	if p.TCPFlags&packet.TCPFlagFIN != 0 {
+		if forward {
+			f.finForward = true
+		} else {
+			f.finReverse = true
+		}
+	}
+	if p.TCPFlags&packet.TCPFlagRST != 0 {
+		f.reset = true
+	}
+}
+
+func (f *flowState) handshake() string {
+	switch {
+	case !f.syn:
+		return HandshakeNotSeen
+	case f.synAck && f.established:
+		return HandshakeComplete
+	default:
+		return HandshakeIncomplete
+	}
+}
+
+func (f *flowState) teardown() string {
+	switch {
+	case f.reset:
+		return TeardownReset
+	case f.finForward && f.finReverse:
+		return TeardownClosed
+	case f.finForward || f.finReverse:
+		return TeardownHalfClosed
+	default:
+		return TeardownOpen
+	}
+}
+
+// Report returns the flows added so far.
+func (t *Table) Report() *Report {
+	r := &Report{Packets: t.packets, Skipped: t.skipped, Flows: make([]Flow, len(t.flows))}
+	for i, f := range t.flows {
+		flow := f.Flow
+		flow.First, flow.Last = flow.First.UTC(), flow.Last.UTC()
+		if f.protocol == packet.ProtocolTCP {
+			flow.TCPFlags = packet.TCPFlagString(f.flags)
+			flow.Handshake = f.handshake()
+			flow.Teardown = f.teardown()
+		}
+		r.Flows[i] = flow
+	}
+	// Flows are created in the order their packets were read, which is
+	// only the order of their first packet if the inputs were in order
+	slices.SortStableFunc(r.Flows, func(a, b Flow) int { return a.First.Compare(b.First) })
+	return r
+}
+
+// Summarize reads the inputs, one after another, into a report.
+func Summarize(inputs ...*pcap.Reader) (*Report, error) {
+	t := NewTable()
+	for _, r := range inputs {
+		if err := t.Read(r); err != nil {
+			return nil, err
+		}
+	}
+	return t.Report(), nil
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// csvHeader names the columns WriteCSV writes.
+var csvHeader = []string{
+	"protocol", "src", "src_port", "dst", "dst_port", "first", "last",
+	"packets_forward", "bytes_forward", "packets_reverse", "bytes_reverse",
+	"tcp_flags", "handshake", "teardown",
+}
+
+// WriteCSV writes the flows of the report as CSV with a header row, one flow
+// per row. Times are RFC 3339 in UTC; ports are empty for protocols without
+// them.
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, f := range r.Flows {
+		cw.Write([]string{
+			f.Protocol,
+			f.Src.String(), port(f.SrcPort),
+			f.Dst.String(), port(f.DstPort),
+			f.First.Format(time.RFC3339Nano), f.Last.Format(time.RFC3339Nano),
+			strconv.FormatUint(f.Forward.Packets, 10), strconv.FormatUint(f.Forward.Bytes, 10),
+			strconv.FormatUint(f.Reverse.Packets, 10), strconv.FormatUint(f.Reverse.Bytes, 10),
+			f.TCPFlags, f.Handshake, f.Teardown,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func port(p uint16) string {
+	if p == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(p))
+}
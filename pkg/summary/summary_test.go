@@ -0,0 +1,125 @@
+package summary
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/pcap"
+)
+
+// The fixtures start at this time, one packet per millisecond.
+var start = time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+
+func summarizeFile(t *testing.T, path string) *Report {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := Summarize(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func at(ms int) time.Time {
+	return start.Add(time.Duration(ms) * time.Millisecond)
+}
+
+// session.pcap holds a DNS exchange, an HTTP request over a TCP connection
+// from handshake to FIN, an ARP frame and a ping.
+func TestSummarize(t *testing.T) {
+	report := summarizeFile(t, "testdata/session.pcap")
+	client, server, dns := netip.MustParseAddr("10.244.1.5"), netip.MustParseAddr("10.244.2.9"), netip.MustParseAddr("10.96.0.10")
+	want := &Report{Packets: 13, Skipped: 1, Flows: []Flow{
+		{Protocol: "udp", Src: client, SrcPort: 53001, Dst: dns, DstPort: 53, First: at(0), Last: at(1),
+			Forward: Counters{1, 70}, Reverse: Counters{1, 86}},
+		{Protocol: "tcp", Src: client, SrcPort: 40000, Dst: server, DstPort: 8080, First: at(2), Last: at(9),
+			Forward: Counters{5, 288}, Reverse: Counters{3, 200},
+			TCPFlags: "SYN,FIN,PSH,ACK", Handshake: HandshakeComplete, Teardown: TeardownClosed},
+		{Protocol: "icmp", Src: client, Dst: server, First: at(11), Last: at(12),
+			Forward: Counters{1, 46}, Reverse: Counters{1, 46}},
+	}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report = %+v\nwant %+v", report, want)
+	}
+}
+
+// resets.pcap holds a refused IPv6 connection, one the capture joined late,
+// a reset connection whose ports are reused, a SYN-ACK without its SYN and a
+// lone SYN.
+func TestSummarizeTCPStates(t *testing.T) {
+	report := summarizeFile(t, "testdata/resets.pcap")
+	want := []struct {
+		src                 string
+		handshake, teardown string
+	}{
+		{"[fd00::5]:41000", HandshakeIncomplete, TeardownReset},
+		{"10.244.2.9:8080", HandshakeNotSeen, TeardownOpen},
+		{"10.244.1.5:40001", HandshakeComplete, TeardownReset},
+		{"10.244.1.5:40001", HandshakeComplete, TeardownHalfClosed},
+		{"10.244.1.5:40002", HandshakeNotSeen, TeardownOpen},
+		{"10.244.1.5:40003", HandshakeIncomplete, TeardownOpen},
+	}
+	if len(report.Flows) != len(want) {
+		t.Fatalf("got %d flows, want %d: %+v", len(report.Flows), len(want), report.Flows)
+	}
+	for i, w := range want {
+		f := report.Flows[i]
+		if src := netip.AddrPortFrom(f.Src, f.SrcPort).String(); src != w.src || f.Handshake != w.handshake || f.Teardown != w.teardown {
+			t.Errorf("flow %d = %s %s/%s, want %s %s/%s", i, src, f.Handshake, f.Teardown, w.src, w.handshake, w.teardown)
+		}
+	}
+	// The SYN-ACK was sent by the server, to the client's port
+	if f := report.Flows[4]; f.Forward.Packets != 0 || f.Reverse.Packets != 1 {
+		t.Errorf("SYN-ACK counted as %+v forward, %+v reverse", f.Forward, f.Reverse)
+	}
+}
+
+func TestReportWrite(t *testing.T) {
+	report := summarizeFile(t, "testdata/session.pcap")
+
+	var buf bytes.Buffer
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, report) {
+		t.Errorf("JSON round trip = %+v, want %+v", decoded, report)
+	}
+
+	buf.Reset()
+	if err := report.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1+len(report.Flows) || !reflect.DeepEqual(rows[0], csvHeader) {
+		t.Fatalf("CSV = %q", rows)
+	}
+	want := []string{"tcp", "10.244.1.5", "40000", "10.244.2.9", "8080", "2026-03-01T12:30:00.002Z", "2026-03-01T12:30:00.009Z",
+		"5", "288", "3", "200", "SYN,FIN,PSH,ACK", "complete", "closed"}
+	if !reflect.DeepEqual(rows[2], want) {
+		t.Errorf("CSV row = %q, want %q", rows[2], want)
+	}
+	if rows[3][2] != "" || rows[3][4] != "" {
+		t.Errorf("ICMP row has ports: %q", rows[3])
+	}
+}
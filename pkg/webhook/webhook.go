@@ -0,0 +1,152 @@
+// Package webhook implements a validating admission webhook that rejects Pods
+// and workloads with capture annotations the controller would refuse.
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/controller"
+)
+
+// maxRequestBytes bounds an AdmissionReview body; the API server sends at
+// most a few MB per object.
+const maxRequestBytes = 8 << 20
+
+// filterTimeout bounds compiling one filter with tcpdump.
+const filterTimeout = 5 * time.Second
+
+// Validator reviews Pod admission requests.
+type Validator struct {
+	limits     controller.Limits
+	priorities controller.PriorityPolicy
+	// compileFilter checks filter syntax; nil skips the check.
+	compileFilter func(ctx context.Context, filter string) error
+}
+
+// NewValidator creates a Validator enforcing the same limits and priority
+// policy as the controller. With checkFilters, filters are compiled by
+// tcpdump, which must be installed.
+func NewValidator(limits controller.Limits, priorities controller.PriorityPolicy, checkFilters bool) *Validator {
+	v := &Validator{limits: limits, priorities: priorities}
+	if checkFilters {
+		v.compileFilter = controller.CompileFilter
+	}
+	return v
+}
+
+// ServeHTTP handles an admission.k8s.io/v1 AdmissionReview.
+func (v *Validator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = v.Review(r.Context(), review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		klog.ErrorS(err, "Failed to write admission response")
+	}
+}
+
+// reviewedKinds are the kinds whose capture annotations are validated: Pods
+// and the workloads and Namespaces whose annotations Pods inherit.
+var reviewedKinds = map[string]bool{
+	"Pod":         true,
+	"Namespace":   true,
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+	"ReplicaSet":  true,
+	"Job":         true,
+}
+
+// Review admits or denies one request.
+func (v *Validator) Review(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if !reviewedKinds[req.Kind.Kind] {
+		return allowed()
+	}
+
+	obj := &metav1.PartialObjectMetadata{}
+	if err := json.Unmarshal(req.Object.Raw, obj); err != nil {
+		return denied(fmt.Sprintf("failed to decode %s: %v", req.Kind.Kind, err))
+	}
+	if req.Operation == admissionv1.Update && len(req.OldObject.Raw) > 0 {
+		old := &metav1.PartialObjectMetadata{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err == nil &&
+			maps.Equal(controller.CaptureRequestAnnotations(old.Annotations), controller.CaptureRequestAnnotations(obj.Annotations)) {
+			// Let unrelated updates through, including the controller's own
+			// status writes on a Pod whose request it already refused.
+			return allowed()
+		}
+	}
+
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = obj.Namespace
+	}
+	if req.Kind.Kind == "Namespace" {
+		namespace = obj.Name
+	}
+	cfg, err := controller.ValidateAnnotations(namespace, obj.Annotations, v.limits, v.priorities)
+	if err == nil && cfg != nil && v.compileFilter != nil {
+		filterCtx, cancel := context.WithTimeout(ctx, filterTimeout)
+		err = v.compileFilter(filterCtx, cfg.Filter)
+		if err == nil {
+			err = v.compileFilter(filterCtx, cfg.StopOnFilter)
+		}
+		cancel()
+	}
+	if err != nil {
+		klog.V(2).InfoS("Denied capture annotations", "kind", req.Kind.Kind, "object", klog.KRef(namespace, objectName(req, obj)), "err", err)
+		return denied(err.Error())
+	}
+	return allowed()
+}
+
+func objectName(req *admissionv1.AdmissionRequest, obj *metav1.PartialObjectMetadata) string {
+	if req.Name != "" {
+		return req.Name
+	}
+	if obj.Name != "" {
+		return obj.Name
+	}
+	return obj.GenerateName
+}
+
+func allowed() *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+func denied(msg string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusUnprocessableEntity,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: "capture annotations: " + msg,
+		},
+	}
+}
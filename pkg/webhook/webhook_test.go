@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/Av1ralS1ngh/antrea-packet-capture/pkg/controller"
+)
+
+// podRaw encodes a Pod. Only its metadata is reviewed, so it stands in for
+// workloads too.
+func podRaw(t *testing.T, annotations map[string]string) runtime.RawExtension {
+	t.Helper()
+	data, err := json.Marshal(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-a", Annotations: annotations}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runtime.RawExtension{Raw: data}
+}
+
+func TestReview(t *testing.T) {
+	v := NewValidator(controller.Limits{MaxFiles: 10, MaxDuration: time.Hour}, controller.PriorityPolicy{"sre": 100}, false)
+	v.compileFilter = func(ctx context.Context, filter string) error {
+		if filter == "tcp prot 80" {
+			return errors.New("syntax error")
+		}
+		return nil
+	}
+	valid := map[string]string{controller.AnnotationKey: "3", controller.DurationAnnotationKey: "10m"}
+
+	tests := []struct {
+		name        string
+		kind        string // default Pod
+		operation   admissionv1.Operation
+		annotations map[string]string
+		old         map[string]string
+		wantAllowed bool
+	}{
+		{name: "no capture", operation: admissionv1.Create, wantAllowed: true},
+		{name: "valid", operation: admissionv1.Create, annotations: valid, wantAllowed: true},
+		{name: "malformed files", operation: admissionv1.Create, annotations: map[string]string{controller.AnnotationKey: "many"}},
+		{name: "over file limit", operation: admissionv1.Create, annotations: map[string]string{controller.AnnotationKey: "50", controller.DurationAnnotationKey: "10m"}},
+		{name: "missing duration", operation: admissionv1.Create, annotations: map[string]string{controller.AnnotationKey: "3"}},
+		{name: "priority not allowed", operation: admissionv1.Create, annotations: map[string]string{controller.AnnotationKey: "3", controller.DurationAnnotationKey: "10m", controller.PriorityAnnotationKey: "5"}},
+		{name: "unknown key", operation: admissionv1.Create, annotations: map[string]string{controller.AnnotationKey: "3", controller.DurationAnnotationKey: "10m", "tcpdump.antrea.io/filtre": "tcp"}},
+		{name: "invalid filter", operation: admissionv1.Create, annotations: map[string]string{controller.AnnotationKey: "3", controller.DurationAnnotationKey: "10m", controller.FilterAnnotationKey: "tcp prot 80"}},
+		{name: "invalid stop filter", operation: admissionv1.Create, annotations: map[string]string{controller.AnnotationKey: "3", controller.DurationAnnotationKey: "10m", controller.StopOnFilterAnnotationKey: "tcp prot 80"}},
+		{
+			name:        "status update on unchanged request",
+			operation:   admissionv1.Update,
+			annotations: map[string]string{controller.AnnotationKey: "many", controller.StatusAnnotationKey: `{"phase":"Failed"}`},
+			old:         map[string]string{controller.AnnotationKey: "many"},
+			wantAllowed: true,
+		},
+		{name: "invalid workload", kind: "Deployment", operation: admissionv1.Create, annotations: map[string]string{controller.AnnotationKey: "many"}},
+		{name: "namespace priority", kind: "Namespace", operation: admissionv1.Create, annotations: map[string]string{controller.AnnotationKey: "3", controller.DurationAnnotationKey: "10m", controller.PriorityAnnotationKey: "5"}},
+		{name: "other kind", kind: "ConfigMap", operation: admissionv1.Create, annotations: map[string]string{controller.AnnotationKey: "many"}, wantAllowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind := tt.kind
+			if kind == "" {
+				kind = "Pod"
+			}
+			req := &admissionv1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: kind},
+				Namespace: "team-a",
+				Operation: tt.operation,
+				Object:    podRaw(t, tt.annotations),
+			}
+			if tt.operation == admissionv1.Update {
+				req.OldObject = podRaw(t, tt.old)
+			}
+			resp := v.Review(context.Background(), req)
+			if resp.Allowed != tt.wantAllowed {
+				t.Errorf("Allowed = %v, want %v (result %+v)", resp.Allowed, tt.wantAllowed, resp.Result)
+			}
+		})
+	}
+}